@@ -0,0 +1,141 @@
+package admission
+
+import (
+	"Gateway/tenant"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	PriorityCritical = 0 // 关键请求，过载时也不会因为排队过久而被丢弃
+	PriorityHigh     = 1
+	PriorityNormal   = 2
+	PriorityLow      = 3
+	priorityCount    = 4
+
+	PriorityHeader = "X-Priority" // 受信任的客户端可以通过该请求头声明请求的优先级，取值为 critical/high/normal/low
+
+	trustedKey = "admission.trusted"
+)
+
+type trustedCtxKey struct{}
+
+var (
+	QueuePool      = &sync.Map{} // serviceName -> *Queue
+	routePriority  = &sync.Map{} // route -> priority
+	apiKeyPriority = &sync.Map{} // API key -> priority
+
+	// 为true时信任所有调用方声明的优先级，只应该在网关只对受信任的内部调用方开放时使用
+	TrustPriorityHeader = false
+
+	priorityNames = map[string]int{
+		"critical": PriorityCritical,
+		"high":     PriorityHigh,
+		"normal":   PriorityNormal,
+		"low":      PriorityLow,
+	}
+)
+
+// 为服务设置准入队列，会覆盖之前的队列
+func SetQueue(serviceName string, queue *Queue) {
+	QueuePool.Store(serviceName, queue)
+}
+
+func RemoveQueue(serviceName string) {
+	QueuePool.Delete(serviceName)
+}
+
+// 获取服务的准入队列，没有设置时返回nil
+func GetQueue(serviceName string) *Queue {
+	queue, ok := QueuePool.Load(serviceName)
+	if !ok {
+		return nil
+	}
+	return queue.(*Queue)
+}
+
+// 设置某个路由上所有请求的默认优先级，route 为tenant.Route返回的路由，例如 /sortService，teamA/sortService
+func SetRoutePriority(route string, priority int) {
+	routePriority.Store(route, priority)
+}
+
+// 设置使用某个API key（请求头 X-Api-Key）的请求的优先级
+func SetAPIKeyPriority(apiKey string, priority int) {
+	apiKeyPriority.Store(apiKey, priority)
+}
+
+// Trust 标记请求的调用方可以通过X-Priority声明优先级，例如API key的策略允许时
+// 没有被标记的请求的X-Priority会被忽略，否则任何匿名的客户端都可以把自己的请求声明为critical
+func Trust(c *gin.Context) {
+	c.Set(trustedKey, true)
+}
+
+// TrustContext 是Trust对应的原生grpc版本
+func TrustContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedCtxKey{}, true)
+}
+
+func trusted(c *gin.Context) bool {
+	return TrustPriorityHeader || c.GetBool(trustedKey)
+}
+
+func trustedContext(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedCtxKey{}).(bool)
+	return TrustPriorityHeader || trusted
+}
+
+// Classify 计算请求的优先级，依次根据API key，X-Priority 请求头和路由来决定，都没有配置时为PriorityNormal
+// 只有受信任的调用方声明的X-Priority才会生效，路由按照tenant.Route区分租户
+func Classify(c *gin.Context) int {
+	if apiKey := c.GetHeader("X-Api-Key"); apiKey != "" {
+		if priority, ok := apiKeyPriority.Load(apiKey); ok {
+			return priority.(int)
+		}
+	}
+	if trusted(c) {
+		if priority, ok := priorityNames[strings.ToLower(c.GetHeader(PriorityHeader))]; ok {
+			return priority
+		}
+	}
+	if priority, ok := routePriority.Load(tenant.Route(c)); ok {
+		return priority.(int)
+	}
+	return PriorityNormal
+}
+
+// ClassifyStream 计算原生grpc请求的优先级，规则和Classify相同，API key 和优先级分别从metadata x-api-key 和 x-priority 中读取
+func ClassifyStream(ctx context.Context, fullMethod string) int {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		if priority, ok := apiKeyPriority.Load(values[0]); ok {
+			return priority.(int)
+		}
+	}
+	if values := md.Get(strings.ToLower(PriorityHeader)); len(values) > 0 && trustedContext(ctx) {
+		if priority, ok := priorityNames[strings.ToLower(values[0])]; ok {
+			return priority
+		}
+	}
+	if priority, ok := routePriority.Load(tenant.GrpcRoute(ctx, fullMethod)); ok {
+		return priority.(int)
+	}
+	return PriorityNormal
+}
+
+// StatsHandler 返回请求所属租户的各个服务的准入队列的统计信息，包括队列深度和等待时间
+func StatsHandler(c *gin.Context) {
+	stats := map[string]Stats{}
+	name := tenant.Get(c)
+	QueuePool.Range(func(key, value interface{}) bool {
+		if tenant.Owns(name, key.(string)) {
+			stats[key.(string)] = value.(*Queue).Stats()
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": stats})
+}
@@ -0,0 +1,128 @@
+package admission
+
+import (
+	"Gateway/tenant"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestClassify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", PathPrefix: "/teamA"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	SetRoutePriority("teamA/classify", PriorityHigh)
+	defer routePriority.Delete("teamA/classify")
+	SetAPIKeyPriority("batch-key", PriorityLow)
+	defer apiKeyPriority.Delete("batch-key")
+
+	cases := []struct {
+		name     string
+		path     string
+		header   map[string]string
+		trusted  bool
+		trustAll bool
+		want     int
+	}{
+		{"default", "/classify", nil, false, false, PriorityNormal},
+		{"untrusted header is ignored", "/classify", map[string]string{PriorityHeader: "critical"}, false, false, PriorityNormal},
+		{"trusted header", "/classify", map[string]string{PriorityHeader: "critical"}, true, false, PriorityCritical},
+		{"trust all callers", "/classify", map[string]string{PriorityHeader: "low"}, false, true, PriorityLow},
+		{"unknown priority", "/classify", map[string]string{PriorityHeader: "urgent"}, true, false, PriorityNormal},
+		{"api key", "/classify", map[string]string{"X-Api-Key": "batch-key", PriorityHeader: "critical"}, true, false, PriorityLow},
+		{"tenant route", "/teamA/classify", nil, false, false, PriorityHigh},
+		{"route of other tenant", "/classify", nil, false, false, PriorityNormal},
+		{"untrusted header on tenant route", "/teamA/classify", map[string]string{PriorityHeader: "critical"}, false, false, PriorityHigh},
+	}
+	for _, c := range cases {
+		TrustPriorityHeader = c.trustAll
+		got := -1
+		router := gin.New()
+		router.GET("/classify", func(ctx *gin.Context) {
+			if c.trusted {
+				Trust(ctx)
+			}
+			got = Classify(ctx)
+		})
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		tenant.Handler(router).ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.want {
+			t.Errorf("%s: priority = %d, want %d", c.name, got, c.want)
+		}
+	}
+	TrustPriorityHeader = false
+}
+
+func TestClassifyStream(t *testing.T) {
+	SetRoutePriority("/pkg.Svc/Batch", PriorityLow)
+	defer routePriority.Delete("/pkg.Svc/Batch")
+	cases := []struct {
+		name     string
+		method   string
+		priority string
+		trusted  bool
+		want     int
+	}{
+		{"default", "/pkg.Svc/Call", "", false, PriorityNormal},
+		{"untrusted metadata is ignored", "/pkg.Svc/Call", "critical", false, PriorityNormal},
+		{"trusted metadata", "/pkg.Svc/Call", "critical", true, PriorityCritical},
+		{"method route", "/pkg.Svc/Batch", "", false, PriorityLow},
+	}
+	for _, c := range cases {
+		md := metadata.MD{}
+		if c.priority != "" {
+			md.Set(PriorityHeader, c.priority)
+		}
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		if c.trusted {
+			ctx = TrustContext(ctx)
+		}
+		if got := ClassifyStream(ctx, c.method); got != c.want {
+			t.Errorf("%s: priority = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStatsHandlerTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, serviceName := range []string{"StatsSvc", "teamA/StatsSvc", "teamB/StatsSvc"} {
+		SetQueue(serviceName, NewQueue(Config{MaxQueueLen: 1}, nil))
+		defer RemoveQueue(serviceName)
+	}
+	router := gin.New()
+	router.GET("/stats/admission", StatsHandler)
+	cases := []struct {
+		name   string
+		tenant string
+		want   string
+		hidden []string
+	}{
+		{"default tenant", "", "StatsSvc", []string{"teamA/StatsSvc", "teamB/StatsSvc"}},
+		{"tenant", "teamA", "teamA/StatsSvc", []string{`"StatsSvc"`, "teamB/StatsSvc"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/stats/admission", nil)
+		req = req.WithContext(tenant.NewContext(req.Context(), c.tenant))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		body := w.Body.String()
+		if !strings.Contains(body, c.want) {
+			t.Errorf("%s: stats %s should contain %s", c.name, body, c.want)
+		}
+		for _, hidden := range c.hidden {
+			if strings.Contains(body, hidden) {
+				t.Errorf("%s: stats %s should not contain %s", c.name, body, hidden)
+			}
+		}
+	}
+}
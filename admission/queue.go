@@ -0,0 +1,223 @@
+package admission
+
+import (
+	"Gateway/concurrency"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("admission queue is full")
+	ErrTimeout   = errors.New("wait in admission queue timeout")
+	ErrDropped   = errors.New("dropped from admission queue")
+)
+
+// 准入队列的配置
+// MaxQueueLen 表示队列中最多等待的请求数，队列满了之后新的请求会挤掉优先级更低的请求，或者被直接拒绝
+// Timeout 表示请求在队列中最长的等待时间
+// CoDelTarget 和 CoDelInterval 用于过载判断：队列在CoDelInterval内一直没有被清空，就认为服务处于过载状态，
+// 此时同一优先级内改为后进先出（尽量服务还没有被客户端放弃的新请求），并且丢弃排队时间超过CoDelTarget的请求
+type Config struct {
+	MaxQueueLen   int
+	Timeout       time.Duration
+	CoDelTarget   time.Duration
+	CoDelInterval time.Duration
+}
+
+// 队列的统计信息，时间的单位都是毫秒
+type Stats struct {
+	Depth           int                `json:"depth"`
+	DepthByPriority [priorityCount]int `json:"depthByPriority"`
+	AvgWaitMs       float64            `json:"avgWaitMs"`
+	MaxWaitMs       float64            `json:"maxWaitMs"`
+	Overloaded      bool               `json:"overloaded"`
+	Admitted        int64              `json:"admitted"`
+	Rejected        int64              `json:"rejected"`
+	Dropped         int64              `json:"dropped"`
+	Timeouts        int64              `json:"timeouts"`
+}
+
+type waiter struct {
+	result   chan error // 被调度时写入nil，被丢弃时写入ErrDropped
+	enqueue  time.Time
+	priority int
+	elem     *list.Element // 离开队列之后置为nil
+}
+
+// 服务前面的有界准入队列，请求需要从并发限制器中拿到名额才能执行，拿不到名额时按照优先级排队等待
+type Queue struct {
+	lock      *sync.Mutex
+	config    Config
+	limiter   concurrency.Limiter
+	waiters   [priorityCount]*list.List
+	length    int
+	lastEmpty time.Time // 队列最后一次为空的时间
+	stats     Stats
+}
+
+const waitDecay = 0.9 // 计算平均等待时间时旧值所占的比例
+
+func NewQueue(config Config, limiter concurrency.Limiter) *Queue {
+	q := &Queue{lock: &sync.Mutex{}, config: config, limiter: limiter, lastEmpty: time.Now()}
+	for i := range q.waiters {
+		q.waiters[i] = list.New()
+	}
+	return q
+}
+
+// Wait 等待获取执行名额，返回nil时表示已经拿到名额，请求执行完毕之后必须调用Release
+func (q *Queue) Wait(ctx context.Context, priority int) error {
+	if priority < PriorityCritical || priority >= priorityCount {
+		priority = PriorityNormal
+	}
+	now := time.Now()
+	q.lock.Lock()
+	q.dispatch(now)
+	if q.length == 0 && q.limiter.Acquire() {
+		q.stats.Admitted++
+		q.recordWait(0)
+		q.lock.Unlock()
+		return nil
+	}
+	if q.length >= q.config.MaxQueueLen {
+		victim := q.victim(priority)
+		if victim == nil {
+			q.stats.Rejected++
+			q.lock.Unlock()
+			return ErrQueueFull
+		}
+		q.remove(victim, now)
+		victim.result <- ErrDropped
+		q.stats.Dropped++
+	}
+	w := &waiter{result: make(chan error, 1), enqueue: now, priority: priority}
+	w.elem = q.waiters[priority].PushBack(w)
+	q.length++
+	q.lock.Unlock()
+
+	timer := time.NewTimer(q.config.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.result:
+		return err
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	q.lock.Lock()
+	if w.elem != nil {
+		q.remove(w, time.Now())
+		q.stats.Timeouts++
+		q.lock.Unlock()
+		return ErrTimeout
+	}
+	q.lock.Unlock()
+	// 超时的同时已经被调度或者丢弃了，结果一定已经写入了channel
+	return <-w.result
+}
+
+// Release 在请求执行完毕之后释放名额，并调度等待中的请求
+func (q *Queue) Release(rtt time.Duration, dropped bool) {
+	q.limiter.Release(rtt, dropped)
+	q.lock.Lock()
+	q.dispatch(time.Now())
+	q.lock.Unlock()
+}
+
+// 返回队列当前的统计信息
+func (q *Queue) Stats() Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	stats.Depth = q.length
+	for i, waiters := range q.waiters {
+		stats.DepthByPriority[i] = waiters.Len()
+	}
+	stats.Overloaded = q.overloaded(time.Now())
+	return stats
+}
+
+func (q *Queue) overloaded(now time.Time) bool {
+	return q.length > 0 && now.Sub(q.lastEmpty) > q.config.CoDelInterval
+}
+
+// 在持有锁的情况下调度等待中的请求，只要并发限制器还有名额，就按照优先级从高到低放行
+func (q *Queue) dispatch(now time.Time) {
+	overloaded := q.overloaded(now)
+	if overloaded {
+		q.dropExpired(now)
+	}
+	for q.length > 0 {
+		w := q.next(overloaded)
+		if !q.limiter.Acquire() {
+			break
+		}
+		q.remove(w, now)
+		q.stats.Admitted++
+		q.recordWait(now.Sub(w.enqueue))
+		w.result <- nil
+	}
+	if q.length == 0 {
+		q.lastEmpty = now
+	}
+}
+
+// 过载时丢弃排队时间已经超过CoDelTarget的请求，关键请求除外
+func (q *Queue) dropExpired(now time.Time) {
+	for priority := PriorityHigh; priority < priorityCount; priority++ {
+		waiters := q.waiters[priority]
+		// 队列头部是最早进入的请求，遇到第一个没有超时的请求就可以停止
+		for e := waiters.Front(); e != nil; e = waiters.Front() {
+			w := e.Value.(*waiter)
+			if now.Sub(w.enqueue) <= q.config.CoDelTarget {
+				break
+			}
+			q.remove(w, now)
+			q.stats.Dropped++
+			w.result <- ErrDropped
+		}
+	}
+}
+
+// 选出下一个应该被调度的请求，正常情况下同一优先级内先进先出，过载时后进先出
+func (q *Queue) next(overloaded bool) *waiter {
+	for _, waiters := range q.waiters {
+		if waiters.Len() == 0 {
+			continue
+		}
+		if overloaded {
+			return waiters.Back().Value.(*waiter)
+		}
+		return waiters.Front().Value.(*waiter)
+	}
+	return nil
+}
+
+// 队列满时选出一个优先级比priority低的请求让位，优先选择优先级最低并且最新进入的请求
+func (q *Queue) victim(priority int) *waiter {
+	for i := priorityCount - 1; i > priority; i-- {
+		if q.waiters[i].Len() > 0 {
+			return q.waiters[i].Back().Value.(*waiter)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) remove(w *waiter, now time.Time) {
+	q.waiters[w.priority].Remove(w.elem)
+	w.elem = nil
+	q.length--
+	if q.length == 0 {
+		q.lastEmpty = now
+	}
+}
+
+func (q *Queue) recordWait(wait time.Duration) {
+	ms := float64(wait) / float64(time.Millisecond)
+	q.stats.AvgWaitMs = q.stats.AvgWaitMs*waitDecay + ms*(1-waitDecay)
+	if ms > q.stats.MaxWaitMs {
+		q.stats.MaxWaitMs = ms
+	}
+}
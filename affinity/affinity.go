@@ -0,0 +1,147 @@
+package affinity
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Header = "X-Affinity" // 不支持cookie的客户端可以通过该请求头带上之前响应中的亲和性token
+)
+
+// 服务的会话亲和性配置
+// CookieName 为空时使用 gw_affinity_<serviceName>，租户的分隔符会被替换成 . ，TTL 表示token的有效期，每次请求成功之后都会重新签发，所以是滑动的有效期
+type Config struct {
+	CookieName string
+	TTL        time.Duration
+}
+
+var (
+	configs = &sync.Map{} // serviceName -> Config
+	secret  []byte        // 签名token的密钥
+)
+
+func init() {
+	// 没有设置密钥时使用随机的密钥，网关重启之后之前的token都会失效
+	secret = make([]byte, 32)
+	rand.Read(secret)
+}
+
+// 设置签名token的密钥，多个网关实例需要使用相同的密钥
+func SetSecret(key []byte) {
+	secret = key
+}
+
+// 为服务开启会话亲和性
+func SetConfig(serviceName string, config Config) {
+	if config.CookieName == "" {
+		// cookie的名字中不能带有 /
+		config.CookieName = "gw_affinity_" + strings.Replace(serviceName, tenant.Separator, ".", -1)
+	}
+	configs.Store(serviceName, config)
+}
+
+func RemoveConfig(serviceName string) {
+	configs.Delete(serviceName)
+}
+
+// token的格式为 base64(serviceName|serverID|过期时间).hex(HMAC-SHA256)
+func sign(serviceName, serverID string, expire time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(serviceName + "|" + serverID + "|" + strconv.FormatInt(expire.Unix(), 10)))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 校验token，返回其中的serverID，签名错误，过期或者不属于该服务时返回空字符串
+func verify(token, serviceName string, now time.Time) string {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return ""
+	}
+	signature, err := hex.DecodeString(token[i+1:])
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(token[:i]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 3 || parts[0] != serviceName {
+		return ""
+	}
+	expire, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() > expire {
+		return ""
+	}
+	return parts[1]
+}
+
+// Pinned 返回请求之前绑定的Invoker，服务没有开启亲和性，请求没有携带有效的token，
+// 或者绑定的Invoker已经被移出svrpool，不可用，不满足selector时返回nil，此时需要由调度器重新选择
+func Pinned(c *gin.Context, serviceName string, selector svrpool.Selector) svrpool.Invoker {
+	val, ok := configs.Load(serviceName)
+	if !ok {
+		return nil
+	}
+	config := val.(Config)
+	token := c.GetHeader(Header)
+	if token == "" {
+		token, _ = c.Cookie(config.CookieName)
+	}
+	if token == "" {
+		return nil
+	}
+	serverID := verify(token, serviceName, time.Now())
+	if serverID == "" {
+		return nil
+	}
+	snapshot, err := svrpool.GetSnapshot(serviceName)
+	if err != nil {
+		return nil
+	}
+	invoker, ok := snapshot.SvrMap[serverID]
+	if !ok || !snapshot.Matches(invoker, selector) || !svrpool.Available(serviceName, invoker) {
+		return nil
+	}
+	return invoker
+}
+
+// Bind 将请求绑定到处理它的Invoker上，通过cookie和响应头返回新的token
+func Bind(c *gin.Context, serviceName string, invoker svrpool.Invoker) {
+	val, ok := configs.Load(serviceName)
+	if !ok {
+		return
+	}
+	config := val.(Config)
+	snapshot, err := svrpool.GetSnapshot(serviceName)
+	if err != nil {
+		return
+	}
+	serverID := snapshot.ServerID(invoker)
+	if serverID == "" {
+		return
+	}
+	token := sign(serviceName, serverID, time.Now().Add(config.TTL))
+	c.Header(Header, token)
+	http.SetCookie(c.Writer, &http.Cookie{Name: config.CookieName, Value: token, Path: "/",
+		MaxAge: int(config.TTL / time.Second), HttpOnly: true, Secure: c.Request.TLS != nil, SameSite: http.SameSiteLaxMode})
+}
@@ -0,0 +1,144 @@
+package affinity
+
+import (
+	"Gateway/svrpool"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	valid := sign("teamA/SortService", "s1", now.Add(time.Minute))
+	oldSecret := secret
+	SetSecret([]byte("another gateway"))
+	otherSecret := sign("teamA/SortService", "s1", now.Add(time.Minute))
+	SetSecret(oldSecret)
+	i := strings.LastIndex(valid, ".")
+	// 修改签名的最后一位
+	tampered := valid[:len(valid)-1] + "0"
+	if strings.HasSuffix(valid, "0") {
+		tampered = valid[:len(valid)-1] + "1"
+	}
+
+	cases := []struct {
+		name        string
+		token       string
+		serviceName string
+		now         time.Time
+		want        string
+	}{
+		{"valid", valid, "teamA/SortService", now, "s1"},
+		{"valid until expire", valid, "teamA/SortService", now.Add(time.Minute), "s1"},
+		{"expired", valid, "teamA/SortService", now.Add(time.Minute + time.Second), ""},
+		// 一个服务签发的token不能用在其他服务或者其他租户的同名服务上
+		{"other service", valid, "teamA/OtherService", now, ""},
+		{"other tenant", valid, "teamB/SortService", now, ""},
+		{"signed by other secret", otherSecret, "teamA/SortService", now, ""},
+		{"tampered payload", sign("teamA/SortService", "s2", now.Add(time.Minute))[:i] + valid[i:], "teamA/SortService", now, ""},
+		{"tampered signature", tampered, "teamA/SortService", now, ""},
+		{"no signature", valid[:i], "teamA/SortService", now, ""},
+		{"invalid signature", valid[:i] + ".xyz", "teamA/SortService", now, ""},
+		{"empty", "", "teamA/SortService", now, ""},
+	}
+	for _, c := range cases {
+		if got := verify(c.token, c.serviceName, c.now); got != c.want {
+			t.Errorf("%s: verify = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+type namedInvoker struct {
+	name string
+}
+
+func (invoker *namedInvoker) Invoke(req []byte) ([]byte, error) {
+	return []byte(invoker.name), nil
+}
+
+func TestPinned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, serviceName := range []string{"teamA/SortService", "teamA/OtherService"} {
+		for _, serverID := range []string{"s1", "s2"} {
+			if _, err := svrpool.AddServer(serviceName, serverID, &namedInvoker{name: serverID}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		SetConfig(serviceName, Config{TTL: time.Minute})
+		defer RemoveConfig(serviceName)
+		defer svrpool.ServerPool.Delete(serviceName)
+	}
+	s1, _ := svrpool.GetInvoker("teamA/SortService", "s1")
+
+	// 先让s1处理一个请求，拿到绑定到s1的token
+	router := gin.New()
+	router.GET("/bind", func(c *gin.Context) {
+		Bind(c, "teamA/SortService", s1)
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bind", nil))
+	token := w.Header().Get(Header)
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Name != "gw_affinity_teamA.SortService" || cookies[0].Value != token {
+		t.Fatalf("bind: token = %q, cookies = %v", token, cookies)
+	}
+
+	var got svrpool.Invoker
+	var serviceName string
+	var selector svrpool.Selector
+	router.GET("/pinned", func(c *gin.Context) {
+		got = Pinned(c, serviceName, selector)
+	})
+	cases := []struct {
+		name        string
+		serviceName string
+		header      string
+		cookie      *http.Cookie
+		selector    string
+		want        string
+	}{
+		{"header", "teamA/SortService", token, nil, "", "s1"},
+		{"cookie", "teamA/SortService", "", cookies[0], "", "s1"},
+		// token被重放到其他服务时不生效，即使其他服务有同名的服务器
+		{"replayed to other service", "teamA/OtherService", token, nil, "", ""},
+		{"replayed cookie to other service", "teamA/OtherService", "", &http.Cookie{Name: "gw_affinity_teamA.OtherService", Value: token}, "", ""},
+		{"not matched by selector", "teamA/SortService", token, nil, "version=v2", ""},
+		{"no token", "teamA/SortService", "", nil, "", ""},
+		{"no config", "teamB/SortService", token, nil, "", ""},
+	}
+	for _, c := range cases {
+		got, serviceName = nil, c.serviceName
+		selector, _ = svrpool.ParseSelector(c.selector)
+		req := httptest.NewRequest(http.MethodGet, "/pinned", nil)
+		if c.header != "" {
+			req.Header.Set(Header, c.header)
+		}
+		if c.cookie != nil {
+			req.AddCookie(c.cookie)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		name := ""
+		if got != nil {
+			name = got.(*namedInvoker).name
+		}
+		if name != c.want {
+			t.Errorf("%s: pinned = %q, want %q", c.name, name, c.want)
+		}
+	}
+
+	// 绑定的服务器被移除之后由调度器重新选择
+	if _, err := svrpool.RemoveInvoker("teamA/SortService", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	got, serviceName, selector = nil, "teamA/SortService", nil
+	req := httptest.NewRequest(http.MethodGet, "/pinned", nil)
+	req.Header.Set(Header, token)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if got != nil {
+		t.Errorf("removed server is still pinned")
+	}
+}
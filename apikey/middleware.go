@@ -0,0 +1,213 @@
+package apikey
+
+import (
+	"Gateway/admission"
+	"Gateway/proxy"
+	"Gateway/ratelimit"
+	"Gateway/tenant"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	Header     = "X-Api-Key" // 客户端通过该请求头（grpc中为metadata x-api-key）携带API key
+	ContextKey = "apikey.policy"
+)
+
+// 检查策略是否允许访问租户，路由和服务，路由为空（例如没有匹配到任何路由）时不检查路由
+// key只能访问所属租户的请求，不属于任何租户的key只能访问默认租户
+// route 为tenant.Route或者tenant.GrpcRoute返回的路由，策略中的Routes是相对于key所属租户的，所以比较时去掉租户的前缀
+func (policy *Policy) allow(tenantName, route, serviceName string) bool {
+	if policy.Tenant != tenantName {
+		return false
+	}
+	if route != "" && len(policy.Routes) > 0 && !contains(policy.Routes, strings.TrimPrefix(route, tenantName)) {
+		return false
+	}
+	if serviceName != "" && len(policy.Services) > 0 && !contains(policy.Services, serviceName) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, target string) bool {
+	for _, val := range values {
+		if val == target {
+			return true
+		}
+	}
+	return false
+}
+
+// 对一次请求执行完整的检查：key是否有效，是否有权限访问，配额和限流是否允许
+// 被限流时同时返回需要等待的时间
+func (store *Store) authorize(key, tenantName, route, serviceName string) (*Policy, time.Duration, error) {
+	policy, err := store.Lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !policy.allow(tenantName, route, serviceName) {
+		return nil, 0, ErrForbidden
+	}
+	if policy.RateLimit > 0 {
+		rule := &ratelimit.Rule{Algorithm: ratelimit.TokenBucket, Rate: policy.RateLimit, Period: time.Second, Burst: policy.Burst}
+		allowed, retryAfter, err := ratelimit.Allow(ratelimit.DefaultStore, "apikey|"+policy.ID, rule)
+		if err == nil && !allowed {
+			return nil, retryAfter, ErrRateLimited
+		}
+	}
+	if !store.consume(policy) {
+		return nil, time.Until(tomorrow()), ErrQuotaExceeded
+	}
+	return policy, 0, nil
+}
+
+func tomorrow() time.Time {
+	year, month, day := time.Now().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.Local)
+}
+
+// 请求要访问的服务名，普通请求放在Query参数service中，gRPC-Web请求放在路径中
+func requestService(c *gin.Context) string {
+	if serviceName := c.Query("service"); serviceName != "" {
+		return serviceName
+	}
+	if fullMethod := c.Param("method"); fullMethod != "" {
+		return grpcServiceName(tenant.Get(c), fullMethod)
+	}
+	return ""
+}
+
+// 使用和代理相同的方式从 /pkg.Service/Method 中解析出实际调用的服务名，返回相对于租户的名字
+// 例如注册了 pkg.Service 时为 pkg.Service，否则为 Service，方法名不合法时原样返回，不会匹配任何服务
+func grpcServiceName(tenantName, fullMethod string) string {
+	qualified, err := proxy.GrpcServiceName(tenantName, fullMethod)
+	if err != nil {
+		return fullMethod
+	}
+	_, serviceName := tenant.Split(qualified)
+	return serviceName
+}
+
+// Middleware 返回执行API key认证的中间件
+// 没有携带key或者key无效时返回401，没有权限时返回403，配额用尽或者被限流时返回429
+// CORS预检请求不会携带key，所以直接放行
+func Middleware(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		key := c.GetHeader(Header)
+		// 没有通过域名或者路径前缀确定租户时，使用key所属的租户，确定了其他租户时由authorize返回403
+		if policy, err := store.Lookup(key); err == nil {
+			tenant.Bind(c, policy.Tenant)
+		}
+		policy, retryAfter, err := store.authorize(key, tenant.Get(c), tenant.Route(c), requestService(c))
+		switch err {
+		case nil:
+			c.Set(ContextKey, policy)
+			if policy.TrustPriority {
+				admission.Trust(c)
+			}
+			c.Next()
+		case ErrForbidden:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		case ErrQuotaExceeded, ErrRateLimited:
+			ratelimit.Reject(c, retryAfter)
+		default:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		}
+	}
+}
+
+// StreamInterceptor 返回原生grpc入口使用的认证拦截器，key放在metadata x-api-key 中
+// 原生grpc请求的路由为完整的方法名，例如 /sortService.SortService/Sort，限制了Routes的key需要在其中列出允许调用的方法
+func StreamInterceptor(store *Store) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		var key string
+		if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+			if vals := md.Get(Header); len(vals) > 0 {
+				key = vals[0]
+			}
+		}
+		ctx := ss.Context()
+		// 没有通过 :authority 确定租户时，使用key所属的租户
+		if policy, err := store.Lookup(key); err == nil && policy.Tenant != "" && tenant.FromContext(ctx) == "" {
+			ctx = tenant.NewContext(ctx, policy.Tenant)
+		}
+		policy, _, err := store.authorize(key, tenant.FromContext(ctx), tenant.GrpcRoute(ctx, info.FullMethod), grpcServiceName(tenant.FromContext(ctx), info.FullMethod))
+		switch err {
+		case nil:
+			if policy.TrustPriority {
+				ctx = admission.TrustContext(ctx)
+			}
+			return handler(srv, &policyStream{ServerStream: ss, ctx: ctx})
+		case ErrForbidden:
+			return status.Error(codes.PermissionDenied, err.Error())
+		case ErrQuotaExceeded, ErrRateLimited:
+			return status.Error(codes.ResourceExhausted, err.Error())
+		default:
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+}
+
+// 携带key的策略所决定的租户和信任标记的ServerStream，后面的handler通过tenant.FromContext获取租户
+type policyStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *policyStream) Context() context.Context {
+	return stream.ctx
+}
+
+// 获取中间件保存在context中的策略
+func GetPolicy(c *gin.Context) *Policy {
+	policy, ok := c.Get(ContextKey)
+	if !ok {
+		return nil
+	}
+	return policy.(*Policy)
+}
+
+type rotateRequest struct {
+	ID          string `json:"id"`
+	GraceSecond int64  `json:"graceSecond"`
+}
+
+// RotateHandler 为指定的ID轮换key，只有Admin的key可以调用，旧的key在graceSecond秒之后失效
+// 属于租户的Admin只能轮换本租户的key，不属于任何租户的Admin可以轮换所有的key
+func RotateHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := GetPolicy(c)
+		if policy == nil || !policy.Admin {
+			c.JSON(http.StatusForbidden, gin.H{"code": -1, "msg": ErrForbidden.Error(), "rsp": nil})
+			return
+		}
+		var req rotateRequest
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+			return
+		}
+		key, err := store.Rotate(req.ID, policy.Tenant, time.Duration(req.GraceSecond)*time.Second)
+		if err == ErrForbidden {
+			c.JSON(http.StatusForbidden, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": key})
+	}
+}
@@ -0,0 +1,301 @@
+package apikey
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestPolicyAllow(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  *Policy
+		tenant  string
+		route   string
+		service string
+		want    bool
+	}{
+		{"default key on default tenant", &Policy{}, "", "/sortService", "SortService", true},
+		{"default key on other tenant", &Policy{}, "teamA", "teamA/sortService", "SortService", false},
+		{"tenant key on own tenant", &Policy{Tenant: "teamA"}, "teamA", "teamA/sortService", "SortService", true},
+		{"tenant key on default tenant", &Policy{Tenant: "teamA"}, "", "/sortService", "SortService", false},
+		{"tenant key on other tenant", &Policy{Tenant: "teamA"}, "teamB", "teamB/sortService", "SortService", false},
+		{"relative route of tenant key", &Policy{Tenant: "teamA", Routes: []string{"/sortService"}}, "teamA", "teamA/sortService", "", true},
+		{"route not allowed", &Policy{Routes: []string{"/sortService"}}, "", "/ws", "", false},
+		{"grpc method not allowed", &Policy{Routes: []string{"/sortService"}}, "", "/sortService.SortService/Sort", "SortService", false},
+		{"grpc method allowed", &Policy{Routes: []string{"/sortService.SortService/Sort"}}, "", "/sortService.SortService/Sort", "SortService", true},
+		{"relative grpc method of tenant key", &Policy{Tenant: "teamA", Routes: []string{"/sortService.SortService/Sort"}}, "teamA", "teamA/sortService.SortService/Sort", "SortService", true},
+		{"service not allowed", &Policy{Services: []string{"SortService"}}, "", "/sortService", "Other", false},
+	}
+	for _, c := range cases {
+		if got := c.policy.allow(c.tenant, c.route, c.service); got != c.want {
+			t.Errorf("%s: allow = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 测试使用的明文key和对应的策略，写入key文件时Hash由明文的key计算
+var testKeys = map[string]Policy{
+	"default-key":      {ID: "default", Routes: []string{"/sortService", "/sortService.SortService/Sort"}},
+	"team-a-key":       {ID: "team-a", Tenant: "teamA", Routes: []string{"/sortService", "/sortService.SortService/Sort"}},
+	"team-b-key":       {ID: "team-b", Tenant: "teamB"},
+	"admin-key":        {ID: "admin", Admin: true},
+	"team-a-admin-key": {ID: "team-a-admin", Tenant: "teamA", Admin: true},
+	"expiring-key":     {ID: "expiring", ExpiresAt: time.Now().Add(time.Hour)},
+}
+
+// 把testKeys写入dir中的key文件并加载，Rotate会把新的key写回该文件，所以dir由调用方在测试结束之后删除
+func newTestStore(t *testing.T, dir string) *Store {
+	var file keyFile
+	for key, policy := range testKeys {
+		policy.Hash = HashKey(key)
+		p := policy
+		file.Keys = append(file.Keys, &p)
+	}
+	content, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestMiddlewareTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", PathPrefix: "/teamA"}, {Name: "teamB", PathPrefix: "/teamB"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	router := gin.New()
+	router.Use(Middleware(newTestStore(t, dir)))
+	resolved := ""
+	router.POST("/sortService", func(c *gin.Context) {
+		resolved = tenant.Get(c)
+		c.Status(http.StatusOK)
+	})
+	router.POST("/ws", func(c *gin.Context) { c.Status(http.StatusOK) })
+	handler := tenant.Handler(router)
+
+	cases := []struct {
+		name       string
+		path       string
+		key        string
+		want       int
+		wantTenant string
+	}{
+		{"default key", "/sortService", "default-key", http.StatusOK, ""},
+		{"default key on tenant", "/teamA/sortService", "default-key", http.StatusForbidden, ""},
+		{"tenant key", "/teamA/sortService", "team-a-key", http.StatusOK, "teamA"},
+		{"tenant key binds unresolved request", "/sortService", "team-a-key", http.StatusOK, "teamA"},
+		{"tenant key on other tenant", "/teamB/sortService", "team-a-key", http.StatusForbidden, ""},
+		{"route not allowed", "/teamA/ws", "team-a-key", http.StatusForbidden, ""},
+		{"missing key", "/sortService", "", http.StatusUnauthorized, ""},
+		{"invalid key", "/sortService", "bad-key", http.StatusUnauthorized, ""},
+	}
+	for _, c := range cases {
+		resolved = ""
+		req := httptest.NewRequest(http.MethodPost, c.path, nil)
+		if c.key != "" {
+			req.Header.Set(Header, c.key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.want || resolved != c.wantTenant {
+			t.Errorf("%s: status = %d, tenant = %q, want %d, %q", c.name, w.Code, resolved, c.want, c.wantTenant)
+		}
+	}
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *testStream) Context() context.Context {
+	return ss.ctx
+}
+
+func TestStreamInterceptorTenant(t *testing.T) {
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", Hosts: []string{"a.example.com"}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	interceptor := StreamInterceptor(newTestStore(t, dir))
+
+	cases := []struct {
+		name       string
+		authority  string
+		key        string
+		method     string
+		want       codes.Code
+		wantTenant string
+	}{
+		{"default key", "gw.example.com", "default-key", "/sortService.SortService/Sort", codes.OK, ""},
+		{"default key on tenant host", "a.example.com", "default-key", "/sortService.SortService/Sort", codes.PermissionDenied, ""},
+		{"tenant key on tenant host", "a.example.com", "team-a-key", "/sortService.SortService/Sort", codes.OK, "teamA"},
+		{"tenant key binds unresolved request", "gw.example.com", "team-a-key", "/sortService.SortService/Sort", codes.OK, "teamA"},
+		{"missing key", "gw.example.com", "", "/sortService.SortService/Sort", codes.Unauthenticated, ""},
+		{"method not in routes", "gw.example.com", "default-key", "/sortService.SortService/Admin", codes.PermissionDenied, ""},
+	}
+	for _, c := range cases {
+		md := metadata.Pairs(":authority", c.authority)
+		if c.key != "" {
+			md.Set(Header, c.key)
+		}
+		ss := &testStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+		resolved := ""
+		err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: c.method},
+			func(srv interface{}, stream grpc.ServerStream) error {
+				resolved = tenant.FromContext(stream.Context())
+				return nil
+			})
+		if got := status.Code(err); got != c.want || resolved != c.wantTenant {
+			t.Errorf("%s: code = %s, tenant = %q, want %s, %q", c.name, got, resolved, c.want, c.wantTenant)
+		}
+	}
+}
+
+func TestRotateHandlerTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", PathPrefix: "/teamA"}, {Name: "teamB", PathPrefix: "/teamB"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := newTestStore(t, dir)
+	router := gin.New()
+	router.Use(Middleware(store))
+	router.POST("/admin/apikeys/rotate", RotateHandler(store))
+	handler := tenant.Handler(router)
+
+	cases := []struct {
+		name string
+		path string
+		key  string
+		id   string
+		want int
+	}{
+		{"not admin", "/teamB/admin/apikeys/rotate", "team-b-key", "team-b", http.StatusForbidden},
+		{"tenant admin rotates own tenant", "/teamA/admin/apikeys/rotate", "team-a-admin-key", "team-a", http.StatusOK},
+		{"tenant admin rotates other tenant", "/teamA/admin/apikeys/rotate", "team-a-admin-key", "team-b", http.StatusForbidden},
+		{"tenant admin rotates default tenant", "/teamA/admin/apikeys/rotate", "team-a-admin-key", "default", http.StatusForbidden},
+		{"global admin rotates any tenant", "/admin/apikeys/rotate", "admin-key", "team-b", http.StatusOK},
+		{"unknown id", "/admin/apikeys/rotate", "admin-key", "nobody", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(`{"id": "`+c.id+`", "graceSecond": 60}`))
+		req.Header.Set(Header, c.key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d, body %s", c.name, w.Code, c.want, w.Body.String())
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := newTestStore(t, dir)
+	now := time.Now()
+	cases := []struct {
+		name          string
+		id            string
+		grace         time.Duration
+		wantErr       bool
+		wantOldExpire time.Time // 旧key轮换之后的过期时间
+	}{
+		{"negative grace", "default", -time.Second, true, time.Time{}},
+		{"no expiration", "default", time.Minute, false, now.Add(time.Minute)},
+		// 旧key在grace之前就会过期时保持原来的过期时间，新key不会跟着过期
+		{"expires before grace", "expiring", 2 * time.Hour, false, testKeys["expiring-key"].ExpiresAt},
+	}
+	for _, c := range cases {
+		oldKey := c.id + "-key"
+		key, err := store.Rotate(c.id, "", c.grace)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		rotated, err := store.Lookup(key)
+		if err != nil || !rotated.ExpiresAt.IsZero() {
+			t.Errorf("%s: new key err = %v, expires at %v", c.name, err, rotated.ExpiresAt)
+		}
+		old, err := store.Lookup(oldKey)
+		if err != nil || old.ExpiresAt.Sub(c.wantOldExpire) > time.Second || c.wantOldExpire.Sub(old.ExpiresAt) > time.Second {
+			t.Errorf("%s: old key err = %v, expires at %v, want %v", c.name, err, old.ExpiresAt, c.wantOldExpire)
+		}
+	}
+}
+
+func TestGrpcServiceName(t *testing.T) {
+	svrpool.SchedulerPool.Store("pkg.Service", struct{ svrpool.Scheduler }{})
+	svrpool.SchedulerPool.Store("teamA/pkg.Service", struct{ svrpool.Scheduler }{})
+	defer svrpool.SchedulerPool.Delete("pkg.Service")
+	defer svrpool.SchedulerPool.Delete("teamA/pkg.Service")
+	cases := []struct {
+		name       string
+		tenant     string
+		fullMethod string
+		services   []string // 策略允许的服务
+		want       string
+		wantAllow  bool
+	}{
+		{"registered with package", "", "/pkg.Service/Call", []string{"pkg.Service"}, "pkg.Service", true},
+		// 允许Service不能访问到实际被调用的pkg.Service
+		{"bare name of registered package", "", "/pkg.Service/Call", []string{"Service"}, "pkg.Service", false},
+		{"fallback to bare name", "", "/other.Service/Call", []string{"Service"}, "Service", true},
+		{"package of fallback", "", "/other.Service/Call", []string{"other.Service"}, "Service", false},
+		{"tenant", "teamA", "/pkg.Service/Call", []string{"pkg.Service"}, "pkg.Service", true},
+		{"tenant fallback", "teamB", "/pkg.Service/Call", []string{"pkg.Service"}, "Service", false},
+		{"invalid method", "", "/teamB/pkg.Service/Call", []string{"pkg.Service"}, "/teamB/pkg.Service/Call", false},
+	}
+	for _, c := range cases {
+		got := grpcServiceName(c.tenant, c.fullMethod)
+		if got != c.want {
+			t.Errorf("%s: service = %q, want %q", c.name, got, c.want)
+		}
+		policy := &Policy{Tenant: c.tenant, Services: c.services}
+		if allowed := policy.allow(c.tenant, "", got); allowed != c.wantAllow {
+			t.Errorf("%s: allow = %v, want %v", c.name, allowed, c.wantAllow)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingKey    = errors.New("api key is missing")
+	ErrInvalidKey    = errors.New("api key is invalid")
+	ErrForbidden     = errors.New("api key is not allowed to access this resource")
+	ErrQuotaExceeded = errors.New("daily quota of api key is exhausted")
+	ErrRateLimited   = errors.New("too many requests with this api key")
+)
+
+// 一个API key对应的策略
+// ID 是key的持有者，同一个ID可以同时有多个key（例如轮换期间新旧两个key同时有效），配额和限流都按照ID计算
+// Hash 是key的SHA-256（十六进制），文件中不保存明文的key
+// Services 和 Routes 分别表示允许访问的服务和路由，为空表示不限制，原生grpc请求的路由为完整的方法名，例如 /sortService.SortService/Sort
+// DailyQuota 表示每天允许的请求数，RateLimit 和 Burst 表示每秒允许的请求数和突发请求数，为0都表示不限制
+// ExpiresAt 表示key的过期时间，为零值表示永不过期
+// Admin 表示该key是否可以执行key轮换等管理操作
+// Tenant 表示key所属的租户，key只能访问该租户，为空表示只能访问默认租户，Services 中的服务名和Routes 中的路由都是相对于该租户的
+// TrustPriority 表示使用该key的客户端是否可以通过X-Priority声明请求的优先级
+type Policy struct {
+	ID            string    `json:"id"`
+	Hash          string    `json:"hash"`
+	Services      []string  `json:"services,omitempty"`
+	Routes        []string  `json:"routes,omitempty"`
+	DailyQuota    int64     `json:"dailyQuota,omitempty"`
+	RateLimit     int64     `json:"rateLimit,omitempty"`
+	Burst         int64     `json:"burst,omitempty"`
+	ExpiresAt     time.Time `json:"expiresAt,omitempty"`
+	Disabled      bool      `json:"disabled,omitempty"`
+	Admin         bool      `json:"admin,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	TrustPriority bool      `json:"trustPriority,omitempty"`
+}
+
+type keyFile struct {
+	Keys []*Policy `json:"keys"`
+}
+
+type quota struct {
+	day  string
+	used int64
+}
+
+// 基于文件的API key存储，文件被修改之后会自动重新加载
+type Store struct {
+	lock     *sync.RWMutex
+	path     string
+	modTime  time.Time
+	policies []*Policy
+	byHash   map[string]*Policy
+	quotas   map[string]*quota // ID -> 当天的用量
+}
+
+// 返回key的SHA-256，用于生成key文件中的hash字段
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewStore(path string) (*Store, error) {
+	store := &Store{lock: &sync.RWMutex{}, path: path, quotas: map[string]*quota{}}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *Store) load() error {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return err
+	}
+	var file keyFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return err
+	}
+	byHash := make(map[string]*Policy, len(file.Keys))
+	for _, policy := range file.Keys {
+		if policy.RateLimit < 0 || policy.Burst < 0 || policy.DailyQuota < 0 {
+			return errors.New("quota, rate limit and burst of api key " + policy.ID + " should not be negative")
+		}
+		byHash[policy.Hash] = policy
+	}
+	store.lock.Lock()
+	store.policies, store.byHash, store.modTime = file.Keys, byHash, info.ModTime()
+	store.lock.Unlock()
+	return nil
+}
+
+// Watch 每隔interval检查一次key文件，文件被修改之后重新加载，加载失败时继续使用之前的key
+func (store *Store) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			info, err := os.Stat(store.path)
+			if err != nil {
+				log.Println("stat api key file failed, the err is", err)
+				continue
+			}
+			store.lock.RLock()
+			changed := !info.ModTime().Equal(store.modTime)
+			store.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := store.load(); err != nil {
+				log.Println("reload api key file failed, the err is", err)
+				continue
+			}
+			log.Println("api key file reloaded")
+		}
+	}()
+}
+
+// 根据明文的key查找对应的策略，key不存在，已经过期或者被禁用时返回ErrInvalidKey
+func (store *Store) Lookup(key string) (*Policy, error) {
+	if key == "" {
+		return nil, ErrMissingKey
+	}
+	store.lock.RLock()
+	policy, ok := store.byHash[HashKey(key)]
+	store.lock.RUnlock()
+	if !ok || policy.Disabled {
+		return nil, ErrInvalidKey
+	}
+	if !policy.ExpiresAt.IsZero() && time.Now().After(policy.ExpiresAt) {
+		return nil, ErrInvalidKey
+	}
+	return policy, nil
+}
+
+// 消耗一次ID当天的配额，配额用尽时返回false
+func (store *Store) consume(policy *Policy) bool {
+	if policy.DailyQuota <= 0 {
+		return true
+	}
+	day := time.Now().Format("2006-01-02")
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	q, ok := store.quotas[policy.ID]
+	if !ok || q.day != day {
+		q = &quota{day: day}
+		store.quotas[policy.ID] = q
+	}
+	if q.used >= policy.DailyQuota {
+		return false
+	}
+	q.used++
+	return true
+}
+
+// Rotate 为ID生成一个新的key，新key继承旧key除过期时间之外的策略，旧key在grace之后过期，返回新key的明文
+// tenantName 为调用方所属的租户，只能轮换该租户的key，为空表示全局的管理员，可以轮换任意租户的key，否则返回ErrForbidden
+// 新的key会被写回key文件，明文只会在这里返回一次
+func (store *Store) Rotate(id, tenantName string, grace time.Duration) (string, error) {
+	if grace < 0 {
+		return "", errors.New("grace period should not be negative")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var current *Policy
+	for _, policy := range store.policies {
+		if policy.ID == id && !policy.Disabled && (policy.ExpiresAt.IsZero() || policy.ExpiresAt.After(time.Now())) {
+			current = policy
+		}
+	}
+	if current == nil {
+		return "", errors.New("no active key for id " + id)
+	}
+	if tenantName != "" && current.Tenant != tenantName {
+		return "", ErrForbidden
+	}
+	rotated := *current
+	rotated.Hash = HashKey(key)
+	// 旧key可能已经设置了过期时间，新key不能和它一起过期
+	rotated.ExpiresAt = time.Time{}
+	expiresAt := time.Now().Add(grace)
+	// 修改副本而不是原来的策略，因为其他goroutine可能正在读取原来的策略
+	policies := make([]*Policy, 0, len(store.policies)+1)
+	byHash := make(map[string]*Policy, len(store.policies)+1)
+	for _, policy := range store.policies {
+		if policy.ID == id && (policy.ExpiresAt.IsZero() || policy.ExpiresAt.After(expiresAt)) {
+			expiring := *policy
+			expiring.ExpiresAt = expiresAt
+			policy = &expiring
+		}
+		policies = append(policies, policy)
+		byHash[policy.Hash] = policy
+	}
+	policies = append(policies, &rotated)
+	byHash[rotated.Hash] = &rotated
+	if err := store.save(policies); err != nil {
+		return "", err
+	}
+	store.policies, store.byHash = policies, byHash
+	return key, nil
+}
+
+// 先写入临时文件再重命名，避免写到一半时被Watch读到
+func (store *Store) save(policies []*Policy) error {
+	content, err := json.MarshalIndent(keyFile{Keys: policies}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), ".apikeys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), store.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(store.path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
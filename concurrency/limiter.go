@@ -0,0 +1,174 @@
+package concurrency
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// 自适应的并发限制器，限制一个服务同时在处理的请求数，并根据调用的耗时和失败情况动态调整上限
+// Acquire 尝试获取一个执行名额，获取失败说明服务已经过载，请求应当被直接拒绝
+// Release 在调用结束之后释放名额，rtt 为本次调用的耗时，dropped 表示调用失败（会被当作过载的信号）
+// 流式调用的时长取决于客户端，不能反映后端的处理能力，这类调用以NoRtt释放名额，只有dropped会影响上限
+type Limiter interface {
+	Acquire() bool
+	Release(rtt time.Duration, dropped bool)
+	Limit() int
+	Inflight() int
+}
+
+// 表示调用没有耗时样本
+const NoRtt = time.Duration(-1)
+
+var (
+	LimiterPool = &sync.Map{} // serviceName -> Limiter
+)
+
+// 为服务设置并发限制器，会覆盖之前的限制器
+func SetLimiter(serviceName string, limiter Limiter) {
+	LimiterPool.Store(serviceName, limiter)
+}
+
+func RemoveLimiter(serviceName string) {
+	LimiterPool.Delete(serviceName)
+}
+
+// 获取服务的并发限制器，没有设置时返回nil
+func GetLimiter(serviceName string) Limiter {
+	limiter, ok := LimiterPool.Load(serviceName)
+	if !ok {
+		return nil
+	}
+	return limiter.(Limiter)
+}
+
+// limiter 是AIMD和Gradient限制器共用的名额计数部分
+type limiter struct {
+	lock     *sync.Mutex
+	limit    float64
+	inflight int
+	minLimit float64
+	maxLimit float64
+}
+
+func (l *limiter) Acquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+func (l *limiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.limit)
+}
+
+func (l *limiter) Inflight() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inflight
+}
+
+func (l *limiter) clamp(limit float64) float64 {
+	if limit < l.minLimit {
+		return l.minLimit
+	}
+	if limit > l.maxLimit {
+		return l.maxLimit
+	}
+	return limit
+}
+
+// AIMD（加性增，乘性减）限制器
+// 调用成功并且名额使用过半时上限加1，调用失败或者耗时超过Timeout时上限乘以BackoffRatio
+type AIMDLimiter struct {
+	limiter
+	BackoffRatio float64
+	Timeout      time.Duration
+}
+
+func NewAIMDLimiter(initLimit, minLimit, maxLimit int, backoffRatio float64, timeout time.Duration) *AIMDLimiter {
+	return &AIMDLimiter{
+		limiter: limiter{lock: &sync.Mutex{}, limit: float64(initLimit),
+			minLimit: float64(minLimit), maxLimit: float64(maxLimit)},
+		BackoffRatio: backoffRatio,
+		Timeout:      timeout,
+	}
+}
+
+func (l *AIMDLimiter) Release(rtt time.Duration, dropped bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	if dropped || rtt > l.Timeout {
+		l.limit = l.clamp(l.limit * l.BackoffRatio)
+		return
+	}
+	if rtt == NoRtt {
+		return
+	}
+	if float64(inflight)*2 >= l.limit {
+		l.limit = l.clamp(l.limit + 1)
+	}
+}
+
+// Gradient限制器，思路类似于TCP Vegas
+// 用较长时间窗口的平均耗时作为服务的基准耗时，与最近一次的耗时做比较得到梯度：
+// 耗时变长说明请求在后端开始排队，梯度小于1，上限随之减小；耗时稳定时梯度为1，上限会加上一个允许排队的余量慢慢增长
+// Tolerance 表示可以容忍的耗时增长比例，例如1.5表示耗时增长到基准的1.5倍以内都不会减小上限
+// Smoothing 表示每次调整上限时新值所占的比例
+type GradientLimiter struct {
+	limiter
+	Tolerance float64
+	Smoothing float64
+	longRtt   float64 // 基准耗时的指数移动平均值，单位为纳秒
+}
+
+const gradientLongDecay = 0.99 // 计算基准耗时时旧值所占的比例
+
+func NewGradientLimiter(initLimit, minLimit, maxLimit int, tolerance, smoothing float64) *GradientLimiter {
+	return &GradientLimiter{
+		limiter: limiter{lock: &sync.Mutex{}, limit: float64(initLimit),
+			minLimit: float64(minLimit), maxLimit: float64(maxLimit)},
+		Tolerance: tolerance,
+		Smoothing: smoothing,
+	}
+}
+
+func (l *GradientLimiter) Release(rtt time.Duration, dropped bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	if dropped {
+		l.limit = l.clamp(l.limit * 0.9)
+		return
+	}
+	if rtt == NoRtt {
+		return
+	}
+	shortRtt := float64(rtt)
+	if l.longRtt == 0 {
+		l.longRtt = shortRtt
+	} else {
+		l.longRtt = l.longRtt*gradientLongDecay + shortRtt*(1-gradientLongDecay)
+	}
+	// 名额没有被充分使用时耗时不能反映服务的处理能力，不调整上限
+	if float64(inflight)*2 < l.limit {
+		return
+	}
+	gradient := l.Tolerance * l.longRtt / shortRtt
+	if gradient > 1 {
+		gradient = 1
+	} else if gradient < 0.5 {
+		gradient = 0.5
+	}
+	queueSize := math.Sqrt(l.limit)
+	newLimit := l.limit*gradient + queueSize
+	l.limit = l.clamp(l.limit*(1-l.Smoothing) + newLimit*l.Smoothing)
+}
@@ -0,0 +1,88 @@
+package concurrency
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	l := NewAIMDLimiter(2, 1, 10, 0.5, time.Second)
+	for i, want := range []bool{true, true, false} {
+		if got := l.Acquire(); got != want {
+			t.Errorf("acquire %d = %v, want %v", i, got, want)
+		}
+	}
+	if l.Inflight() != 2 {
+		t.Errorf("inflight = %d, want 2", l.Inflight())
+	}
+	l.Release(time.Millisecond, false)
+	if !l.Acquire() {
+		t.Error("acquire after release failed")
+	}
+}
+
+func TestAIMDRelease(t *testing.T) {
+	cases := []struct {
+		name      string
+		limit     float64
+		inflight  int // Release之前正在处理的请求数，包括被释放的这一个
+		rtt       time.Duration
+		dropped   bool
+		wantLimit float64
+	}{
+		{"success with half used", 10, 5, time.Millisecond, false, 11},
+		{"success with few used", 10, 4, time.Millisecond, false, 10},
+		{"capped by max", 12, 12, time.Millisecond, false, 12},
+		{"dropped", 10, 5, time.Millisecond, true, 5},
+		{"timeout", 10, 5, 2 * time.Second, false, 5},
+		{"floored by min", 3, 1, time.Millisecond, true, 2},
+		// 没有耗时样本的流式调用只释放名额
+		{"no rtt", 10, 5, NoRtt, false, 10},
+		{"no rtt but dropped", 10, 5, NoRtt, true, 5},
+	}
+	for _, c := range cases {
+		l := NewAIMDLimiter(0, 2, 12, 0.5, time.Second)
+		l.limit, l.inflight = c.limit, c.inflight
+		l.Release(c.rtt, c.dropped)
+		if l.limit != c.wantLimit || l.inflight != c.inflight-1 {
+			t.Errorf("%s: limit = %v, inflight = %d, want %v, %d", c.name, l.limit, l.inflight, c.wantLimit, c.inflight-1)
+		}
+	}
+}
+
+func TestGradientRelease(t *testing.T) {
+	ms := float64(time.Millisecond)
+	cases := []struct {
+		name        string
+		limit       float64
+		inflight    int
+		longRtt     float64
+		rtt         time.Duration
+		dropped     bool
+		wantLimit   float64
+		wantLongRtt float64
+	}{
+		// 第一次调用时以本次的耗时作为基准，梯度被限制为1，上限增加 sqrt(limit) 的20%
+		{"first sample", 100, 100, 0, 10 * time.Millisecond, false, 102, 10 * ms},
+		{"stable latency", 100, 100, 10 * ms, 10 * time.Millisecond, false, 102, 10 * ms},
+		// 梯度 = 1.5 * 10.1 / 20 = 0.7575，新的上限 = 75.75 + 10，平滑之后为 80 + 17.15
+		{"latency doubled", 100, 100, 10 * ms, 20 * time.Millisecond, false, 97.15, 10.1 * ms},
+		// 梯度 = 1.5 * 10.3 / 40 < 0.5，被限制为0.5
+		{"latency quadrupled", 100, 100, 10 * ms, 40 * time.Millisecond, false, 92, 10.3 * ms},
+		{"underused", 100, 40, 10 * ms, 40 * time.Millisecond, false, 100, 10.3 * ms},
+		{"dropped", 100, 100, 10 * ms, 40 * time.Millisecond, true, 90, 10 * ms},
+		{"floored by min", 10, 10, 10 * ms, time.Millisecond, true, 10, 10 * ms},
+		{"capped by max", 500, 500, 10 * ms, 10 * time.Millisecond, false, 500, 10 * ms},
+		{"no rtt", 100, 100, 10 * ms, NoRtt, false, 100, 10 * ms},
+		{"no rtt but dropped", 100, 100, 10 * ms, NoRtt, true, 90, 10 * ms},
+	}
+	for _, c := range cases {
+		l := NewGradientLimiter(0, 10, 500, 1.5, 0.2)
+		l.limit, l.inflight, l.longRtt = c.limit, c.inflight, c.longRtt
+		l.Release(c.rtt, c.dropped)
+		if math.Abs(l.limit-c.wantLimit) > 1e-6 || math.Abs(l.longRtt-c.wantLongRtt) > 1 {
+			t.Errorf("%s: limit = %v, longRtt = %v, want %v, %v", c.name, l.limit, l.longRtt, c.wantLimit, c.wantLongRtt)
+		}
+	}
+}
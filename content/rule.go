@@ -0,0 +1,336 @@
+package content
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 对一个值的匹配条件，由字符串解析得到：
+// "v2" 表示等于v2，"!=v1" 表示不等于v1，">=100"，">100"，"<=100"，"<100" 表示数字的大小比较，
+// "~^gold-" 表示匹配正则表达式，"*" 表示值存在即可
+type Matcher struct {
+	op    string
+	value string
+	num   float64
+	re    *regexp.Regexp
+}
+
+func ParseMatcher(s string) (Matcher, error) {
+	if s == "*" {
+		return Matcher{op: "*"}, nil
+	}
+	if strings.HasPrefix(s, "~") {
+		re, err := regexp.Compile(s[1:])
+		if err != nil {
+			return Matcher{}, err
+		}
+		return Matcher{op: "~", re: re}, nil
+	}
+	for _, op := range []string{"!=", ">=", "<=", ">", "<"} {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		m := Matcher{op: op, value: strings.TrimSpace(s[len(op):])}
+		if op != "!=" {
+			num, err := strconv.ParseFloat(m.value, 64)
+			if err != nil {
+				return Matcher{}, errors.New("value of " + s + " should be a number")
+			}
+			m.num = num
+		}
+		return m, nil
+	}
+	return Matcher{op: "=", value: s}, nil
+}
+
+// 判断值是否满足条件，present为false表示值不存在，此时只有 != 满足
+func (m Matcher) Match(value string, present bool) bool {
+	if !present {
+		return m.op == "!="
+	}
+	switch m.op {
+	case "*":
+		return true
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "~":
+		return m.re.MatchString(value)
+	}
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch m.op {
+	case ">=":
+		return num >= m.num
+	case "<=":
+		return num <= m.num
+	case ">":
+		return num > m.num
+	case "<":
+		return num < m.num
+	}
+	return false
+}
+
+// 规则选中之后请求的去向，Service 为空时使用请求中的服务名，Selector 用于选出服务中的子集
+type Target struct {
+	Service  string
+	Selector svrpool.Selector
+}
+
+// 一条路由规则，所有的条件都满足时规则才匹配
+// Headers，Query 的key分别为请求头和Query参数的名字，Body 的key为JSON请求体中的路径，例如 options.algo，data.0，
+// 路径以 # 结尾时表示数组，对象或者字符串的长度，例如 data.# 表示data数组的元素个数
+// MinBodySize 和 MaxBodySize 限制请求体的字节数，为0表示不限制
+type Rule struct {
+	Name        string
+	Headers     map[string]Matcher
+	Query       map[string]Matcher
+	Body        map[string]Matcher
+	MinBodySize int
+	MaxBodySize int
+	Target      Target
+	hits        *int64
+}
+
+// 一个路由的所有规则，按照顺序匹配，第一个匹配的规则决定请求的去向，都不匹配时使用Default，Default为nil时请求不受影响
+type Table struct {
+	Rules   []*Rule
+	Default *Target
+	misses  *int64
+}
+
+var (
+	tables = &sync.Map{} // route -> *Table，route 为tenant.Route返回的路由，例如 /sortService，teamA/sortService
+)
+
+// 为路由设置规则，会覆盖之前的规则
+func SetTable(route string, table *Table) {
+	for _, rule := range table.Rules {
+		rule.hits = new(int64)
+	}
+	table.misses = new(int64)
+	tables.Store(route, table)
+}
+
+func RemoveTable(route string) {
+	tables.Delete(route)
+}
+
+// Resolve 根据请求选出去向，body是已经读取的请求体，路由没有配置规则或者没有匹配的规则并且没有Default时返回nil
+func Resolve(c *gin.Context, body []byte) *Target {
+	val, ok := tables.Load(tenant.Route(c))
+	if !ok {
+		return nil
+	}
+	table := val.(*Table)
+	var doc interface{}
+	parsed := false
+	for _, rule := range table.Rules {
+		if len(rule.Body) > 0 && !parsed {
+			// 只有在需要时才解析请求体，并且只解析一次，解析失败时所有的路径都不存在
+			parsed = true
+			if json.Unmarshal(body, &doc) != nil {
+				doc = nil
+			}
+		}
+		if rule.matches(c, body, doc) {
+			atomic.AddInt64(rule.hits, 1)
+			return &rule.Target
+		}
+	}
+	atomic.AddInt64(table.misses, 1)
+	return table.Default
+}
+
+func (rule *Rule) matches(c *gin.Context, body []byte, doc interface{}) bool {
+	if rule.MinBodySize > 0 && len(body) < rule.MinBodySize {
+		return false
+	}
+	if rule.MaxBodySize > 0 && len(body) > rule.MaxBodySize {
+		return false
+	}
+	for name, m := range rule.Headers {
+		_, present := c.Request.Header[http.CanonicalHeaderKey(name)]
+		if !m.Match(c.GetHeader(name), present) {
+			return false
+		}
+	}
+	for name, m := range rule.Query {
+		value, present := c.GetQuery(name)
+		if !m.Match(value, present) {
+			return false
+		}
+	}
+	for path, m := range rule.Body {
+		value, present := lookup(doc, path)
+		if !m.Match(value, present) {
+			return false
+		}
+	}
+	return true
+}
+
+// 在JSON文档中根据路径查找值，返回值的字符串形式
+func lookup(doc interface{}, path string) (string, bool) {
+	current := doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if part == "#" {
+				return strconv.Itoa(len(node)), true
+			}
+			next, ok := node[part]
+			if !ok {
+				return "", false
+			}
+			current = next
+		case []interface{}:
+			if part == "#" {
+				return strconv.Itoa(len(node)), true
+			}
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			current = node[i]
+		case string:
+			if part == "#" {
+				return strconv.Itoa(len(node)), true
+			}
+			return "", false
+		default:
+			return "", false
+		}
+	}
+	switch value := current.(type) {
+	case nil:
+		return "null", true
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	content, _ := json.Marshal(current)
+	return string(content), true
+}
+
+// StatsHandler 返回请求所属租户的每个路由中各条规则命中的次数，default表示没有规则匹配的次数
+func StatsHandler(c *gin.Context) {
+	stats := map[string]map[string]int64{}
+	name := tenant.Get(c)
+	tables.Range(func(key, value interface{}) bool {
+		if !tenant.Owns(name, key.(string)) {
+			return true
+		}
+		table := value.(*Table)
+		routeStats := map[string]int64{"default": atomic.LoadInt64(table.misses)}
+		for i, rule := range table.Rules {
+			name := rule.Name
+			if name == "" {
+				name = "rule-" + strconv.Itoa(i)
+			}
+			routeStats[name] = atomic.LoadInt64(rule.hits)
+		}
+		stats[key.(string)] = routeStats
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": stats})
+}
+
+type targetFile struct {
+	Service  string `json:"service"`
+	Selector string `json:"selector"`
+}
+
+type ruleFile struct {
+	Name        string            `json:"name"`
+	Headers     map[string]string `json:"headers"`
+	Query       map[string]string `json:"query"`
+	Body        map[string]string `json:"body"`
+	MinBodySize int               `json:"minBodySize"`
+	MaxBodySize int               `json:"maxBodySize"`
+	Target      targetFile        `json:"target"`
+}
+
+type tableFile struct {
+	Rules   []ruleFile  `json:"rules"`
+	Default *targetFile `json:"default"`
+}
+
+// 从JSON文件中加载各个路由的规则，格式为
+// {"/sortService": {"rules": [{"name": "large", "body": {"data.#": ">=100000"}, "target": {"selector": "memory>=16"}}], "default": {"selector": "memory<16"}}}
+func LoadRules(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var files map[string]tableFile
+	if err := json.Unmarshal(content, &files); err != nil {
+		return err
+	}
+	for route, file := range files {
+		table := &Table{}
+		for _, rf := range file.Rules {
+			rule := &Rule{Name: rf.Name, MinBodySize: rf.MinBodySize, MaxBodySize: rf.MaxBodySize}
+			if rule.Headers, err = parseMatchers(rf.Headers); err != nil {
+				return err
+			}
+			if rule.Query, err = parseMatchers(rf.Query); err != nil {
+				return err
+			}
+			if rule.Body, err = parseMatchers(rf.Body); err != nil {
+				return err
+			}
+			if rule.Target, err = parseTarget(rf.Target); err != nil {
+				return err
+			}
+			table.Rules = append(table.Rules, rule)
+		}
+		if file.Default != nil {
+			target, err := parseTarget(*file.Default)
+			if err != nil {
+				return err
+			}
+			table.Default = &target
+		}
+		SetTable(route, table)
+	}
+	return nil
+}
+
+func parseMatchers(conditions map[string]string) (map[string]Matcher, error) {
+	matchers := make(map[string]Matcher, len(conditions))
+	for key, condition := range conditions {
+		m, err := ParseMatcher(condition)
+		if err != nil {
+			return nil, err
+		}
+		matchers[key] = m
+	}
+	return matchers, nil
+}
+
+func parseTarget(file targetFile) (Target, error) {
+	selector, err := svrpool.ParseSelector(file.Selector)
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{Service: file.Service, Selector: selector}, nil
+}
@@ -0,0 +1,181 @@
+package content
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseMatcher(t *testing.T) {
+	cases := []struct {
+		s       string
+		wantOp  string
+		wantErr bool
+	}{
+		{"v2", "=", false},
+		{"", "=", false},
+		{"*", "*", false},
+		{"!=v1", "!=", false},
+		{">=100", ">=", false},
+		{"> 1.5", ">", false},
+		{"<=0", "<=", false},
+		{"<-3", "<", false},
+		{"~^gold-", "~", false},
+		{">abc", "", true},
+		{"<", "", true},
+		{"~(", "", true},
+	}
+	for _, c := range cases {
+		m, err := ParseMatcher(c.s)
+		if (err != nil) != c.wantErr {
+			t.Errorf("ParseMatcher(%q): err = %v, wantErr %v", c.s, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && m.op != c.wantOp {
+			t.Errorf("ParseMatcher(%q): op = %q, want %q", c.s, m.op, c.wantOp)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		matcher string
+		value   string
+		present bool
+		want    bool
+	}{
+		{"v2", "v2", true, true},
+		{"v2", "v3", true, false},
+		{"v2", "", false, false},
+		{"*", "", true, true},
+		{"*", "", false, false},
+		{"!=v1", "v2", true, true},
+		{"!=v1", "v1", true, false},
+		// 值不存在时只有 != 满足
+		{"!=v1", "", false, true},
+		{">=100", "100", true, true},
+		{">=100", "99.9", true, false},
+		{">100", "100", true, false},
+		{"<=100", "100", true, true},
+		{"<100", "-1", true, true},
+		{">100", "abc", true, false},
+		{"~^gold-", "gold-1", true, true},
+		{"~^gold-", "silver-gold-1", true, false},
+	}
+	for _, c := range cases {
+		m, err := ParseMatcher(c.matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(c.value, c.present); got != c.want {
+			t.Errorf("%q.Match(%q, %v) = %v, want %v", c.matcher, c.value, c.present, got, c.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var doc interface{}
+	body := `{"options": {"algo": "quick", "stable": true, "limit": 10.5, "extra": null},
+		"data": [3, 1, 2], "name": "sort", "nested": [{"id": 7}], "empty": {}}`
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path        string
+		want        string
+		wantPresent bool
+	}{
+		{"options.algo", "quick", true},
+		{"options.stable", "true", true},
+		{"options.limit", "10.5", true},
+		{"options.extra", "null", true},
+		{"options.missing", "", false},
+		{"options.#", "4", true},
+		{"data.0", "3", true},
+		{"data.#", "3", true},
+		{"data.3", "", false},
+		{"data.-1", "", false},
+		{"data.x", "", false},
+		{"name.#", "4", true},
+		{"name.first", "", false},
+		{"nested.0.id", "7", true},
+		{"data", "[3,1,2]", true},
+		{"empty", "{}", true},
+		{"options.algo.x", "", false},
+	}
+	for _, c := range cases {
+		got, present := lookup(doc, c.path)
+		if got != c.want || present != c.wantPresent {
+			t.Errorf("lookup(%q) = %q, %v, want %q, %v", c.path, got, present, c.want, c.wantPresent)
+		}
+	}
+	if _, present := lookup(nil, "options.algo"); present {
+		t.Error("lookup in an unparsed body should find nothing")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mustParse := func(s string) Matcher {
+		m, err := ParseMatcher(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	SetTable("/resolve", &Table{
+		Rules: []*Rule{
+			{Name: "beta", Headers: map[string]Matcher{"X-Beta": mustParse("*")}, Target: Target{Service: "Beta"}},
+			{Name: "debug", Query: map[string]Matcher{"debug": mustParse("1")}, Target: Target{Service: "Debug"}},
+			{Name: "big", Body: map[string]Matcher{"data.#": mustParse(">=3")}, Target: Target{Service: "Big"}},
+			{Name: "large body", MinBodySize: 100, Target: Target{Service: "Large"}},
+		},
+		Default: &Target{Service: "Default"},
+	})
+	defer RemoveTable("/resolve")
+	var got *Target
+	router := gin.New()
+	router.POST("/resolve", func(c *gin.Context) {
+		body, _ := c.GetRawData()
+		got = Resolve(c, body)
+	})
+	router.POST("/unrouted", func(c *gin.Context) {
+		got = Resolve(c, nil)
+	})
+
+	cases := []struct {
+		name   string
+		target string
+		header string
+		body   string
+		want   string
+	}{
+		{"header", "/resolve", "X-Beta", `{"data": [1]}`, "Beta"},
+		{"first match wins", "/resolve?debug=1", "X-Beta", `{"data": [1, 2, 3]}`, "Beta"},
+		{"query", "/resolve?debug=1", "", `{"data": [1, 2, 3]}`, "Debug"},
+		{"body", "/resolve?debug=0", "", `{"data": [1, 2, 3]}`, "Big"},
+		{"body size", "/resolve", "", `{"padding": "` + strings.Repeat("x", 100) + `"}`, "Large"},
+		{"invalid json", "/resolve", "", `{"data": [1, 2, 3]`, "Default"},
+		{"default", "/resolve", "", `{"data": [1]}`, "Default"},
+		{"no table", "/unrouted", "", "", ""},
+	}
+	for _, c := range cases {
+		got = nil
+		req := httptest.NewRequest(http.MethodPost, c.target, strings.NewReader(c.body))
+		if c.header != "" {
+			req.Header.Set(c.header, "1")
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		service := ""
+		if got != nil {
+			service = got.Service
+		}
+		if service != c.want {
+			t.Errorf("%s: target = %q, want %q", c.name, service, c.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.12
 require (
 	github.com/gin-gonic/gin v1.6.3
 	github.com/golang/protobuf v1.4.1
+	github.com/gorilla/websocket v1.4.2
 	golang.org/x/tools v0.0.0-20200527150044-688b3c5d9fa5 // indirect
 	google.golang.org/grpc v1.29.1
 	google.golang.org/protobuf v1.24.0
@@ -0,0 +1,251 @@
+package health
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// 主动健康检查的配置
+// Interval 和 Timeout 分别表示检查的间隔和每次检查的超时时间
+// HealthyThreshold 表示不健康的Invoker连续检查成功多少次之后恢复健康，UnhealthyThreshold 表示健康的Invoker连续检查失败多少次之后变为不健康
+// GrpcService 是grpc健康检查协议中的服务名，为空表示检查后端整体的健康状态
+type Config struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	GrpcService        string
+}
+
+// 通过HTTP接口进行健康检查的Invoker，GET HealthURL 返回2xx表示健康
+type HTTPInvoker interface {
+	svrpool.Invoker
+	HealthURL() string
+}
+
+// 一个Invoker的健康状态
+type InvokerHealth struct {
+	Healthy         bool      `json:"healthy"`
+	ConsecutiveOK   int       `json:"consecutiveOK"`
+	ConsecutiveFail int       `json:"consecutiveFail"`
+	LastCheck       time.Time `json:"lastCheck"`
+	LastError       string    `json:"lastError,omitempty"`
+	invoker         svrpool.Invoker
+}
+
+// 一个服务的健康检查器，周期性地检查服务的所有Invoker
+type checker struct {
+	serviceName string
+	config      Config
+	lock        *sync.RWMutex
+	states      map[string]*InvokerHealth // serverID -> 健康状态
+	byInvoker   map[svrpool.Invoker]*InvokerHealth
+	stop        chan struct{}
+}
+
+var (
+	checkers   = &sync.Map{} // serviceName -> *checker
+	filterOnce = &sync.Once{}
+	httpClient = &http.Client{}
+)
+
+// Start 开始对服务进行主动健康检查，已经在检查的服务会使用新的配置重新开始
+// 检查失败的Invoker会被svrpool.Available过滤掉，从而不会被调度器选中
+func Start(serviceName string, config Config) {
+	filterOnce.Do(func() {
+		svrpool.AddFilter(filter)
+	})
+	c := &checker{serviceName: serviceName, config: config, lock: &sync.RWMutex{},
+		states: map[string]*InvokerHealth{}, byInvoker: map[svrpool.Invoker]*InvokerHealth{}, stop: make(chan struct{})}
+	if old, loaded := checkers.Load(serviceName); loaded {
+		close(old.(*checker).stop)
+	}
+	checkers.Store(serviceName, c)
+	go c.run()
+}
+
+// 停止对服务的健康检查，之后该服务的所有Invoker都被认为是健康的
+func Stop(serviceName string) {
+	if old, loaded := checkers.Load(serviceName); loaded {
+		checkers.Delete(serviceName)
+		close(old.(*checker).stop)
+	}
+}
+
+// 提供给svrpool的过滤器，还没有被检查过的Invoker被认为是健康的
+func filter(serviceName string, invoker svrpool.Invoker) bool {
+	val, ok := checkers.Load(serviceName)
+	if !ok {
+		return true
+	}
+	c := val.(*checker)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if state, ok := c.byInvoker[invoker]; ok {
+		return state.Healthy
+	}
+	return true
+}
+
+func (c *checker) run() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// 并发地检查服务的所有Invoker，已经被移出Server pool的Invoker的状态会被清除
+// 无法主动检查的Invoker不会被记录状态，由过滤器当作健康的Invoker处理，是否可用交给被动的异常检测判断
+func (c *checker) checkAll() {
+	invokers, err := svrpool.ListInvokers(c.serviceName)
+	if err != nil {
+		invokers = map[string]svrpool.Invoker{}
+	}
+	results := make(map[string]error, len(invokers))
+	resultLock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for serverID, invoker := range invokers {
+		if !probeable(invoker) {
+			continue
+		}
+		wg.Add(1)
+		go func(serverID string, invoker svrpool.Invoker) {
+			defer wg.Done()
+			err := c.probe(invoker)
+			resultLock.Lock()
+			results[serverID] = err
+			resultLock.Unlock()
+		}(serverID, invoker)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	states := make(map[string]*InvokerHealth, len(invokers))
+	byInvoker := make(map[svrpool.Invoker]*InvokerHealth, len(invokers))
+	for serverID, invoker := range invokers {
+		if !probeable(invoker) {
+			continue
+		}
+		state, ok := c.states[serverID]
+		if !ok || state.invoker != invoker {
+			state = &InvokerHealth{Healthy: true, invoker: invoker}
+		}
+		state.update(results[serverID], now, c.config)
+		states[serverID] = state
+		byInvoker[invoker] = state
+	}
+	c.states, c.byInvoker = states, byInvoker
+}
+
+func (state *InvokerHealth) update(err error, now time.Time, config Config) {
+	state.LastCheck = now
+	if err == nil {
+		state.ConsecutiveOK++
+		state.ConsecutiveFail = 0
+		state.LastError = ""
+		if !state.Healthy && state.ConsecutiveOK >= config.HealthyThreshold {
+			state.Healthy = true
+		}
+		return
+	}
+	state.ConsecutiveFail++
+	state.ConsecutiveOK = 0
+	state.LastError = err.Error()
+	if state.Healthy && state.ConsecutiveFail >= config.UnhealthyThreshold {
+		state.Healthy = false
+	}
+}
+
+// 判断Invoker是否支持主动健康检查
+func probeable(invoker svrpool.Invoker) bool {
+	switch invoker.(type) {
+	case HTTPInvoker, svrpool.StreamInvoker:
+		return true
+	}
+	return false
+}
+
+// 对一个Invoker执行一次检查，grpc的Invoker使用grpc.health.v1协议，HTTP的Invoker使用GET请求
+// 后端没有实现grpc健康检查服务时，只要调用能够到达后端就认为是健康的
+func (c *checker) probe(invoker svrpool.Invoker) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+	switch inv := invoker.(type) {
+	case HTTPInvoker:
+		req, err := http.NewRequest(http.MethodGet, inv.HealthURL(), nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+			return fmt.Errorf("health check returns status %d", rsp.StatusCode)
+		}
+		return nil
+	case svrpool.StreamInvoker:
+		client := healthpb.NewHealthClient(inv.ClientConn())
+		rsp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: c.config.GrpcService})
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("health check returns %s", rsp.Status)
+		}
+		return nil
+	}
+	return errors.New("invoker doesn't support health check")
+}
+
+// 返回服务所有Invoker的健康状态，key为服务器的ID
+func Status(serviceName string) map[string]InvokerHealth {
+	result := map[string]InvokerHealth{}
+	val, ok := checkers.Load(serviceName)
+	if !ok {
+		return result
+	}
+	c := val.(*checker)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for serverID, state := range c.states {
+		result[serverID] = *state
+	}
+	return result
+}
+
+// StatsHandler 返回请求所属租户中被检查的各个服务的Invoker的健康状态
+func StatsHandler(c *gin.Context) {
+	stats := map[string]map[string]InvokerHealth{}
+	name := tenant.Get(c)
+	checkers.Range(func(key, value interface{}) bool {
+		if tenant.Owns(name, key.(string)) {
+			stats[key.(string)] = Status(key.(string))
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": stats})
+}
@@ -0,0 +1,111 @@
+package health
+
+import (
+	"Gateway/svrpool"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	config := Config{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	failed := errors.New("connection refused")
+	cases := []struct {
+		name        string
+		err         error
+		wantHealthy bool
+	}{
+		{"first failure", failed, true},
+		{"second failure", failed, true},
+		{"third failure", failed, false},
+		{"still failing", failed, false},
+		{"first success", nil, false},
+		{"second success", nil, true},
+		// 连续失败的计数在成功之后重新开始
+		{"failure after recovery", failed, true},
+		{"success resets failures", nil, true},
+		{"failure again", failed, true},
+		{"failure twice", failed, true},
+		{"failure three times", failed, false},
+		{"success interrupted", nil, false},
+		{"failure resets successes", failed, false},
+		{"single success", nil, false},
+	}
+	state := &InvokerHealth{Healthy: true}
+	for _, c := range cases {
+		state.update(c.err, time.Now(), config)
+		if state.Healthy != c.wantHealthy {
+			t.Errorf("%s: healthy = %v, want %v", c.name, state.Healthy, c.wantHealthy)
+		}
+		if (state.LastError != "") != (c.err != nil) {
+			t.Errorf("%s: lastError = %q", c.name, state.LastError)
+		}
+	}
+}
+
+type plainInvoker struct{ id int }
+
+func (invoker *plainInvoker) Invoke(req []byte) ([]byte, error) {
+	return req, nil
+}
+
+type httpInvoker struct {
+	plainInvoker
+	url string
+}
+
+func (invoker *httpInvoker) HealthURL() string {
+	return invoker.url
+}
+
+func TestCheckAll(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	serviceName := "TestCheckAll"
+	invokers := map[string]svrpool.Invoker{
+		"plain":   &plainInvoker{id: 1},
+		"healthy": &httpInvoker{plainInvoker{id: 2}, healthy.URL},
+		"broken":  &httpInvoker{plainInvoker{id: 3}, broken.URL},
+	}
+	for serverID, invoker := range invokers {
+		if _, err := svrpool.AddServer(serviceName, serverID, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer svrpool.ServerPool.Delete(serviceName)
+	c := &checker{serviceName: serviceName, config: Config{Timeout: time.Second, HealthyThreshold: 1, UnhealthyThreshold: 2},
+		lock: &sync.RWMutex{}, states: map[string]*InvokerHealth{}, byInvoker: map[svrpool.Invoker]*InvokerHealth{}}
+	checkers.Store(serviceName, c)
+	defer checkers.Delete(serviceName)
+	for i := 0; i < 3; i++ {
+		c.checkAll()
+	}
+
+	cases := []struct {
+		serverID    string
+		wantTracked bool
+		wantHealthy bool
+	}{
+		// 无法主动检查的Invoker不会因为检查失败而被剔除
+		{"plain", false, true},
+		{"healthy", true, true},
+		{"broken", true, false},
+	}
+	for _, tc := range cases {
+		_, tracked := c.states[tc.serverID]
+		if tracked != tc.wantTracked {
+			t.Errorf("%s: tracked = %v, want %v", tc.serverID, tracked, tc.wantTracked)
+		}
+		if got := filter(serviceName, invokers[tc.serverID]); got != tc.wantHealthy {
+			t.Errorf("%s: healthy = %v, want %v", tc.serverID, got, tc.wantHealthy)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey = errors.New("signing key of token is unknown")
+)
+
+// JWKS中的一个key，只解析校验签名需要的字段
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// 从文件或者HTTP地址加载的一组用于校验签名的key
+// 加载后的key会缓存TTL的时间，过期之后在下一次查找时重新加载
+// 遇到未知的kid时（通常是签发方轮换了key）也会立即重新加载，但两次重新加载的间隔不会小于MinRefreshInterval
+type KeySet struct {
+	Source             string // 以 http:// 或 https:// 开头时从HTTP地址加载，否则作为文件路径
+	TTL                time.Duration
+	MinRefreshInterval time.Duration
+
+	lock        *sync.RWMutex
+	refreshLock *sync.Mutex            // 保证同一时间只有一个重新加载
+	keys        map[string]interface{} // kid -> *rsa.PublicKey / *ecdsa.PublicKey / []byte
+	loadedAt    time.Time
+	refreshedAt time.Time
+	client      *http.Client
+}
+
+func NewKeySet(source string, ttl, minRefreshInterval time.Duration) (*KeySet, error) {
+	ks := &KeySet{Source: source, TTL: ttl, MinRefreshInterval: minRefreshInterval,
+		lock: &sync.RWMutex{}, refreshLock: &sync.Mutex{}, client: &http.Client{Timeout: 5 * time.Second}}
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// 根据kid查找key，kid为空并且只有一个key时返回该key
+func (ks *KeySet) Lookup(kid string) (interface{}, error) {
+	key, ok, needRefresh := ks.check(kid)
+	if needRefresh {
+		// 同一时间只有一个请求重新加载，等待的请求在加载完成之后重新检查，大量伪造的kid也不会让加载的次数成倍增加
+		ks.refreshLock.Lock()
+		if key, ok, needRefresh = ks.check(kid); needRefresh {
+			if err := ks.refresh(); err != nil {
+				// 重新加载失败时继续使用缓存中的key，避免签发方短暂不可用导致所有请求失败
+				log.Println("refresh jwks failed, the err is", err)
+			}
+			ks.lock.RLock()
+			key, ok = ks.find(kid)
+			ks.lock.RUnlock()
+		}
+		ks.refreshLock.Unlock()
+	}
+	if ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// 返回缓存中kid对应的key，以及是否需要重新加载：key不存在或者已经过期，并且距离上一次重新加载超过了MinRefreshInterval
+func (ks *KeySet) check(kid string) (interface{}, bool, bool) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	key, ok := ks.find(kid)
+	expired := time.Since(ks.loadedAt) > ks.TTL
+	canRefresh := time.Since(ks.refreshedAt) > ks.MinRefreshInterval
+	return key, ok, (!ok || expired) && canRefresh
+}
+
+func (ks *KeySet) find(kid string) (interface{}, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// 加载结束之后才记录加载的时间，正在加载时查找未知kid的请求会在refreshLock上等待这次加载的结果
+func (ks *KeySet) refresh() error {
+	defer func() {
+		ks.lock.Lock()
+		ks.refreshedAt = time.Now()
+		ks.lock.Unlock()
+	}()
+	content, err := ks.fetch()
+	if err != nil {
+		return err
+	}
+	var set jsonWebKeySet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.parse()
+		if err != nil {
+			log.Printf("skip jwk %s, the err is %v\n", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	ks.lock.Lock()
+	ks.keys, ks.loadedAt = keys, time.Now()
+	ks.lock.Unlock()
+	return nil
+}
+
+func (ks *KeySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ks.Source, "http://") && !strings.HasPrefix(ks.Source, "https://") {
+		return ioutil.ReadFile(ks.Source)
+	}
+	rsp, err := ks.client.Get(ks.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.New("fetch jwks failed, status is " + rsp.Status)
+	}
+	return ioutil.ReadAll(rsp.Body)
+}
+
+func (jwk *jsonWebKey) parse() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	}
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,56 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 同时查找大量未知的kid时只会重新加载一次，等待加载的请求可以找到轮换之后的key
+func TestConcurrentUnknownKid(t *testing.T) {
+	var fetches int64
+	jwks := jsonWebKeySet{Keys: []jsonWebKey{{Kty: "oct", Kid: "k1", K: base64.RawURLEncoding.EncodeToString(testSecret)}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一次之后的加载返回轮换之后的key
+		if atomic.AddInt64(&fetches, 1) > 1 {
+			time.Sleep(20 * time.Millisecond)
+			jwks.Keys[0].Kid = "k2"
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer srv.Close()
+	keys, err := NewKeySet(srv.URL, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 允许立即重新加载一次
+	keys.refreshedAt = time.Time{}
+
+	var wg sync.WaitGroup
+	var forged, rotated int64
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		kid, found := "forged", &forged
+		if i%2 == 0 {
+			kid, found = "k2", &rotated
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := keys.Lookup(kid); err == nil {
+				atomic.AddInt64(found, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if fetches != 2 || forged != 0 || rotated != 10 {
+		t.Errorf("fetches = %d, forged found = %d, rotated found = %d, want 2, 0, 10", fetches, forged, rotated)
+	}
+}
@@ -0,0 +1,191 @@
+package jwt
+
+import (
+	"Gateway/proxy"
+	"Gateway/tenant"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ContextKey     = "jwt.claims"
+	metadataPrefix = "x-jwt-" // 转发给后端的声明在metadata中的前缀，例如sub声明会被转发为 x-jwt-sub
+)
+
+// 路由对token的要求
+// Scopes 表示token的scope（或者scp）声明中必须包含的所有scope
+// Claims 表示token中必须具有的声明及其取值
+type Requirement struct {
+	Scopes []string
+	Claims map[string]string
+}
+
+var (
+	routeRequirements = &sync.Map{} // route -> *Requirement，route 为tenant.Route返回的路由，原生grpc为tenant.GrpcRoute返回的完整方法名
+	forwardClaims     []string      // 需要转发给后端的声明
+)
+
+func init() {
+	// 客户端自己携带的同名metadata不可信，不会被转发给后端
+	proxy.ReservePrefix(metadataPrefix)
+}
+
+// 为路由设置token的要求，设置了要求的路由必须携带有效的token
+func SetRouteRequirement(route string, requirement *Requirement) {
+	routeRequirements.Store(route, requirement)
+}
+
+func RemoveRouteRequirement(route string) {
+	routeRequirements.Delete(route)
+}
+
+func getRequirement(route string) *Requirement {
+	if val, ok := routeRequirements.Load(route); ok {
+		return val.(*Requirement)
+	}
+	return nil
+}
+
+// 返回HTTP请求需要满足的所有要求，gRPC-Web和WebSocket请求除了HTTP路由的要求，还需要满足所调用的grpc方法的要求
+// 这样grpc方法的要求不能通过换一个入口绕过
+func httpRequirements(c *gin.Context) []*Requirement {
+	var requirements []*Requirement
+	if requirement := getRequirement(tenant.Route(c)); requirement != nil {
+		requirements = append(requirements, requirement)
+	}
+	if method := proxy.GrpcMethod(c); method != "" {
+		if requirement := getRequirement(tenant.Get(c) + method); requirement != nil {
+			requirements = append(requirements, requirement)
+		}
+	}
+	return requirements
+}
+
+// 设置需要作为metadata转发给后端的声明，需要在启动时设置
+func SetForwardClaims(claims ...string) {
+	forwardClaims = claims
+}
+
+func (requirement *Requirement) satisfied(claims Claims) bool {
+	for _, scope := range requirement.Scopes {
+		if !claims.HasValue("scope", scope) && !claims.HasValue("scp", scope) {
+			return false
+		}
+	}
+	for name, want := range requirement.Claims {
+		if got, ok := claims.String(name); !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+func bearerToken(authorization string) string {
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// Middleware 返回校验bearer token的中间件
+// 请求携带了token时必须是有效的token，否则返回401；路由或者所调用的grpc方法设置了要求时必须携带token，不满足要求时返回403
+// required 为true时所有的请求都必须携带token
+func Middleware(v *Validator, required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		requirements := httpRequirements(c)
+		token := bearerToken(c.GetHeader("Authorization"))
+		if token == "" {
+			if required || len(requirements) > 0 {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "msg": "bearer token is missing", "rsp": nil})
+				return
+			}
+			c.Next()
+			return
+		}
+		claims, err := v.Validate(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+			return
+		}
+		for _, requirement := range requirements {
+			if !requirement.satisfied(claims) {
+				c.Header("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": -1, "msg": "token doesn't satisfy the requirement of route", "rsp": nil})
+				return
+			}
+		}
+		c.Set(ContextKey, claims)
+		for _, name := range forwardClaims {
+			if val, ok := claims.String(name); ok {
+				proxy.SetMetadata(c, metadataPrefix+name, val)
+			}
+		}
+		c.Next()
+	}
+}
+
+// StreamInterceptor 返回原生grpc入口使用的token校验拦截器，token放在metadata authorization 中
+// 方法设置了要求时必须携带token，不满足要求时返回PermissionDenied，校验通过之后选定的声明会随调用转发给后端
+func StreamInterceptor(v *Validator, required bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		ctx := ss.Context()
+		var token string
+		if vals := md.Get("authorization"); len(vals) > 0 {
+			token = bearerToken(vals[0])
+		}
+		requirement := getRequirement(tenant.GrpcRoute(ss.Context(), info.FullMethod))
+		if token == "" {
+			if required || requirement != nil {
+				return status.Error(codes.Unauthenticated, "bearer token is missing")
+			}
+			return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		}
+		claims, err := v.Validate(token)
+		if err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		if requirement != nil && !requirement.satisfied(claims) {
+			return status.Error(codes.PermissionDenied, "token doesn't satisfy the requirement of method")
+		}
+		for _, name := range forwardClaims {
+			if val, ok := claims.String(name); ok {
+				ctx = proxy.SetStreamMetadata(ctx, metadataPrefix+name, val)
+			}
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// 替换了context的ServerStream，grpc代理从context中取出需要转发给后端的声明
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// 获取中间件保存在context中的声明，请求没有携带token时返回nil
+func GetClaims(c *gin.Context) Claims {
+	claims, ok := c.Get(ContextKey)
+	if !ok {
+		return nil
+	}
+	return claims.(Claims)
+}
@@ -0,0 +1,185 @@
+package jwt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// 返回使用testSecret校验签名的Validator，JWKS由本地的HTTP服务提供，加载之后缓存一个小时，所以返回之前就可以关闭该服务
+func newTestValidator(t *testing.T) *Validator {
+	jwks := jsonWebKeySet{Keys: []jsonWebKey{{Kty: "oct", Kid: "k1", K: base64.RawURLEncoding.EncodeToString(testSecret)}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer srv.Close()
+	keys, err := NewKeySet(srv.URL, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Validator{Keys: keys}
+}
+
+func sign(t *testing.T, claims Claims) string {
+	h, _ := json.Marshal(header{Alg: "HS256", Kid: "k1"})
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequirementSatisfied(t *testing.T) {
+	requirement := &Requirement{Scopes: []string{"sort:write"}, Claims: map[string]string{"tier": "gold"}}
+	cases := []struct {
+		name   string
+		claims Claims
+		want   bool
+	}{
+		{"scope string", Claims{"scope": "sort:read sort:write", "tier": "gold"}, true},
+		{"scp array", Claims{"scp": []interface{}{"sort:write"}, "tier": "gold"}, true},
+		{"missing scope", Claims{"scope": "sort:read", "tier": "gold"}, false},
+		{"wrong claim", Claims{"scope": "sort:write", "tier": "silver"}, false},
+		{"missing claim", Claims{"scope": "sort:write"}, false},
+	}
+	for _, c := range cases {
+		if got := requirement.satisfied(c.claims); got != c.want {
+			t.Errorf("%s: satisfied = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMiddlewareRouteRequirement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v := newTestValidator(t)
+	SetRouteRequirement("/admin", &Requirement{Claims: map[string]string{"role": "admin"}})
+	defer RemoveRouteRequirement("/admin")
+	router := gin.New()
+	router.Use(Middleware(v, false))
+	router.GET("/admin", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/public", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"public without token", "/public", "", http.StatusOK},
+		{"public with invalid token", "/public", "abc.def.ghi", http.StatusUnauthorized},
+		{"route without token", "/admin", "", http.StatusUnauthorized},
+		{"route with wrong claim", "/admin", sign(t, Claims{"exp": exp, "role": "user"}), http.StatusForbidden},
+		{"route with expired token", "/admin", sign(t, Claims{"exp": float64(time.Now().Add(-time.Hour).Unix()), "role": "admin"}), http.StatusUnauthorized},
+		{"route with claim", "/admin", sign(t, Claims{"exp": exp, "role": "admin"}), http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+func TestMiddlewareGrpcMethodRequirement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	v := newTestValidator(t)
+	SetRouteRequirement("/pkg.Svc/Admin", &Requirement{Scopes: []string{"admin"}})
+	defer RemoveRouteRequirement("/pkg.Svc/Admin")
+	router := gin.New()
+	router.Use(Middleware(v, false))
+	router.POST("/grpcweb/*method", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/ws", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   int
+	}{
+		{"grpc-web method without requirement", http.MethodPost, "/grpcweb/pkg.Svc/Call", "", http.StatusOK},
+		{"grpc-web without token", http.MethodPost, "/grpcweb/pkg.Svc/Admin", "", http.StatusUnauthorized},
+		{"grpc-web with missing scope", http.MethodPost, "/grpcweb/pkg.Svc/Admin", sign(t, Claims{"exp": exp, "scope": "read"}), http.StatusForbidden},
+		{"grpc-web with scope", http.MethodPost, "/grpcweb/pkg.Svc/Admin", sign(t, Claims{"exp": exp, "scope": "admin"}), http.StatusOK},
+		{"websocket method without requirement", http.MethodGet, "/ws?method=/pkg.Svc/Call", "", http.StatusOK},
+		{"websocket without token", http.MethodGet, "/ws?method=/pkg.Svc/Admin", "", http.StatusUnauthorized},
+		{"websocket with missing scope", http.MethodGet, "/ws?method=/pkg.Svc/Admin", sign(t, Claims{"exp": exp, "scope": "read"}), http.StatusForbidden},
+		{"websocket with scope", http.MethodGet, "/ws?method=/pkg.Svc/Admin", sign(t, Claims{"exp": exp, "scope": "admin"}), http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *testStream) Context() context.Context {
+	return ss.ctx
+}
+
+func TestStreamInterceptorRouteRequirement(t *testing.T) {
+	v := newTestValidator(t)
+	SetRouteRequirement("/sortService.SortService/Sort", &Requirement{Scopes: []string{"sort"}})
+	defer RemoveRouteRequirement("/sortService.SortService/Sort")
+	interceptor := StreamInterceptor(v, false)
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		name   string
+		method string
+		token  string
+		want   codes.Code
+	}{
+		{"method without requirement", "/pkg.Other/Call", "", codes.OK},
+		{"method without token", "/sortService.SortService/Sort", "", codes.Unauthenticated},
+		{"method with missing scope", "/sortService.SortService/Sort", sign(t, Claims{"exp": exp, "scope": "read"}), codes.PermissionDenied},
+		{"method with scope", "/sortService.SortService/Sort", sign(t, Claims{"exp": exp, "scope": "read sort"}), codes.OK},
+	}
+	for _, c := range cases {
+		md := metadata.MD{}
+		if c.token != "" {
+			md.Set("authorization", "Bearer "+c.token)
+		}
+		ss := &testStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+		err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: c.method},
+			func(srv interface{}, stream grpc.ServerStream) error { return nil })
+		if got := status.Code(err); got != c.want {
+			t.Errorf("%s: code = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedToken   = errors.New("token is malformed")
+	ErrUnsupportedAlg   = errors.New("signing algorithm of token is not supported")
+	ErrInvalidSignature = errors.New("signature of token is invalid")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("issuer of token is invalid")
+	ErrInvalidAudience  = errors.New("audience of token is invalid")
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// token中的声明，数字类型的声明解析之后为float64
+type Claims map[string]interface{}
+
+// 校验token的配置
+// Issuer 和 Audience 为空时不检查对应的声明
+// Leeway 表示检查exp和nbf时允许的时钟误差
+type Validator struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// Validate 校验token的签名和标准声明，成功时返回token中的所有声明
+func (v *Validator) Validate(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	key, err := v.Keys.Lookup(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(h.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// 按照alg校验签名，key的类型必须与alg匹配，避免用公钥作为HMAC密钥之类的算法混淆攻击
+func verify(alg string, key interface{}, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlg
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedAlg
+		}
+		// ES256的签名是定长的 r||s，各32字节
+		if len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrUnsupportedAlg
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlg
+}
+
+func (v *Validator) checkClaims(claims Claims) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+			return ErrExpired
+		}
+	} else {
+		// 不允许没有过期时间的token
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return ErrNotYetValid
+		}
+	}
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return ErrInvalidIssuer
+		}
+	}
+	if v.Audience != "" && !claims.HasValue("aud", v.Audience) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// HasValue 判断声明中是否包含value，声明可以是字符串，以空格分隔的字符串（例如scope）或者字符串数组
+func (claims Claims) HasValue(name, value string) bool {
+	switch val := claims[name].(type) {
+	case string:
+		for _, field := range strings.Fields(val) {
+			if field == value {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 返回声明的字符串形式，非字符串的声明会被编码为JSON
+func (claims Claims) String(name string) (string, bool) {
+	val, ok := claims[name]
+	if !ok {
+		return "", false
+	}
+	if s, ok := val.(string); ok {
+		return s, true
+	}
+	content, err := json.Marshal(val)
+	if err != nil {
+		return "", false
+	}
+	return string(content), true
+}
@@ -1,15 +1,283 @@
 package main
 
 import (
+	"Gateway/admission"
+	"Gateway/affinity"
+	"Gateway/apikey"
+	"Gateway/concurrency"
+	"Gateway/content"
+	"Gateway/health"
+	"Gateway/jwt"
+	"Gateway/mirror"
+	"Gateway/outlier"
 	"Gateway/proxy"
+	"Gateway/ratelimit"
+	"Gateway/regauth"
 	"Gateway/sortsvr"
+	"Gateway/split"
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"Gateway/tlsconf"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	httpAddr = ":80"
+	grpcAddr = ":9090" // 原生grpc入口，已经使用grpc的内部调用方可以直接通过该端口访问后端服务
+)
+
+var (
+	apiKeyFile  = flag.String("apikeys", "", "API key文件的路径，为空时不启用API key认证")
+	jwksSource  = flag.String("jwks", "", "JWKS的文件路径或者HTTP地址，为空时不校验bearer token")
+	jwtIssuer   = flag.String("jwt-issuer", "", "token的签发方，为空时不检查")
+	jwtAudience = flag.String("jwt-audience", "", "token的受众，为空时不检查")
+	jwtRequired = flag.Bool("jwt-required", false, "是否所有请求都必须携带token")
+	regIdentity = flag.String("register-identities", "", "允许注册后端的身份文件的路径，为空时不对注册请求认证")
+	auditLog    = flag.String("audit-log", "", "注册审计日志的路径，为空时输出到标准错误")
+	httpsAddr   = flag.String("https-addr", ":443", "HTTPS的监听地址，只有指定了证书时才会监听")
+	certs       = flag.String("certs", "", "HTTPS使用的证书，格式为 cert1.pem:key1.pem,cert2.pem:key2.pem，根据SNI选择")
+	clientCA    = flag.String("client-ca", "", "校验客户端证书的CA，用于后端注册时的mTLS认证")
+	backendTLS  = flag.String("backend-tls", "", "访问各个服务的后端时使用的TLS配置文件")
+	splitRules  = flag.String("splits", "", "各个路由的流量拆分规则文件，为空时不拆分流量")
+	routeRules  = flag.String("routes", "", "根据请求内容选择去向的路由规则文件")
+	mirrorRules = flag.String("mirrors", "", "各个路由的流量镜像规则文件，为空时不复制流量")
+	mismatchLog = flag.String("mismatch-log", "", "影子响应与主响应不一致的样本日志的路径，为空时输出到标准错误")
+	zone        = flag.String("zone", "", "网关所在的zone，不为空时优先调度到相同zone的后端")
+	zoneOrder   = flag.String("zone-priorities", "", "本地zone可用的后端不足时溢出到其他zone的顺序，例如 rack-2,rack-3")
+	affinityTTL = flag.Duration("affinity-ttl", 0, "排序服务会话亲和性的有效期，为0时不开启")
+	affinityKey = flag.String("affinity-secret", "", "签名亲和性token的密钥，多个网关实例需要相同，为空时使用随机密钥")
+	schedPolicy = flag.String("scheduler", "weight", "排序服务的调度策略，weight 按照权重随机选择，capacity 按照剩余容量选择")
+	tenantFile  = flag.String("tenants", "", "租户配置文件的路径，为空时所有请求都属于默认租户")
+	trustProxy  = flag.String("trusted-proxies", "", "可信的反向代理的网段，例如 10.0.0.0/8,192.168.1.1，只有来自这些地址的请求才使用X-Forwarded-For中的客户端IP")
+	trustPrio   = flag.Bool("trust-priority", false, "信任所有调用方通过X-Priority声明的优先级，只应该在网关只对内部调用方开放时开启，否则只信任API key策略允许的调用方")
 )
 
 func main() {
+	flag.Parse()
+	admission.TrustPriorityHeader = *trustPrio
+	if *trustProxy != "" {
+		if err := ratelimit.SetTrustedProxies(strings.Split(*trustProxy, ",")); err != nil {
+			log.Fatalln("parse trusted proxies failed, the err is", err)
+		}
+	}
+	var interceptors []grpc.StreamServerInterceptor
+	var keyStore *apikey.Store
+	if *apiKeyFile != "" {
+		var err error
+		if keyStore, err = apikey.NewStore(*apiKeyFile); err != nil {
+			log.Fatalln("load api key file failed, the err is", err)
+		}
+		keyStore.Watch(10 * time.Second)
+		interceptors = append(interceptors, apikey.StreamInterceptor(keyStore))
+	}
+	var validator *jwt.Validator
+	if *jwksSource != "" {
+		keys, err := jwt.NewKeySet(*jwksSource, 10*time.Minute, 30*time.Second)
+		if err != nil {
+			log.Fatalln("load jwks failed, the err is", err)
+		}
+		validator = &jwt.Validator{Keys: keys, Issuer: *jwtIssuer, Audience: *jwtAudience, Leeway: 30 * time.Second}
+		jwt.SetForwardClaims("sub")
+		interceptors = append(interceptors, jwt.StreamInterceptor(validator, *jwtRequired))
+	}
+
+	if *tenantFile != "" {
+		if err := tenant.LoadTenants(*tenantFile); err != nil {
+			log.Fatalln("load tenants failed, the err is", err)
+		}
+	}
+	if *backendTLS != "" {
+		if err := tlsconf.LoadBackendTLS(*backendTLS); err != nil {
+			log.Fatalln("load backend tls config failed, the err is", err)
+		}
+	}
+	if *splitRules != "" {
+		if err := split.LoadRules(*splitRules); err != nil {
+			log.Fatalln("load split rules failed, the err is", err)
+		}
+	}
+	if *routeRules != "" {
+		if err := content.LoadRules(*routeRules); err != nil {
+			log.Fatalln("load route rules failed, the err is", err)
+		}
+	}
+	if *mirrorRules != "" {
+		if err := mirror.LoadRules(*mirrorRules); err != nil {
+			log.Fatalln("load mirror rules failed, the err is", err)
+		}
+	}
+	if *mismatchLog != "" {
+		if err := mirror.SetMismatchLog(*mismatchLog); err != nil {
+			log.Fatalln("open mismatch log failed, the err is", err)
+		}
+	}
+	grpcOpts := []grpc.ServerOption{grpc.ChainStreamInterceptor(interceptors...)}
+	var serverTLS *tls.Config
+	if *certs != "" {
+		files, err := tlsconf.ParseCertFiles(*certs)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		certStore, err := tlsconf.NewCertStore(files)
+		if err != nil {
+			log.Fatalln("load certificates failed, the err is", err)
+		}
+		certStore.Watch(time.Minute)
+		if serverTLS, err = tlsconf.ServerConfig(certStore, *clientCA); err != nil {
+			log.Fatalln("load client ca failed, the err is", err)
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+
+	lis, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatalln("listen grpc address failed, the err is", err)
+	}
+	grpcServer := proxy.NewGrpcServer(grpcOpts...)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			log.Println("grpc server stopped, the err is", err)
+		}
+	}()
+
+	if *schedPolicy != "weight" && *schedPolicy != "capacity" {
+		log.Fatalln("unknown scheduler", *schedPolicy)
+	}
+	if *affinityKey != "" {
+		affinity.SetSecret([]byte(*affinityKey))
+	}
+	var priorities []string
+	if *zoneOrder != "" {
+		priorities = strings.Split(*zoneOrder, ",")
+	}
+	// 每个租户都有自己的排序服务，默认租户的服务名为 SortService，其他租户为 <tenant>/SortService
+	setupSortService(sortsvr.ServiceName, priorities)
+	for _, t := range tenant.List() {
+		setupSortService(tenant.Qualify(t.Name, sortsvr.ServiceName), priorities)
+		// 租户的限额由该租户的所有客户端共享
+		if t.RateLimit > 0 {
+			if err := ratelimit.SetTenantRule(t.Name, &ratelimit.Rule{
+				Algorithm: ratelimit.TokenBucket, Rate: t.RateLimit, Period: time.Second, Burst: t.Burst,
+				KeyFunc: ratelimit.AllClients, StreamKeyFunc: ratelimit.StreamAllClients,
+			}); err != nil {
+				log.Fatalln("set rate limit of tenant", t.Name, "failed, the err is", err)
+			}
+		}
+	}
+
 	router := gin.Default()
-	router.POST("/sortServer", sortsvr.ContactSortServer)
+	// gin默认信任客户端发送的X-Forwarded-For，客户端IP统一由ratelimit.ClientIP根据可信的代理确定
+	router.ForwardedByClientIP = false
+	if keyStore != nil {
+		router.Use(apikey.Middleware(keyStore))
+		router.POST("/admin/apikeys/rotate", apikey.RotateHandler(keyStore))
+	}
+	if validator != nil {
+		router.Use(jwt.Middleware(validator, *jwtRequired))
+	}
+	router.Use(ratelimit.Middleware())
+	registerHandlers := []gin.HandlerFunc{sortsvr.ContactSortServer}
+	var authenticator *regauth.Authenticator
+	if *regIdentity != "" {
+		authenticator, err = regauth.NewAuthenticator(*regIdentity, 5*time.Minute)
+		if err != nil {
+			log.Fatalln("load register identities failed, the err is", err)
+		}
+		registerHandlers = append([]gin.HandlerFunc{authenticator.Middleware(sortsvr.ServiceName)}, registerHandlers...)
+	}
+	if *auditLog != "" {
+		if err := regauth.SetAuditFile(*auditLog); err != nil {
+			log.Fatalln("open audit log failed, the err is", err)
+		}
+	}
+	router.POST("/sortServer", registerHandlers...)
 	router.POST("/sortService", proxy.Proxy)
-	router.Run(":80")
+	router.GET("/ws", proxy.WebSocket)
+	router.Any("/grpcweb/*method", proxy.GrpcWeb)
+	router.GET("/stats/admission", admission.StatsHandler)
+	router.GET("/stats/health", health.StatsHandler)
+	router.GET("/stats/outlier", outlier.StatsHandler)
+	router.GET("/stats/pool/watch", svrpool.WatchHandler)
+	router.GET("/stats/pool/instances", svrpool.InstancesHandler)
+	router.GET("/stats/pool/services", svrpool.ServicesHandler)
+	router.GET("/stats/split", split.StatsHandler)
+	router.GET("/stats/route", content.StatsHandler)
+	router.GET("/stats/mirror", mirror.StatsHandler)
+	if *schedPolicy == "capacity" {
+		router.GET("/stats/capacity", sortsvr.CapacityStatsHandler)
+	}
+	// 管理接口只对身份文件中的Admin身份开放，没有指定身份文件时不提供管理接口
+	if authenticator != nil {
+		router.POST("/admin/split/weights", authenticator.AdminMiddleware(), split.WeightsHandler)
+	}
+	if serverTLS != nil {
+		go func() {
+			server := &http.Server{Addr: *httpsAddr, Handler: tenant.Handler(router), TLSConfig: serverTLS}
+			// 证书由TLSConfig中的GetCertificate提供，所以这里不需要指定证书文件
+			if err := server.ListenAndServeTLS("", ""); err != nil {
+				log.Fatalln("https server stopped, the err is", err)
+			}
+		}()
+	}
+	// 在路由之前根据域名和路径前缀确定租户
+	if err := http.ListenAndServe(httpAddr, tenant.Handler(router)); err != nil {
+		log.Fatalln("http server stopped, the err is", err)
+	}
+}
+
+// 设置一个租户的排序服务的限流，准入，调度和健康检查等策略，serviceName 为带有租户前缀的服务名
+func setupSortService(serviceName string, priorities []string) {
+	// 默认每个客户端IP每秒最多请求100次排序服务，允许200次的突发
+	if err := ratelimit.SetServiceRule(serviceName, &ratelimit.Rule{
+		Algorithm: ratelimit.TokenBucket, Rate: 100, Period: time.Second, Burst: 200,
+		KeyFunc: ratelimit.ByClientIP, StreamKeyFunc: ratelimit.StreamByClientIP,
+	}); err != nil {
+		log.Fatalln("set rate limit of", serviceName, "failed, the err is", err)
+	}
+	// 排序服务同时在处理的请求数根据耗时在10到500之间自适应调整
+	limiter := concurrency.NewGradientLimiter(50, 10, 500, 1.5, 0.2)
+	concurrency.SetLimiter(serviceName, limiter)
+	// 拿不到名额的请求按照优先级在队列中最多等待1秒，过载时丢弃排队超过50毫秒的非关键请求
+	admission.SetQueue(serviceName, admission.NewQueue(admission.Config{
+		MaxQueueLen: 1000, Timeout: time.Second, CoDelTarget: 50 * time.Millisecond, CoDelInterval: 100 * time.Millisecond,
+	}, limiter))
+
+	// 新注册的排序服务后端在30秒内权重线性地从10%增加到配置的权重，避免冷缓存时就承担全部的流量
+	svrpool.SetSlowStart(serviceName, svrpool.SlowStart{Window: 30 * time.Second, Aggression: 1, MinWeightPercent: 10})
+
+	// 按照剩余容量调度时，每个核心同时处理4个请求，心跳中上报的利用率15秒内有效，排序一个字节的请求大约需要4个字节的内存
+	if *schedPolicy == "capacity" {
+		sortsvr.SetScheduler(serviceName, &sortsvr.CapacityScheduler{Service: serviceName,
+			Config: sortsvr.CapacityConfig{SlotsPerCore: 4, UtilTTL: 15 * time.Second, MemoryFactor: 4}})
+	}
+
+	// 同一个客户端在有效期内的请求总是发给同一个后端，后端被移除或者不可用时重新选择
+	if *affinityTTL > 0 {
+		affinity.SetConfig(serviceName, affinity.Config{TTL: *affinityTTL})
+	}
+
+	// 本地zone可用的后端少于本地后端总数的70%时，按照可用比例把一部分流量依次溢出到其他zone
+	if *zone != "" {
+		svrpool.SetLocality(serviceName, svrpool.Locality{Zone: *zone, Priorities: priorities, MinHealthyPercent: 70})
+	}
+
+	// 每5秒检查一次排序服务的各个后端，连续失败3次之后不再调度，连续成功2次之后恢复
+	health.Start(serviceName, health.Config{
+		Interval: 5 * time.Second, Timeout: time.Second, HealthyThreshold: 2, UnhealthyThreshold: 3,
+	})
+	// 每10秒比较一次排序服务各个后端的成功率和耗时，剔除异常的后端，最多剔除一半
+	outlier.Start(serviceName, outlier.Config{
+		Interval: 10 * time.Second, BaseEjectionTime: 30 * time.Second, MaxEjectionPercent: 50,
+		MinRequests: 20, MinHosts: 3, StdevFactor: 1.9, LatencyFactor: 3,
+	})
 }
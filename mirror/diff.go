@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 影子响应与主响应的比较方式
+type CompareMode string
+
+const (
+	CompareNone  CompareMode = ""      // 不比较
+	CompareExact CompareMode = "exact" // 逐字节比较
+	CompareJSON  CompareMode = "json"  // 按照JSON的语义比较，忽略字段顺序和空白，可以忽略指定的字段
+)
+
+const (
+	maxSampleSize = 4096 // 不一致的样本中每个报文最多记录的字节数
+)
+
+var (
+	mismatchLogger = log.New(os.Stderr, "[mirror] ", 0) // 默认输出到标准错误，可以通过SetMismatchLog输出到文件
+)
+
+// 一条不一致的样本
+type mismatchRecord struct {
+	Time    time.Time `json:"time"`
+	Route   string    `json:"route"`
+	Service string    `json:"service"`
+	Request string    `json:"request"`
+	Primary string    `json:"primary"`
+	Shadow  string    `json:"shadow"`
+}
+
+// 将不一致的样本追加写入到文件中，每一行是一条JSON格式的记录
+func SetMismatchLog(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	mismatchLogger = log.New(file, "", 0)
+	return nil
+}
+
+// 比较主响应和影子响应，返回是否一致
+func (rule *Rule) equal(primary, shadow []byte) bool {
+	if rule.Compare != CompareJSON {
+		return bytes.Equal(primary, shadow)
+	}
+	var primaryDoc, shadowDoc interface{}
+	// 不是合法的JSON时退化为逐字节比较
+	if json.Unmarshal(primary, &primaryDoc) != nil || json.Unmarshal(shadow, &shadowDoc) != nil {
+		return bytes.Equal(primary, shadow)
+	}
+	for _, field := range rule.IgnoreFields {
+		parts := strings.Split(field, ".")
+		primaryDoc = removePath(primaryDoc, parts)
+		shadowDoc = removePath(shadowDoc, parts)
+	}
+	return reflect.DeepEqual(primaryDoc, shadowDoc)
+}
+
+// 删除JSON文档中路径对应的字段，路径中的 * 匹配对象的所有字段或者数组的所有元素
+func removePath(doc interface{}, parts []string) interface{} {
+	if len(parts) == 0 {
+		return doc
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(parts) == 1 {
+			if parts[0] == "*" {
+				return map[string]interface{}{}
+			}
+			delete(node, parts[0])
+			return node
+		}
+		for key, child := range node {
+			if parts[0] == "*" || parts[0] == key {
+				node[key] = removePath(child, parts[1:])
+			}
+		}
+	case []interface{}:
+		if parts[0] != "*" {
+			return node
+		}
+		if len(parts) == 1 {
+			return []interface{}{}
+		}
+		for i, child := range node {
+			node[i] = removePath(child, parts[1:])
+		}
+	}
+	return doc
+}
+
+// 按照比例记录不一致的样本
+func (rule *Rule) sampleMismatch(route, serviceName string, request, primary, shadow []byte) {
+	if rand.Float64()*100 >= rule.SampleMismatches {
+		return
+	}
+	record := mismatchRecord{Time: time.Now(), Route: route, Service: serviceName,
+		Request: truncate(request), Primary: truncate(primary), Shadow: truncate(shadow)}
+	content, _ := json.Marshal(&record)
+	mismatchLogger.Println(string(content))
+}
+
+func truncate(content []byte) string {
+	if len(content) > maxSampleSize {
+		return string(content[:maxSampleSize]) + "...(truncated)"
+	}
+	return string(content)
+}
@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemovePath(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		path string
+		want string
+	}{
+		{"top level field", `{"a": 1, "b": 2}`, "a", `{"b": 2}`},
+		{"nested field", `{"meta": {"ts": 1, "v": 2}, "b": 2}`, "meta.ts", `{"meta": {"v": 2}, "b": 2}`},
+		{"missing field", `{"a": 1}`, "meta.ts", `{"a": 1}`},
+		{"wildcard object", `{"a": {"x": 1, "y": 2}}`, "a.*", `{"a": {}}`},
+		{"wildcard key", `{"a": {"ts": 1, "v": 1}, "b": {"ts": 2, "v": 2}}`, "*.ts", `{"a": {"v": 1}, "b": {"v": 2}}`},
+		{"wildcard array", `{"items": [{"id": 1, "v": "a"}, {"id": 2, "v": "b"}]}`, "items.*.id", `{"items": [{"v": "a"}, {"v": "b"}]}`},
+		{"whole array", `{"items": [1, 2, 3]}`, "items.*", `{"items": []}`},
+		// 数组只能通过 * 访问
+		{"array index", `{"items": [{"id": 1}]}`, "items.0.id", `{"items": [{"id": 1}]}`},
+		{"path through scalar", `{"a": 1}`, "a.b", `{"a": 1}`},
+		{"nested wildcards", `{"a": [{"b": [{"c": 1, "d": 2}]}]}`, "a.*.b.*.c", `{"a": [{"b": [{"d": 2}]}]}`},
+	}
+	for _, c := range cases {
+		var doc, want interface{}
+		if err := json.Unmarshal([]byte(c.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(c.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if got := removePath(doc, strings.Split(c.path, ".")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: removePath(%s, %q) = %v, want %v", c.name, c.doc, c.path, got, want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	cases := []struct {
+		name    string
+		rule    *Rule
+		primary string
+		shadow  string
+		want    bool
+	}{
+		{"exact same", &Rule{Compare: CompareExact}, `{"a":1}`, `{"a":1}`, true},
+		{"exact whitespace", &Rule{Compare: CompareExact}, `{"a":1}`, `{"a": 1}`, false},
+		{"json whitespace and order", &Rule{Compare: CompareJSON}, `{"a":1,"b":2}`, `{ "b": 2, "a": 1 }`, true},
+		{"json different value", &Rule{Compare: CompareJSON}, `{"a":1}`, `{"a":2}`, false},
+		{"json ignored field", &Rule{Compare: CompareJSON, IgnoreFields: []string{"meta.ts"}},
+			`{"a":1,"meta":{"ts":1}}`, `{"a":1,"meta":{"ts":2}}`, true},
+		{"json ignored field only", &Rule{Compare: CompareJSON, IgnoreFields: []string{"meta.ts"}},
+			`{"a":1,"meta":{"ts":1}}`, `{"a":2,"meta":{"ts":2}}`, false},
+		{"json ignored array field", &Rule{Compare: CompareJSON, IgnoreFields: []string{"items.*.id"}},
+			`{"items":[{"id":1,"v":"a"}]}`, `{"items":[{"id":9,"v":"a"}]}`, true},
+		{"json array order matters", &Rule{Compare: CompareJSON}, `[1,2]`, `[2,1]`, false},
+		// 不是合法的JSON时退化为逐字节比较
+		{"invalid json same", &Rule{Compare: CompareJSON}, `not json`, `not json`, true},
+		{"invalid json different", &Rule{Compare: CompareJSON}, `{"a":1}`, `{"a":1`, false},
+	}
+	for _, c := range cases {
+		if got := c.rule.equal([]byte(c.primary), []byte(c.shadow)); got != c.want {
+			t.Errorf("%s: equal = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate([]byte("short")); got != "short" {
+		t.Errorf("truncate short = %q", got)
+	}
+	long := strings.Repeat("x", maxSampleSize+1)
+	if got := truncate([]byte(long)); got != long[:maxSampleSize]+"...(truncated)" {
+		t.Errorf("truncate long has length %d", len(got))
+	}
+}
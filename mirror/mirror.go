@@ -0,0 +1,259 @@
+package mirror
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 一个路由的镜像规则
+// Service 为空时使用主请求的服务名，Selector 用于选出影子实例（例如 version=v3）
+// Percent 表示被复制的请求的百分比，Timeout 表示影子请求的超时时间
+// Compare 表示影子响应与主响应的比较方式，IgnoreFields 是CompareJSON时忽略的字段路径，例如 meta.timestamp，items.*.id
+// SampleMismatches 表示不一致的请求中被记录到日志中的百分比
+type Rule struct {
+	Service          string
+	Selector         svrpool.Selector
+	Percent          float64
+	Timeout          time.Duration
+	Compare          CompareMode
+	IgnoreFields     []string
+	SampleMismatches float64
+	stats            *stats
+}
+
+// 一个路由的镜像统计信息
+type Stats struct {
+	Mirrored   int64 `json:"mirrored"`   // 发出的影子请求数
+	Dropped    int64 `json:"dropped"`    // 因为同时进行的影子请求过多而放弃的请求数
+	Errors     int64 `json:"errors"`     // 影子请求失败的次数
+	AvgLatency int64 `json:"avgLatency"` // 影子请求的平均耗时（纳秒）
+	Compared   int64 `json:"compared"`   // 主请求和影子请求都成功，进行了比较的次数
+	Mismatched int64 `json:"mismatched"` // 比较结果不一致的次数
+}
+
+type stats struct {
+	mirrored     int64
+	dropped      int64
+	errors       int64
+	totalLatency int64
+	compared     int64
+	mismatched   int64
+}
+
+var (
+	MaxConcurrent = int64(100) // 同时进行的影子请求的上限，避免影子服务变慢时拖垮网关
+
+	rules    = &sync.Map{} // route -> *Rule，route 为tenant.Route返回的路由，例如 /sortService，teamA/sortService
+	inflight = int64(0)
+)
+
+// 为路由设置镜像规则，会覆盖之前的规则和统计信息，没有设置超时时间时使用5秒
+func SetRule(route string, rule *Rule) {
+	if rule.Timeout <= 0 {
+		rule.Timeout = 5 * time.Second
+	}
+	rule.stats = &stats{}
+	rules.Store(route, rule)
+}
+
+func RemoveRule(route string) {
+	rules.Delete(route)
+}
+
+// 一次正在进行的影子请求，主请求结束之后需要调用Primary提交主请求的结果
+type Shadow struct {
+	primary chan result
+}
+
+type result struct {
+	rsp []byte
+	err error
+}
+
+// Start 根据路由的镜像规则按照比例异步地复制请求，没有被复制时返回nil
+// ctx 中携带需要转发给后端的metadata，但不能是客户端请求的context，否则主请求结束之后影子请求会被取消
+func Start(ctx context.Context, route, serviceName string, body []byte) *Shadow {
+	val, ok := rules.Load(route)
+	if !ok {
+		return nil
+	}
+	rule := val.(*Rule)
+	if rand.Float64()*100 >= rule.Percent {
+		return nil
+	}
+	if atomic.AddInt64(&inflight, 1) > MaxConcurrent {
+		atomic.AddInt64(&inflight, -1)
+		atomic.AddInt64(&rule.stats.dropped, 1)
+		return nil
+	}
+	// 影子服务与主服务属于同一个租户
+	if rule.Service != "" {
+		namespace, _ := tenant.Split(serviceName)
+		serviceName = tenant.Qualify(namespace, rule.Service)
+	}
+	shadow := &Shadow{primary: make(chan result, 1)}
+	go func() {
+		defer atomic.AddInt64(&inflight, -1)
+		rsp, err := invoke(ctx, rule, serviceName, body)
+		if err != nil {
+			log.Println("mirror request of", route, "to", serviceName, "failed, the err is", err)
+			return
+		}
+		if rule.Compare == CompareNone {
+			return
+		}
+		// 主请求一直没有提交结果时放弃比较
+		timer := time.NewTimer(rule.Timeout)
+		defer timer.Stop()
+		select {
+		case primary := <-shadow.primary:
+			if primary.err != nil {
+				return
+			}
+			atomic.AddInt64(&rule.stats.compared, 1)
+			if !rule.equal(primary.rsp, rsp) {
+				atomic.AddInt64(&rule.stats.mismatched, 1)
+				rule.sampleMismatch(route, serviceName, body, primary.rsp, rsp)
+			}
+		case <-timer.C:
+		}
+	}()
+	return shadow
+}
+
+// 调用影子服务，响应只用于比较
+func invoke(ctx context.Context, rule *Rule, serviceName string, body []byte) ([]byte, error) {
+	atomic.AddInt64(&rule.stats.mirrored, 1)
+	start := time.Now()
+	rsp, err := doInvoke(ctx, rule, serviceName, body)
+	atomic.AddInt64(&rule.stats.totalLatency, int64(time.Since(start)))
+	if err != nil {
+		atomic.AddInt64(&rule.stats.errors, 1)
+	}
+	return rsp, err
+}
+
+func doInvoke(ctx context.Context, rule *Rule, serviceName string, body []byte) ([]byte, error) {
+	schedulerInstance, ok := svrpool.SchedulerPool.Load(serviceName)
+	if !ok {
+		return nil, errors.New("can not get scheduler instance")
+	}
+	invoker, err := svrpool.Select(schedulerInstance.(svrpool.Scheduler), svrpool.Hint{Selector: rule.Selector})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, rule.Timeout)
+	defer cancel()
+	// 影子请求尽量不计入Invoker的统计信息，否则会影响异常检测，容量调度和流量拆分的统计
+	if shadowInvoker, ok := invoker.(svrpool.ShadowInvoker); ok {
+		return shadowInvoker.InvokeShadow(ctx, body)
+	}
+	if ctxInvoker, ok := invoker.(svrpool.ContextInvoker); ok {
+		return ctxInvoker.InvokeContext(ctx, body)
+	}
+	// 不能携带context的Invoker在超时之后放弃等待，避免一直占用MaxConcurrent的名额
+	done := make(chan result, 1)
+	go func() {
+		rsp, err := invoker.Invoke(body)
+		done <- result{rsp: rsp, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.rsp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 提交主请求的结果，不会阻塞
+func (shadow *Shadow) Primary(rsp []byte, err error) {
+	if shadow == nil {
+		return
+	}
+	select {
+	case shadow.primary <- result{rsp: rsp, err: err}:
+	default:
+	}
+}
+
+// 返回路由的镜像统计信息
+func RouteStats(route string) Stats {
+	val, ok := rules.Load(route)
+	if !ok {
+		return Stats{}
+	}
+	s := val.(*Rule).stats
+	result := Stats{Mirrored: atomic.LoadInt64(&s.mirrored), Dropped: atomic.LoadInt64(&s.dropped),
+		Errors: atomic.LoadInt64(&s.errors), Compared: atomic.LoadInt64(&s.compared), Mismatched: atomic.LoadInt64(&s.mismatched)}
+	if result.Mirrored > 0 {
+		result.AvgLatency = atomic.LoadInt64(&s.totalLatency) / result.Mirrored
+	}
+	return result
+}
+
+// StatsHandler 返回请求所属租户的各个路由的镜像统计信息
+func StatsHandler(c *gin.Context) {
+	result := map[string]Stats{}
+	name := tenant.Get(c)
+	rules.Range(func(key, value interface{}) bool {
+		if tenant.Owns(name, key.(string)) {
+			result[key.(string)] = RouteStats(key.(string))
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": result})
+}
+
+type ruleFile struct {
+	Service          string   `json:"service"`
+	Selector         string   `json:"selector"`
+	Percent          float64  `json:"percent"`
+	Timeout          string   `json:"timeout"`
+	Compare          string   `json:"compare"`
+	IgnoreFields     []string `json:"ignoreFields"`
+	SampleMismatches float64  `json:"sampleMismatches"`
+}
+
+// 从JSON文件中加载各个路由的镜像规则，格式为
+// {"/sortService": {"selector": "version=v3", "percent": 10, "timeout": "2s", "compare": "json", "ignoreFields": ["meta.timestamp"], "sampleMismatches": 1}}
+func LoadRules(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var files map[string]ruleFile
+	if err := json.Unmarshal(content, &files); err != nil {
+		return err
+	}
+	for route, file := range files {
+		selector, err := svrpool.ParseSelector(file.Selector)
+		if err != nil {
+			return err
+		}
+		mode := CompareMode(file.Compare)
+		if mode != CompareNone && mode != CompareExact && mode != CompareJSON {
+			return errors.New("unknown compare mode " + file.Compare)
+		}
+		rule := &Rule{Service: file.Service, Selector: selector, Percent: file.Percent, Compare: mode,
+			IgnoreFields: file.IgnoreFields, SampleMismatches: file.SampleMismatches}
+		if file.Timeout != "" {
+			if rule.Timeout, err = time.ParseDuration(file.Timeout); err != nil {
+				return err
+			}
+		}
+		SetRule(route, rule)
+	}
+	return nil
+}
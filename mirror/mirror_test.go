@@ -0,0 +1,153 @@
+package mirror
+
+import (
+	"Gateway/svrpool"
+	"context"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type shadowInvoker struct {
+	rsp   string
+	calls chan string
+}
+
+func (invoker *shadowInvoker) Invoke(req []byte) ([]byte, error) {
+	invoker.calls <- string(req)
+	return []byte(invoker.rsp), nil
+}
+
+type shadowScheduler struct {
+	invoker svrpool.Invoker
+}
+
+func (scheduler *shadowScheduler) Select() (svrpool.Invoker, error) {
+	return scheduler.invoker, nil
+}
+
+// 等待影子请求完成比较，返回路由的统计信息
+func waitStats(route string, done func(Stats) bool) Stats {
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := RouteStats(route)
+		if done(stats) || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStart(t *testing.T) {
+	oldLogger, oldMax := mismatchLogger, MaxConcurrent
+	defer func() { mismatchLogger, MaxConcurrent = oldLogger, oldMax }()
+	defer RemoveRule("teamA/sortService")
+	mismatchLogger = log.New(ioutil.Discard, "", 0)
+	invoker := &shadowInvoker{rsp: `{"v": 1, "ts": 2}`, calls: make(chan string, 10)}
+	svrpool.SchedulerPool.Store("teamA/Shadow", &shadowScheduler{invoker: invoker})
+	defer svrpool.SchedulerPool.Delete("teamA/Shadow")
+
+	cases := []struct {
+		name           string
+		rule           *Rule
+		maxConcurrent  int64
+		primary        string
+		wantMirrored   bool
+		wantDropped    int64
+		wantMismatched int64
+	}{
+		{"not sampled", &Rule{Service: "Shadow", Percent: 0}, 100, "", false, 0, 0},
+		{"mirrored without compare", &Rule{Service: "Shadow", Percent: 100}, 100, "", true, 0, 0},
+		{"same response", &Rule{Service: "Shadow", Percent: 100, Compare: CompareJSON, IgnoreFields: []string{"ts"}}, 100, `{"ts": 1, "v": 1}`, true, 0, 0},
+		{"different response", &Rule{Service: "Shadow", Percent: 100, Compare: CompareJSON}, 100, `{"ts": 1, "v": 1}`, true, 0, 1},
+		{"too many shadow requests", &Rule{Service: "Shadow", Percent: 100}, 0, "", false, 1, 0},
+	}
+	for _, c := range cases {
+		MaxConcurrent = c.maxConcurrent
+		SetRule("teamA/sortService", c.rule)
+		// 影子服务和主服务属于同一个租户
+		shadow := Start(context.Background(), "teamA/sortService", "teamA/SortService", []byte("req"))
+		if (shadow != nil) != c.wantMirrored {
+			t.Errorf("%s: mirrored = %v, want %v", c.name, shadow != nil, c.wantMirrored)
+		}
+		if c.wantMirrored {
+			select {
+			case req := <-invoker.calls:
+				if req != "req" {
+					t.Errorf("%s: shadow request = %q", c.name, req)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: shadow service is not called", c.name)
+			}
+		}
+		shadow.Primary([]byte(c.primary), nil)
+		stats := waitStats("teamA/sortService", func(stats Stats) bool {
+			return c.rule.Compare == CompareNone || stats.Compared > 0
+		})
+		if stats.Dropped != c.wantDropped || stats.Mismatched != c.wantMismatched {
+			t.Errorf("%s: dropped = %d, mismatched = %d, want %d, %d", c.name, stats.Dropped, stats.Mismatched, c.wantDropped, c.wantMismatched)
+		}
+	}
+}
+
+// 同时实现了ShadowInvoker和ContextInvoker，影子请求应该使用不计入统计的InvokeShadow
+type statsInvoker struct {
+	shadowCalls int64
+	calls       int64
+}
+
+func (invoker *statsInvoker) Invoke(req []byte) ([]byte, error) {
+	return invoker.InvokeContext(context.Background(), req)
+}
+
+func (invoker *statsInvoker) InvokeContext(ctx context.Context, req []byte) ([]byte, error) {
+	atomic.AddInt64(&invoker.calls, 1)
+	return req, nil
+}
+
+func (invoker *statsInvoker) InvokeShadow(ctx context.Context, req []byte) ([]byte, error) {
+	atomic.AddInt64(&invoker.shadowCalls, 1)
+	return req, nil
+}
+
+// 不能携带context并且一直不返回的Invoker
+type blockingInvoker struct {
+	release chan struct{}
+}
+
+func (invoker *blockingInvoker) Invoke(req []byte) ([]byte, error) {
+	<-invoker.release
+	return req, nil
+}
+
+func TestInvoke(t *testing.T) {
+	stats := &statsInvoker{}
+	blocking := &blockingInvoker{release: make(chan struct{})}
+	defer close(blocking.release)
+
+	cases := []struct {
+		name    string
+		invoker svrpool.Invoker
+		wantErr error
+	}{
+		{"shadow invoker", stats, nil},
+		{"timeout", blocking, context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		svrpool.SchedulerPool.Store("TestInvoke", &shadowScheduler{invoker: c.invoker})
+		start := time.Now()
+		_, err := doInvoke(context.Background(), &Rule{Timeout: 20 * time.Millisecond}, "TestInvoke", []byte("req"))
+		if err != c.wantErr {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.wantErr)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: invoke took %v", c.name, elapsed)
+		}
+	}
+	svrpool.SchedulerPool.Delete("TestInvoke")
+	if stats.shadowCalls != 1 || stats.calls != 0 {
+		t.Errorf("shadow calls = %d, calls = %d, want 1, 0", stats.shadowCalls, stats.calls)
+	}
+}
@@ -0,0 +1,265 @@
+package outlier
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 异常检测的配置
+// Interval 表示检测的周期，每个周期比较一次各个Invoker在这个周期内的表现
+// BaseEjectionTime 表示剔除的基础时长，Invoker每多被剔除一次，剔除的时长就增加一个BaseEjectionTime
+// MaxEjectionPercent 表示最多同时剔除的Invoker比例（百分比），至少会保留一个Invoker不被剔除
+// MinRequests 表示Invoker在一个周期内至少需要多少次调用才参与比较，MinHosts 表示至少需要多少个参与比较的Invoker才进行检测
+// StdevFactor 表示成功率低于 平均值 - StdevFactor * 标准差 的Invoker会被剔除，平均值和标准差由其他参与比较的Invoker计算，
+// 否则异常的Invoker会拉低平均值并拉高标准差，Invoker较少时永远无法被剔除
+// LatencyFactor 表示这个周期的平均耗时超过其他Invoker平均耗时LatencyFactor倍的Invoker会被剔除，为0时不检测耗时
+type Config struct {
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionPercent int
+	MinRequests        int64
+	MinHosts           int
+	StdevFactor        float64
+	LatencyFactor      float64
+}
+
+// 一个Invoker的异常检测状态
+type HostState struct {
+	Ejected       bool      `json:"ejected"`
+	EjectedUntil  time.Time `json:"ejectedUntil,omitempty"`
+	EjectionCount int       `json:"ejectionCount"` // 决定下一次剔除的时长，长时间没有被剔除时会逐渐减小
+	SuccessRate   float64   `json:"successRate"`   // 最近一个周期的成功率
+	Latency       int64     `json:"latency"`       // 最近一个周期的平均耗时（纳秒）
+	LastReason    string    `json:"lastReason,omitempty"`
+	invoker       svrpool.Invoker
+	last          svrpool.Stat // 上一个周期结束时的统计信息
+}
+
+type detector struct {
+	serviceName string
+	config      Config
+	lock        *sync.RWMutex
+	hosts       map[string]*HostState // serverID -> 状态
+	byInvoker   map[svrpool.Invoker]*HostState
+	stop        chan struct{}
+}
+
+// 计算成功率阈值时标准差的下限，其他Invoker的成功率完全相同时，避免因为零星的失败剔除Invoker
+const minStdev = 0.05
+
+var (
+	detectors  = &sync.Map{} // serviceName -> *detector
+	filterOnce = &sync.Once{}
+)
+
+// Start 开始对服务进行异常检测，已经在检测的服务会使用新的配置重新开始
+// 被剔除的Invoker会被svrpool.Available过滤掉，剔除时间结束之后自动恢复
+func Start(serviceName string, config Config) {
+	filterOnce.Do(func() {
+		svrpool.AddFilter(filter)
+	})
+	d := &detector{serviceName: serviceName, config: config, lock: &sync.RWMutex{},
+		hosts: map[string]*HostState{}, byInvoker: map[svrpool.Invoker]*HostState{}, stop: make(chan struct{})}
+	if old, loaded := detectors.Load(serviceName); loaded {
+		close(old.(*detector).stop)
+	}
+	detectors.Store(serviceName, d)
+	go d.run()
+}
+
+// 停止对服务的异常检测，所有被剔除的Invoker立即恢复
+func Stop(serviceName string) {
+	if old, loaded := detectors.Load(serviceName); loaded {
+		detectors.Delete(serviceName)
+		close(old.(*detector).stop)
+	}
+}
+
+func filter(serviceName string, invoker svrpool.Invoker) bool {
+	val, ok := detectors.Load(serviceName)
+	if !ok {
+		return true
+	}
+	d := val.(*detector)
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if host, ok := d.byInvoker[invoker]; ok && host.Ejected {
+		return !time.Now().Before(host.EjectedUntil)
+	}
+	return true
+}
+
+func (d *detector) run() {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.detect(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// 一个周期内参与比较的Invoker
+type sample struct {
+	host        *HostState
+	successRate float64
+	latency     float64
+}
+
+func (d *detector) detect(now time.Time) {
+	invokers, err := svrpool.ListInvokers(d.serviceName)
+	if err != nil {
+		invokers = map[string]svrpool.Invoker{}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	hosts := make(map[string]*HostState, len(invokers))
+	byInvoker := make(map[svrpool.Invoker]*HostState, len(invokers))
+	var samples []sample
+	ejected := 0
+	for serverID, invoker := range invokers {
+		statInvoker, ok := invoker.(svrpool.StatInvoker)
+		if !ok {
+			continue
+		}
+		stat := statInvoker.Stat()
+		host, ok := d.hosts[serverID]
+		if !ok || host.invoker != invoker {
+			host = &HostState{invoker: invoker, last: stat}
+		}
+		hosts[serverID] = host
+		byInvoker[invoker] = host
+
+		if host.Ejected && !now.Before(host.EjectedUntil) {
+			host.Ejected = false
+		}
+		if !host.Ejected && host.EjectionCount > 0 && now.Sub(host.EjectedUntil) > d.config.BaseEjectionTime {
+			// 恢复之后表现稳定，逐渐减小下一次剔除的时长
+			host.EjectionCount--
+			host.EjectedUntil = now
+		}
+		requests := stat.AllPCCount - host.last.AllPCCount
+		fails := stat.Fail - host.last.Fail
+		processTime := stat.TotalProcessTime - host.last.TotalProcessTime
+		host.last = stat
+		if requests > 0 {
+			host.Latency = processTime / requests
+		}
+		if host.Ejected {
+			ejected++
+			continue
+		}
+		if requests < d.config.MinRequests || requests <= 0 {
+			continue
+		}
+		host.SuccessRate = 1 - float64(fails)/float64(requests)
+		samples = append(samples, sample{host: host,
+			successRate: host.SuccessRate, latency: float64(host.Latency)})
+	}
+	d.hosts, d.byInvoker = hosts, byInvoker
+	if len(samples) < d.config.MinHosts || len(samples) == 0 {
+		return
+	}
+
+	maxEjected := len(hosts) * d.config.MaxEjectionPercent / 100
+	if maxEjected < 1 && d.config.MaxEjectionPercent > 0 {
+		maxEjected = 1
+	}
+	if maxEjected > len(hosts)-1 {
+		maxEjected = len(hosts) - 1
+	}
+	successRates := newMoments(samples, func(s sample) float64 { return s.successRate })
+	latencies := newMoments(samples, func(s sample) float64 { return s.latency })
+	for _, s := range samples {
+		if ejected >= maxEjected {
+			return
+		}
+		srMean, srStdev := successRates.without(s.successRate)
+		latencyMean, _ := latencies.without(s.latency)
+		if srStdev < minStdev {
+			srStdev = minStdev
+		}
+		reason := ""
+		if s.successRate < srMean-d.config.StdevFactor*srStdev {
+			reason = "success rate"
+		} else if d.config.LatencyFactor > 0 && s.latency > d.config.LatencyFactor*latencyMean {
+			reason = "latency"
+		}
+		if reason == "" {
+			continue
+		}
+		s.host.EjectionCount++
+		s.host.Ejected = true
+		s.host.EjectedUntil = now.Add(time.Duration(s.host.EjectionCount) * d.config.BaseEjectionTime)
+		s.host.LastReason = reason
+		ejected++
+	}
+}
+
+// 一组数据的个数，和以及平方和，用于计算去掉其中一个数据之后的平均值和标准差
+type moments struct {
+	n          float64
+	sum, sumSq float64
+}
+
+func newMoments(samples []sample, value func(sample) float64) moments {
+	m := moments{n: float64(len(samples))}
+	for _, s := range samples {
+		m.sum += value(s)
+		m.sumSq += value(s) * value(s)
+	}
+	return m
+}
+
+// 返回去掉x之后其他数据的平均值和标准差
+func (m moments) without(x float64) (float64, float64) {
+	n := m.n - 1
+	if n <= 0 {
+		return x, 0
+	}
+	mean := (m.sum - x) / n
+	variance := (m.sumSq-x*x)/n - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return mean, math.Sqrt(variance)
+}
+
+// 返回服务所有Invoker的异常检测状态，key为服务器的ID
+func Status(serviceName string) map[string]HostState {
+	result := map[string]HostState{}
+	val, ok := detectors.Load(serviceName)
+	if !ok {
+		return result
+	}
+	d := val.(*detector)
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for serverID, host := range d.hosts {
+		result[serverID] = *host
+	}
+	return result
+}
+
+// StatsHandler 返回请求所属租户中被检测的各个服务的Invoker的异常检测状态
+func StatsHandler(c *gin.Context) {
+	stats := map[string]map[string]HostState{}
+	name := tenant.Get(c)
+	detectors.Range(func(key, value interface{}) bool {
+		if tenant.Owns(name, key.(string)) {
+			stats[key.(string)] = Status(key.(string))
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": stats})
+}
@@ -0,0 +1,192 @@
+package outlier
+
+import (
+	"Gateway/svrpool"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type statInvoker struct {
+	stat svrpool.Stat
+}
+
+func (invoker *statInvoker) Invoke(req []byte) ([]byte, error) {
+	return req, nil
+}
+
+func (invoker *statInvoker) Stat() svrpool.Stat {
+	return invoker.stat
+}
+
+// 创建有n个Invoker的服务和它的检测器，返回的Invoker按照serverID s0，s1... 的顺序排列
+func newTestDetector(t *testing.T, serviceName string, n int, config Config) (*detector, []*statInvoker) {
+	var invokers []*statInvoker
+	for i := 0; i < n; i++ {
+		invoker := &statInvoker{}
+		if _, err := svrpool.AddServer(serviceName, "s"+strconv.Itoa(i), invoker); err != nil {
+			t.Fatal(err)
+		}
+		invokers = append(invokers, invoker)
+	}
+	d := &detector{serviceName: serviceName, config: config, lock: &sync.RWMutex{},
+		hosts: map[string]*HostState{}, byInvoker: map[svrpool.Invoker]*HostState{}}
+	detectors.Store(serviceName, d)
+	return d, invokers
+}
+
+// 每个Invoker增加一个周期的100次调用，每次耗时10ms，前bad个Invoker失败fails次，每次耗时latency
+func addRound(invokers []*statInvoker, bad int, fails int64, latency time.Duration) {
+	for i, invoker := range invokers {
+		invoker.stat.AllPCCount += 100
+		if i < bad {
+			invoker.stat.Fail += fails
+			invoker.stat.TotalProcessTime += 100 * int64(latency)
+		} else {
+			invoker.stat.TotalProcessTime += 100 * int64(10*time.Millisecond)
+		}
+	}
+}
+
+func TestEjectionCap(t *testing.T) {
+	cases := []struct {
+		name        string
+		hosts       int
+		bad         int
+		maxPercent  int
+		minHosts    int
+		wantEjected int
+	}{
+		{"one outlier", 5, 1, 50, 3, 1},
+		{"capped by percent", 10, 3, 10, 3, 1},
+		{"capped by larger percent", 10, 3, 20, 3, 2},
+		{"all outliers under cap", 10, 3, 50, 3, 3},
+		// 比例算出来不足一个时至少可以剔除一个
+		{"rounded up to one", 5, 1, 10, 3, 1},
+		{"ejection disabled", 5, 1, 0, 3, 0},
+		{"too few hosts", 4, 1, 50, 5, 0},
+	}
+	for i, c := range cases {
+		serviceName := "TestEjectionCap" + strconv.Itoa(i)
+		config := Config{BaseEjectionTime: 30 * time.Second, MaxEjectionPercent: c.maxPercent,
+			MinRequests: 10, MinHosts: c.minHosts, StdevFactor: 1}
+		d, invokers := newTestDetector(t, serviceName, c.hosts, config)
+		now := time.Now()
+		// 第一个周期只记录基准的统计信息
+		d.detect(now)
+		addRound(invokers, c.bad, 50, 10*time.Millisecond)
+		d.detect(now.Add(10 * time.Second))
+		ejected := 0
+		for i, invoker := range invokers {
+			if !filter(serviceName, invoker) {
+				ejected++
+				if i >= c.bad {
+					t.Errorf("%s: healthy host s%d is ejected", c.name, i)
+				}
+			}
+		}
+		if ejected != c.wantEjected {
+			t.Errorf("%s: ejected = %d, want %d", c.name, ejected, c.wantEjected)
+		}
+		detectors.Delete(serviceName)
+		svrpool.ServerPool.Delete(serviceName)
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	serviceName := "TestEjectionBackoff"
+	base := 30 * time.Second
+	d, invokers := newTestDetector(t, serviceName, 5, Config{BaseEjectionTime: base, MaxEjectionPercent: 50,
+		MinRequests: 10, MinHosts: 3, StdevFactor: 1, LatencyFactor: 3})
+	defer detectors.Delete(serviceName)
+	defer svrpool.ServerPool.Delete(serviceName)
+	start := time.Now()
+	d.detect(start)
+
+	cases := []struct {
+		name        string
+		offset      time.Duration
+		reason      string // s0在这个周期内的异常，为空时表现正常
+		wantEjected bool
+		wantCount   int
+		wantUntil   time.Duration // 相对于start的剔除结束时间
+	}{
+		{"first ejection", 10 * time.Second, "success rate", true, 1, 40 * time.Second},
+		{"still ejected", 20 * time.Second, "", true, 1, 40 * time.Second},
+		{"released", 40 * time.Second, "", false, 1, 40 * time.Second},
+		// 第二次剔除的时长是两倍的BaseEjectionTime
+		{"second ejection", 50 * time.Second, "success rate", true, 2, 110 * time.Second},
+		{"released again", 110 * time.Second, "", false, 2, 110 * time.Second},
+		{"stable but too soon", 140 * time.Second, "", false, 2, 110 * time.Second},
+		// 恢复之后超过BaseEjectionTime没有被剔除，下一次剔除的时长减小
+		{"decayed once", 150 * time.Second, "", false, 1, 150 * time.Second},
+		{"decayed twice", 190 * time.Second, "", false, 0, 190 * time.Second},
+		{"decayed to zero", 230 * time.Second, "", false, 0, 190 * time.Second},
+		{"ejected by latency", 240 * time.Second, "latency", true, 1, 270 * time.Second},
+	}
+	for _, c := range cases {
+		switch c.reason {
+		case "success rate":
+			addRound(invokers, 1, 50, 10*time.Millisecond)
+		case "latency":
+			// 只有这个周期的耗时异常，之前的周期都是正常的
+			addRound(invokers, 1, 0, time.Second)
+		default:
+			addRound(invokers, 0, 0, 10*time.Millisecond)
+		}
+		d.detect(start.Add(c.offset))
+		host := Status(serviceName)["s0"]
+		if host.Ejected != c.wantEjected || host.EjectionCount != c.wantCount || !host.EjectedUntil.Equal(start.Add(c.wantUntil)) {
+			t.Errorf("%s: ejected = %v, count = %d, until = %v, want %v, %d, %v", c.name, host.Ejected, host.EjectionCount,
+				host.EjectedUntil.Sub(start), c.wantEjected, c.wantCount, c.wantUntil)
+		}
+		if c.reason != "" && host.LastReason != c.reason {
+			t.Errorf("%s: reason = %q, want %q", c.name, host.LastReason, c.reason)
+		}
+		if got := filter(serviceName, invokers[0]); got == host.Ejected {
+			t.Errorf("%s: filter = %v while ejected = %v", c.name, got, host.Ejected)
+		}
+	}
+}
+
+// 使用main.go中的配置，只有3个Invoker时也可以剔除明显异常的Invoker，同时不会因为零星的失败剔除Invoker
+func TestDetectWithFewHosts(t *testing.T) {
+	cases := []struct {
+		name        string
+		hosts       int
+		fails       int64
+		latency     time.Duration
+		wantEjected bool
+		wantReason  string
+	}{
+		{"all failed", 3, 100, 10 * time.Millisecond, true, "success rate"},
+		{"half failed", 3, 50, 10 * time.Millisecond, true, "success rate"},
+		{"a few failures", 3, 2, 10 * time.Millisecond, false, ""},
+		{"four times slower", 3, 0, 40 * time.Millisecond, true, "latency"},
+		{"twice slower", 3, 0, 20 * time.Millisecond, false, ""},
+		{"all failed among four", 4, 100, 10 * time.Millisecond, true, "success rate"},
+		{"too few hosts", 2, 100, 10 * time.Millisecond, false, ""},
+	}
+	for i, c := range cases {
+		serviceName := "TestDetectWithFewHosts" + strconv.Itoa(i)
+		d, invokers := newTestDetector(t, serviceName, c.hosts, Config{BaseEjectionTime: 30 * time.Second,
+			MaxEjectionPercent: 50, MinRequests: 20, MinHosts: 3, StdevFactor: 1.9, LatencyFactor: 3})
+		now := time.Now()
+		d.detect(now)
+		addRound(invokers, 1, c.fails, c.latency)
+		d.detect(now.Add(10 * time.Second))
+		hosts := Status(serviceName)
+		for serverID, host := range hosts {
+			want := c.wantEjected && serverID == "s0"
+			if host.Ejected != want {
+				t.Errorf("%s: %s ejected = %v, want %v", c.name, serverID, host.Ejected, want)
+			}
+		}
+		if hosts["s0"].Ejected && hosts["s0"].LastReason != c.wantReason {
+			t.Errorf("%s: reason = %q, want %q", c.name, hosts["s0"].LastReason, c.wantReason)
+		}
+		detectors.Delete(serviceName)
+		svrpool.ServerPool.Delete(serviceName)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// frame 保存一条未经解析的grpc消息，网关只负责在两端之间搬运字节，不需要知道具体的proto定义
+type frame struct {
+	payload []byte
+}
+
+// rawCodec 直接透传frame中的字节，其他类型的消息仍然按照proto进行编解码
+// Name 返回 "proto" 是为了让后端看到的content-type依然是 application/grpc+proto
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	if f, ok := v.(*frame); ok {
+		return f.payload, nil
+	}
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("message is neither raw frame nor proto message")
+	}
+	return proto.Marshal(msg)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	if f, ok := v.(*frame); ok {
+		// grpc可能会复用data的底层数组，所以这里需要拷贝一份
+		f.payload = append(f.payload[:0], data...)
+		return nil
+	}
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errors.New("message is neither raw frame nor proto message")
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func (c rawCodec) String() string {
+	return c.Name()
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"Gateway/admission"
+	"Gateway/concurrency"
+	"Gateway/ratelimit"
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// NewGrpcServer 创建一个作为grpc入口的Server，该Server上所有未注册的方法都会被透明地转发给调度器选出的后端
+// 转发时使用rawCodec直接搬运消息的字节，所以网关不需要后端服务的proto定义，一元调用和流式调用都可以转发
+func NewGrpcServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.CustomCodec(rawCodec{}), grpc.UnknownServiceHandler(grpcProxyHandler))
+	return grpc.NewServer(opts...)
+}
+
+// GrpcServiceName 根据grpc的完整方法名解析出租户中在SchedulerPool中注册的服务名
+// 例如 /sortService.SortService/Sort 会先尝试 sortService.SortService，再尝试去掉包名之后的 SortService
+func GrpcServiceName(namespace, fullMethod string) (string, error) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	service := fullMethod
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		service = fullMethod[:i]
+	}
+	// 方法名中带有多个 / 时可能会访问到其他租户的服务
+	if strings.Contains(service, tenant.Separator) {
+		return "", tenant.ErrInvalidName
+	}
+	if _, ok := svrpool.SchedulerPool.Load(tenant.Qualify(namespace, service)); ok {
+		return tenant.Qualify(namespace, service), nil
+	}
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		service = service[i+1:]
+	}
+	return tenant.Qualify(namespace, service), nil
+}
+
+// 返回转发给后端的metadata，客户端的凭证和保留的metadata不会转发，拦截器通过SetStreamMetadata设置的metadata会被追加进去
+func outgoingMetadata(ctx context.Context) metadata.MD {
+	md, _ := metadata.FromIncomingContext(ctx)
+	outMD := metadata.MD{}
+	for k, v := range md {
+		// 伪首部由grpc自己维护，不能转发
+		if strings.HasPrefix(k, ":") || !forwardable(k) {
+			continue
+		}
+		outMD[k] = v
+	}
+	if forward, ok := ctx.Value(metadataCtxKey{}).(metadata.MD); ok {
+		for k, v := range forward {
+			outMD[k] = v
+		}
+	}
+	return outMD
+}
+
+// 和HTTP请求一样，原生grpc请求也要经过限流和准入，名额在整个stream结束之后才会释放
+func grpcProxyHandler(srv interface{}, serverStream grpc.ServerStream) (err error) {
+	fullMethod, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "can not get method from server stream")
+	}
+	ctx := serverStream.Context()
+	serviceName, err := GrpcServiceName(tenant.FromContext(ctx), fullMethod)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if allowed, retryAfter := ratelimit.CheckStream(ctx, fullMethod, serviceName); !allowed {
+		serverStream.SetTrailer(metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))))
+		return status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	release, err := admitPriority(ctx, serviceName, admission.ClassifyStream(ctx, fullMethod))
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "service is overloaded: %v", err)
+	}
+	start := time.Now()
+	var invoker svrpool.StreamInvoker
+	var sent, received int64
+	defer func() {
+		// 只有一元调用的耗时能够反映后端的处理能力，流式调用的时长取决于客户端，释放名额时不记录耗时
+		rtt := concurrency.NoRtt
+		if atomic.LoadInt64(&sent) <= 1 && atomic.LoadInt64(&received) <= 1 {
+			rtt = time.Since(start)
+		}
+		// 没有选出实例时返回的Unavailable不是后端给出的，不能算作过载
+		release(rtt, invoker != nil && overloaded(err))
+	}()
+	invoker, err = selectStreamInvoker(serviceName, grpcHintOf(ctx, fullMethod))
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "%v", err)
+	}
+	clientCtx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, outgoingMetadata(ctx)))
+	defer cancel()
+	clientStream, err := invoker.ClientConn().NewStream(clientCtx, bidiStreamDesc, fullMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+
+	c2b := forwardClientToBackend(serverStream, clientStream, &sent)
+	b2c := forwardBackendToClient(clientStream, serverStream, &received)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-c2b:
+			if err == io.EOF {
+				// 客户端已经发送完毕，关闭发送端之后继续等待后端的响应
+				clientStream.CloseSend()
+				continue
+			}
+			cancel()
+			return status.Errorf(codes.Internal, "failed proxying request: %v", err)
+		case err := <-b2c:
+			serverStream.SetTrailer(clientStream.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			// 后端返回的错误本身就是一个grpc status，直接透传给客户端
+			return err
+		}
+	}
+	return status.Error(codes.Internal, "proxy should never reach here")
+}
+
+// 将客户端发来的消息转发给后端，结束时通过channel返回错误，客户端正常发送完毕时返回io.EOF
+// count 记录已经转发的消息数
+func forwardClientToBackend(src grpc.ServerStream, dst grpc.ClientStream, count *int64) chan error {
+	ret := make(chan error, 1)
+	go func() {
+		f := &frame{}
+		for {
+			if err := src.RecvMsg(f); err != nil {
+				ret <- err
+				return
+			}
+			if err := dst.SendMsg(f); err != nil {
+				ret <- err
+				return
+			}
+			atomic.AddInt64(count, 1)
+		}
+	}()
+	return ret
+}
+
+// 将后端返回的header和消息转发给客户端，后端正常结束时返回io.EOF，count 记录已经转发的消息数
+func forwardBackendToClient(src grpc.ClientStream, dst grpc.ServerStream, count *int64) chan error {
+	ret := make(chan error, 1)
+	go func() {
+		f := &frame{}
+		for i := 0; ; i++ {
+			if err := src.RecvMsg(f); err != nil {
+				ret <- err
+				return
+			}
+			if i == 0 {
+				// header 只有在后端返回第一条消息之后才能确定下来
+				md, err := src.Header()
+				if err != nil {
+					ret <- err
+					return
+				}
+				if err := dst.SendHeader(md); err != nil {
+					ret <- err
+					return
+				}
+			}
+			if err := dst.SendMsg(f); err != nil {
+				ret <- err
+				return
+			}
+			atomic.AddInt64(count, 1)
+		}
+	}()
+	return ret
+}
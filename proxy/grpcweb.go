@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"Gateway/concurrency"
+	"Gateway/ratelimit"
+	"Gateway/tenant"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC-Web的配置
+// AllowedOrigins 表示允许跨域访问的Origin，只有显式列出的Origin可以携带cookie等凭证；包含 "*" 时允许所有的Origin，但不允许携带凭证
+// AllowedHeaders 表示跨域请求允许携带的请求头，预检请求中要求的其他请求头不会被允许
+// MaxRequestSize 表示请求体的最大字节数
+type GrpcWebConfig struct {
+	AllowedOrigins []string
+	AllowedHeaders []string
+	MaxRequestSize int64
+}
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcWebTrailerFlag     = 0x80 // 帧的标志位，表示该帧是trailer
+	grpcWebCompressedFlag  = 0x01 // 帧的标志位，表示该帧经过了压缩，目前还不支持
+)
+
+var (
+	GWConfig = GrpcWebConfig{
+		AllowedOrigins: []string{"*"},
+		AllowedHeaders: []string{"content-type", "x-grpc-web", "x-user-agent", "grpc-timeout", "authorization", "x-api-key", "x-service-version"},
+		MaxRequestSize: 4 << 20,
+	}
+
+	// 这些请求头只在浏览器和网关之间有意义，不会作为metadata转发给后端
+	grpcWebSkipHeaders = map[string]bool{
+		"content-type": true, "content-length": true, "host": true, "connection": true,
+		"accept": true, "accept-encoding": true, "origin": true, "referer": true,
+		"x-grpc-web": true, "x-user-agent": true, "grpc-timeout": true, "user-agent": true,
+	}
+)
+
+// GrpcWeb 处理浏览器发来的gRPC-Web请求（包括二进制和文本两种模式），转换成原生的grpc调用发给后端
+// 路由的格式为 /grpcweb/*method ，method 是grpc的完整方法名，例如 /sortService.SortService/Sort
+// OPTIONS 请求作为CORS的预检请求处理
+func GrpcWeb(c *gin.Context) {
+	if !setCORSHeaders(c) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if c.Request.Method == http.MethodOptions {
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	if c.Request.Method != http.MethodPost {
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := c.GetHeader("Content-Type")
+	textMode := strings.HasPrefix(contentType, grpcWebTextContentType)
+	if !textMode && !strings.HasPrefix(contentType, grpcWebContentType) {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	c.Header("Content-Type", contentType)
+	fullMethod := c.Param("method")
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, GWConfig.MaxRequestSize+1))
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.New(codes.Internal, "can not read request body"), nil, false)
+		return
+	}
+	if int64(len(body)) > GWConfig.MaxRequestSize {
+		writeGrpcWebStatus(c, textMode, status.New(codes.ResourceExhausted, "request body is too large"), nil, false)
+		return
+	}
+	if textMode {
+		if body, err = decodeGrpcWebText(body); err != nil {
+			writeGrpcWebStatus(c, textMode, status.New(codes.InvalidArgument, err.Error()), nil, false)
+			return
+		}
+	}
+	msgs, err := parseGrpcWebFrames(body)
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.New(codes.InvalidArgument, err.Error()), nil, false)
+		return
+	}
+
+	serviceName, err := GrpcServiceName(tenant.Get(c), fullMethod)
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.New(codes.InvalidArgument, err.Error()), nil, false)
+		return
+	}
+	// 服务名由方法名决定，不在Query参数中，所以服务的限流规则需要在这里执行
+	if allowed, retryAfter := ratelimit.AllowService(c, serviceName); !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeGrpcWebStatus(c, textMode, status.New(codes.ResourceExhausted, "too many requests"), nil, false)
+		return
+	}
+	release, err := admit(c, serviceName)
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.New(codes.ResourceExhausted, fmt.Sprintf("service is overloaded: %v", err)), nil, false)
+		return
+	}
+	start := time.Now()
+	responses := 0
+	defer func() {
+		// 服务端流的时长取决于后端推送的节奏，只有一元调用记录耗时
+		rtt := concurrency.NoRtt
+		if len(msgs) <= 1 && responses <= 1 {
+			rtt = time.Since(start)
+		}
+		release(rtt, overloaded(err))
+	}()
+	invoker, err := selectStreamInvoker(serviceName, hintOf(c))
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.New(codes.Unavailable, err.Error()), nil, false)
+		return
+	}
+	ctx, cancel := grpcWebContext(c)
+	defer cancel()
+	stream, err := invoker.ClientConn().NewStream(ctx, bidiStreamDesc, fullMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		writeGrpcWebStatus(c, textMode, status.Convert(err), nil, false)
+		return
+	}
+	for _, msg := range msgs {
+		if err := stream.SendMsg(&frame{payload: msg}); err != nil {
+			// 真正的错误原因会由RecvMsg返回
+			break
+		}
+	}
+	stream.CloseSend()
+
+	// gRPC-Web只支持一元调用和服务端流，所以这里只需要不断地读取后端的响应
+	f := &frame{}
+	headerSent := false
+	for {
+		err = stream.RecvMsg(f)
+		if err != nil {
+			break
+		}
+		if !headerSent {
+			if md, err := stream.Header(); err == nil {
+				writeGrpcWebHeaders(c, md)
+			}
+			c.Status(http.StatusOK)
+			headerSent = true
+		}
+		writeGrpcWebFrame(c, textMode, 0, f.payload)
+		c.Writer.Flush()
+		responses++
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	writeGrpcWebStatus(c, textMode, status.Convert(err), stream.Trailer(), headerSent)
+}
+
+// 判断Origin是否出现在AllowedOrigins中，"*" 只匹配 "*" 本身
+func originListed(origin string) bool {
+	for _, o := range GWConfig.AllowedOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据请求的Origin决定Access-Control-Allow-Origin的值以及是否允许携带凭证，Origin 不被允许时ok为false
+// 显式列出的Origin会被原样返回并允许携带凭证；只配置了 "*" 时返回 "*"，不允许携带凭证，否则任何网站都可以以用户的身份发起调用
+func corsOrigin(origin string) (allowOrigin string, credentials bool, ok bool) {
+	if originListed(origin) {
+		return origin, true, true
+	}
+	if originListed("*") {
+		return "*", false, true
+	}
+	return "", false, false
+}
+
+// 设置CORS相关的响应头，Origin 不在允许列表中时返回false
+func setCORSHeaders(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	allowOrigin, credentials, ok := corsOrigin(origin)
+	if !ok {
+		return false
+	}
+	c.Header("Access-Control-Allow-Origin", allowOrigin)
+	if credentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+	c.Header("Vary", "Origin")
+	c.Header("Access-Control-Expose-Headers", "grpc-status,grpc-message")
+	if c.Request.Method == http.MethodOptions {
+		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", strings.Join(GWConfig.AllowedHeaders, ","))
+		c.Header("Access-Control-Max-Age", "600")
+	}
+	return true
+}
+
+// 根据请求头构造调用后端时使用的context，除了凭证以外的普通请求头会作为metadata转发，grpc-timeout 会被转换为deadline
+func grpcWebContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	md := metadata.MD{}
+	for k, v := range c.Request.Header {
+		k = strings.ToLower(k)
+		if grpcWebSkipHeaders[k] || strings.HasPrefix(k, "access-control-") || !forwardable(k) {
+			continue
+		}
+		md[k] = v
+	}
+	ctx := withMetadata(metadata.NewOutgoingContext(context.Background(), md), c)
+	if timeout, ok := parseGrpcTimeout(c.GetHeader("grpc-timeout")); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// 解析grpc-timeout请求头，格式为数字加上单位，例如 100m 表示100毫秒
+func parseGrpcTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// 文本模式的请求体可能是多段base64拼接而成的，每一段都带有自己的padding，所以按照4个字符为一组依次解码
+func decodeGrpcWebText(body []byte) ([]byte, error) {
+	body = bytes.Join(bytes.Fields(body), nil)
+	if len(body)%4 != 0 {
+		return nil, errors.New("malformed base64 request body")
+	}
+	out := make([]byte, 0, len(body)/4*3)
+	buf := make([]byte, 3)
+	for i := 0; i < len(body); i += 4 {
+		n, err := base64.StdEncoding.Decode(buf, body[i:i+4])
+		if err != nil {
+			return nil, errors.New("malformed base64 request body")
+		}
+		out = append(out, buf[:n]...)
+	}
+	return out, nil
+}
+
+// 解析请求体中的数据帧，每一帧的格式为 1字节标志位 + 4字节大端长度 + 消息内容
+func parseGrpcWebFrames(body []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errors.New("malformed grpc-web frame")
+		}
+		flag := body[0]
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(length) {
+			return nil, errors.New("malformed grpc-web frame")
+		}
+		payload := body[5 : 5+length]
+		body = body[5+length:]
+		if flag&grpcWebCompressedFlag != 0 {
+			return nil, errors.New("compressed grpc-web frame is not supported")
+		}
+		if flag&grpcWebTrailerFlag != 0 {
+			continue
+		}
+		msgs = append(msgs, payload)
+	}
+	return msgs, nil
+}
+
+func writeGrpcWebHeaders(c *gin.Context, md metadata.MD) {
+	for k, vs := range md {
+		for _, v := range vs {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+}
+
+func writeGrpcWebFrame(c *gin.Context, textMode bool, flag byte, payload []byte) {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = flag
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	if textMode {
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(buf)))
+		base64.StdEncoding.Encode(encoded, buf)
+		buf = encoded
+	}
+	c.Writer.Write(buf)
+}
+
+// 以trailer帧的形式返回调用的状态，如果还没有写过响应头，同时也把状态放在响应头中（Trailers-Only）
+func writeGrpcWebStatus(c *gin.Context, textMode bool, st *status.Status, trailer metadata.MD, headerSent bool) {
+	message := encodeGrpcMessage(st.Message())
+	if !headerSent {
+		c.Header("grpc-status", strconv.Itoa(int(st.Code())))
+		c.Header("grpc-message", message)
+		c.Status(http.StatusOK)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "grpc-status: %d\r\n", st.Code())
+	fmt.Fprintf(&buf, "grpc-message: %s\r\n", message)
+	for k, vs := range trailer {
+		for _, v := range vs {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	writeGrpcWebFrame(c, textMode, grpcWebTrailerFlag, buf.Bytes())
+}
+
+// 按照grpc协议对grpc-message进行百分号编码
+func encodeGrpcMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		ch := msg[i]
+		if ch >= 0x20 && ch <= 0x7e && ch != '%' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"Gateway/concurrency"
+	"Gateway/ratelimit"
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+)
+
+func grpcWebFrame(flag byte, payload string) []byte {
+	buf := []byte{flag, 0, 0, 0, 0}
+	buf[1], buf[2], buf[3], buf[4] = byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	return append(buf, payload...)
+}
+
+func TestParseGrpcWebFrames(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    []byte
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"single", grpcWebFrame(0, "hello"), []string{"hello"}, false},
+		{"empty message", grpcWebFrame(0, ""), []string{""}, false},
+		{"multiple", append(grpcWebFrame(0, "a"), grpcWebFrame(0, "bc")...), []string{"a", "bc"}, false},
+		{"trailer skipped", append(grpcWebFrame(0, "a"), grpcWebFrame(grpcWebTrailerFlag, "grpc-status: 0\r\n")...), []string{"a"}, false},
+		{"short header", []byte{0, 0, 0}, nil, true},
+		{"truncated payload", grpcWebFrame(0, "hello")[:7], nil, true},
+		{"huge length", []byte{0, 0xff, 0xff, 0xff, 0xff, 1}, nil, true},
+		{"compressed", grpcWebFrame(grpcWebCompressedFlag, "x"), nil, true},
+	}
+	for _, c := range cases {
+		msgs, err := parseGrpcWebFrames(c.body)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		var got []string
+		for _, msg := range msgs {
+			got = append(got, string(msg))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: messages = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDecodeGrpcWebText(t *testing.T) {
+	first := grpcWebFrame(0, "a")
+	second := grpcWebFrame(0, "bcd")
+	cases := []struct {
+		name    string
+		body    string
+		want    []byte
+		wantErr bool
+	}{
+		{"single chunk", base64.StdEncoding.EncodeToString(first), first, false},
+		// 客户端分多次发送时每一段都有自己的padding
+		{"concatenated chunks", base64.StdEncoding.EncodeToString(first) + base64.StdEncoding.EncodeToString(second), append(append([]byte{}, first...), second...), false},
+		{"with newlines", "AAAA\r\nAAFh", first, false},
+		{"bad length", "AAAAA", nil, true},
+		{"bad character", "AA*A", nil, true},
+	}
+	for _, c := range cases {
+		got, err := decodeGrpcWebText([]byte(c.body))
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && !bytes.Equal(got, c.want) {
+			t.Errorf("%s: decoded = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := GWConfig
+	defer func() { GWConfig = old }()
+	cases := []struct {
+		name            string
+		origins         []string
+		origin          string
+		preflight       bool
+		wantAllowed     bool
+		wantOrigin      string
+		wantCredentials bool
+	}{
+		{"no origin", []string{"https://app.example.com"}, "", false, true, "", false},
+		{"wildcard", []string{"*"}, "https://evil.example.com", false, true, "*", false},
+		{"listed", []string{"https://app.example.com"}, "https://app.example.com", false, true, "https://app.example.com", true},
+		{"listed with wildcard", []string{"*", "https://app.example.com"}, "https://app.example.com", false, true, "https://app.example.com", true},
+		{"unlisted with wildcard", []string{"*", "https://app.example.com"}, "https://evil.example.com", false, true, "*", false},
+		{"unlisted", []string{"https://app.example.com"}, "https://evil.example.com", true, false, "", false},
+		{"preflight", []string{"https://app.example.com"}, "https://app.example.com", true, true, "https://app.example.com", true},
+	}
+	for _, c := range cases {
+		GWConfig.AllowedOrigins = c.origins
+		method := http.MethodPost
+		if c.preflight {
+			method = http.MethodOptions
+		}
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest(method, "/grpcweb/pkg.Service/Method", nil)
+		if c.origin != "" {
+			ctx.Request.Header.Set("Origin", c.origin)
+		}
+		ctx.Request.Header.Set("Access-Control-Request-Headers", "x-secret-header")
+		allowed := setCORSHeaders(ctx)
+		header := w.Header()
+		if allowed != c.wantAllowed || header.Get("Access-Control-Allow-Origin") != c.wantOrigin ||
+			(header.Get("Access-Control-Allow-Credentials") == "true") != c.wantCredentials {
+			t.Errorf("%s: allowed = %v, origin = %q, credentials = %q", c.name, allowed,
+				header.Get("Access-Control-Allow-Origin"), header.Get("Access-Control-Allow-Credentials"))
+		}
+		// 预检请求中要求的请求头不会被原样返回
+		if bytes.Contains([]byte(header.Get("Access-Control-Allow-Headers")), []byte("x-secret-header")) {
+			t.Errorf("%s: requested header is echoed back", c.name)
+		}
+	}
+}
+
+func TestGrpcWebAdmission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ratelimit.SetServiceRule("LimitedSvc", &ratelimit.Rule{Algorithm: ratelimit.TokenBucket, Rate: 1, Period: time.Hour, KeyFunc: ratelimit.AllClients})
+	defer ratelimit.RemoveServiceRule("LimitedSvc")
+	limiter := concurrency.NewAIMDLimiter(1, 1, 1, 0.5, time.Second)
+	concurrency.SetLimiter("BusySvc", limiter)
+	defer concurrency.RemoveLimiter("BusySvc")
+	// 占满BusySvc唯一的名额
+	limiter.Acquire()
+	defer limiter.Release(0, false)
+	router := gin.New()
+	router.POST("/grpcweb/*method", GrpcWeb)
+
+	cases := []struct {
+		name   string
+		method string
+		want   codes.Code
+	}{
+		// 通过了限流和准入，但是服务没有可用的实例
+		{"first call", "/pkg.LimitedSvc/Call", codes.Unavailable},
+		{"rate limited", "/pkg.LimitedSvc/Call", codes.ResourceExhausted},
+		{"concurrency exhausted", "/pkg.BusySvc/Call", codes.ResourceExhausted},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/grpcweb"+c.method, bytes.NewReader(grpcWebFrame(0, "x")))
+		req.Header.Set("Content-Type", grpcWebContentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if got := w.Header().Get("grpc-status"); got != strconv.Itoa(int(c.want)) {
+			t.Errorf("%s: grpc-status = %s, want %d", c.name, got, c.want)
+		}
+	}
+}
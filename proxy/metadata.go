@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+const metadataKey = "proxy.metadata" // 保存在gin.Context中，需要转发给后端的metadata
+
+var (
+	// 这些请求头（原生grpc中为metadata）是客户端给网关的凭证，会话亲和性的cookie也在其中，不会转发给后端
+	credentialHeaders = map[string]bool{"authorization": true, "x-api-key": true, "cookie": true}
+	reservedPrefixes  []string
+)
+
+type metadataCtxKey struct{}
+
+// ReservePrefix 声明以prefix开头的metadata只能由网关的中间件设置，客户端自己携带的不会转发给后端，需要在启动时调用
+func ReservePrefix(prefix string) {
+	reservedPrefixes = append(reservedPrefixes, strings.ToLower(prefix))
+}
+
+// 判断客户端携带的请求头或者metadata是否可以转发给后端，name 为小写
+func forwardable(name string) bool {
+	if credentialHeaders[name] {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetMetadata 设置一条需要随调用转发给后端的metadata，认证等中间件可以通过它把用户信息传递给后端
+func SetMetadata(c *gin.Context, key, value string) {
+	md, ok := c.Get(metadataKey)
+	if !ok {
+		md = metadata.MD{}
+		c.Set(metadataKey, md)
+	}
+	md.(metadata.MD).Set(key, value)
+}
+
+// SetStreamMetadata 是SetMetadata的原生grpc版本，返回的context需要传递给后面的handler，原生grpc入口的拦截器通过它把用户信息传递给后端
+func SetStreamMetadata(ctx context.Context, key, value string) context.Context {
+	md, _ := ctx.Value(metadataCtxKey{}).(metadata.MD)
+	md = md.Copy()
+	md.Set(key, value)
+	return context.WithValue(ctx, metadataCtxKey{}, md)
+}
+
+// 将中间件设置的metadata合并到ctx的outgoing metadata中
+func withMetadata(ctx context.Context, c *gin.Context) context.Context {
+	md, ok := c.Get(metadataKey)
+	if !ok {
+		return ctx
+	}
+	if outMD, ok := metadata.FromOutgoingContext(ctx); ok {
+		return metadata.NewOutgoingContext(ctx, metadata.Join(outMD, md.(metadata.MD)))
+	}
+	return metadata.NewOutgoingContext(ctx, md.(metadata.MD))
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+func init() {
+	ReservePrefix("X-Test-")
+}
+
+func TestGrpcWebForwardedMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/grpcweb/pkg.Svc/Call", nil)
+	for k, v := range map[string]string{
+		"Authorization": "Bearer secret", "X-Api-Key": "secret", "Cookie": "gw-affinity=token",
+		"X-Test-Sub": "forged", "Content-Type": grpcWebContentType, "X-Request-Id": "42",
+	} {
+		c.Request.Header.Set(k, v)
+	}
+	SetMetadata(c, "x-test-sub", "alice")
+	ctx, cancel := grpcWebContext(c)
+	defer cancel()
+	md, _ := metadata.FromOutgoingContext(ctx)
+	want := metadata.Pairs("x-request-id", "42", "x-test-sub", "alice")
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("forwarded metadata = %v, want %v", md, want)
+	}
+}
+
+func TestGrpcOutgoingMetadata(t *testing.T) {
+	cases := []struct {
+		name     string
+		incoming metadata.MD
+		claims   map[string]string
+		want     metadata.MD
+	}{
+		{"plain", metadata.Pairs("x-request-id", "42"), nil, metadata.Pairs("x-request-id", "42")},
+		{"pseudo header", metadata.Pairs(":authority", "gw.example.com", "x-request-id", "42"), nil, metadata.Pairs("x-request-id", "42")},
+		{"credentials", metadata.Pairs("authorization", "Bearer secret", "x-api-key", "secret", "cookie", "a=b"), nil, metadata.MD{}},
+		{"forged reserved", metadata.Pairs("x-test-sub", "forged"), nil, metadata.MD{}},
+		{"set by interceptor", metadata.Pairs("x-test-sub", "forged"), map[string]string{"x-test-sub": "alice"}, metadata.Pairs("x-test-sub", "alice")},
+	}
+	for _, c := range cases {
+		ctx := metadata.NewIncomingContext(context.Background(), c.incoming)
+		for k, v := range c.claims {
+			ctx = SetStreamMetadata(ctx, k, v)
+		}
+		if got := outgoingMetadata(ctx); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: outgoing metadata = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
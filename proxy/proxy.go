@@ -1,12 +1,25 @@
 package proxy
 
 import (
+	"Gateway/admission"
+	"Gateway/affinity"
+	"Gateway/concurrency"
+	"Gateway/content"
+	"Gateway/mirror"
+	"Gateway/split"
 	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -20,30 +33,124 @@ func Proxy(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "can not read request body", "rsp": nil})
 		return
 	}
-	schedulerInstance, ok := svrpool.SchedulerPool.Load(serviceName)
-	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "can not get scheduler instance", "rsp": nil})
+	hint := hintOf(c)
+	hint.RequestSize = len(body)
+	// 先根据请求头，Query参数和请求体的内容选出服务和实例的子集
+	if target := content.Resolve(c, body); target != nil {
+		if target.Service != "" {
+			serviceName = target.Service
+		}
+		hint.Selector = append(hint.Selector, target.Selector...)
+	}
+	// 路由配置了流量拆分时，由拆分的结果决定调用的服务和实例的子集
+	choice := split.Choose(c)
+	if choice != nil {
+		if choice.Service != "" {
+			serviceName = choice.Service
+		}
+		hint.Selector = append(hint.Selector, choice.Selector...)
+	}
+	// 服务名都是相对于请求所属租户的，只能调用该租户的服务
+	serviceName, err = tenant.Service(c, serviceName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	scheduler, err := getScheduler(serviceName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
 		return
 	}
-	var scheduler svrpool.Scheduler
-	scheduler, ok = schedulerInstance.(svrpool.Scheduler)
+	release, err := admit(c, serviceName)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": -1, "msg": fmt.Sprintf("service is overloaded: %v", err), "rsp": nil})
+		return
+	}
+	// 按照镜像规则把请求异步地复制给影子服务，影子请求不会影响客户端
+	shadow := mirror.Start(withMetadata(context.Background(), c), tenant.Route(c), serviceName, body)
+	start := time.Now()
+	defer func() {
+		release(time.Since(start), overloaded(err))
+		if choice != nil {
+			choice.Done(err, time.Since(start))
+		}
+	}()
 
+	// 开启了会话亲和性时，第一次尝试使用之前绑定的Invoker，绑定的Invoker不可用或者调用失败时由调度器重新选择
+	pinned := affinity.Pinned(c, serviceName, hint.Selector)
 	var invoker svrpool.Invoker
 	for i := 0; i < retryTimes; i++ {
-		invoker, err = scheduler.Select()
-		if err != nil {
-			continue
+		if i == 0 && pinned != nil {
+			invoker = pinned
+		} else {
+			invoker, err = svrpool.Select(scheduler, hint)
+			if err != nil {
+				continue
 
+			}
 		}
 		var rsp []byte
-		rsp, err = invoker.Invoke(body)
+		if ctxInvoker, ok := invoker.(svrpool.ContextInvoker); ok {
+			rsp, err = ctxInvoker.InvokeContext(withMetadata(c.Request.Context(), c), body)
+		} else {
+			rsp, err = invoker.Invoke(body)
+		}
 		if err != nil {
 			continue
 
 		}
+		shadow.Primary(rsp, nil)
+		affinity.Bind(c, serviceName, invoker)
 		c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": string(rsp)})
 		return
 	}
+	shadow.Primary(nil, err)
+	if err == svrpool.ErrNoCapacity {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
 	c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": fmt.Sprintf("%v", err), "rsp": nil})
 	return
 }
+
+// 在调用服务之前获取执行名额，服务配置了准入队列时按照优先级排队等待，只配置了并发限制器时拿不到名额直接失败
+// 返回的release需要在调用结束之后执行，用于释放名额
+func admit(c *gin.Context, serviceName string) (func(rtt time.Duration, dropped bool), error) {
+	return admitPriority(c.Request.Context(), serviceName, admission.Classify(c))
+}
+
+// 以指定的优先级获取执行名额，原生grpc请求没有gin.Context，直接使用该函数
+func admitPriority(ctx context.Context, serviceName string, priority int) (func(rtt time.Duration, dropped bool), error) {
+	if queue := admission.GetQueue(serviceName); queue != nil {
+		if err := queue.Wait(ctx, priority); err != nil {
+			return nil, err
+		}
+		return queue.Release, nil
+	}
+	if limiter := concurrency.GetLimiter(serviceName); limiter != nil {
+		if !limiter.Acquire() {
+			return nil, errors.New("concurrency limit exceeded")
+		}
+		return limiter.Release, nil
+	}
+	return func(time.Duration, bool) {}, nil
+}
+
+// 判断调用失败是否说明服务过载，只有超时和后端不可用才会让并发限制器和准入队列认为请求被丢弃
+// 客户端取消，请求本身的错误以及没有选出实例等其他错误的耗时都按照正常的样本处理
+func overloaded(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Unavailable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestOverloaded(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"network timeout", timeoutError{}, true},
+		{"grpc deadline", status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{"backend unavailable", status.Error(codes.Unavailable, "connection refused"), true},
+		{"client canceled", context.Canceled, false},
+		{"grpc canceled", status.Error(codes.Canceled, "canceled"), false},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad request"), false},
+		{"selector miss", errors.New("no server matches the selector"), false},
+	}
+	for _, c := range cases {
+		if got := overloaded(c.err); got != c.want {
+			t.Errorf("%s: overloaded = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
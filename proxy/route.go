@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	VersionHeader = "X-Service-Version" // 客户端指定需要调用的服务版本，相当于在选择器中增加 version=xxx
+)
+
+var (
+	routeSelectors = &sync.Map{} // route -> svrpool.Selector，route 为tenant.Route返回的路由，例如 /sortService，原生grpc为tenant.GrpcRoute返回的完整方法名
+)
+
+// 为路由设置选择器，该路由的请求只会被调度到满足选择器的实例上，例如 version=v2,gpu=false
+func SetRouteSelector(route string, selector svrpool.Selector) {
+	routeSelectors.Store(route, selector)
+}
+
+func RemoveRouteSelector(route string) {
+	routeSelectors.Delete(route)
+}
+
+// 合并路由的选择器和客户端通过VersionHeader指定的版本
+func buildSelector(route, version string) svrpool.Selector {
+	var selector svrpool.Selector
+	if val, ok := routeSelectors.Load(route); ok {
+		selector = append(selector, val.(svrpool.Selector)...)
+	}
+	if version != "" {
+		selector = append(selector, svrpool.Requirement{Key: svrpool.MetaVersion, Value: version})
+	}
+	return selector
+}
+
+// GrpcMethod 返回HTTP请求要调用的grpc完整方法名，例如 /sortService.SortService/Sort，不是grpc调用时返回空字符串
+// gRPC-Web请求的方法名在路径中，WebSocket请求的方法名在Query参数method中
+func GrpcMethod(c *gin.Context) string {
+	if method := c.Param("method"); method != "" {
+		return method
+	}
+	return c.Query("method")
+}
+
+// 根据HTTP请求生成调度时使用的Hint
+func hintOf(c *gin.Context) svrpool.Hint {
+	return svrpool.Hint{Selector: buildSelector(tenant.Route(c), c.GetHeader(VersionHeader))}
+}
+
+// 根据原生grpc请求生成调度时使用的Hint
+func grpcHintOf(ctx context.Context, fullMethod string) svrpool.Hint {
+	version := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(VersionHeader)); len(values) > 0 {
+			version = values[0]
+		}
+	}
+	return svrpool.Hint{Selector: buildSelector(tenant.GrpcRoute(ctx, fullMethod), version)}
+}
+
+// 根据服务名选出调度器
+func getScheduler(serviceName string) (svrpool.Scheduler, error) {
+	schedulerInstance, ok := svrpool.SchedulerPool.Load(serviceName)
+	if !ok {
+		return nil, errors.New("can not get scheduler instance")
+	}
+	scheduler, _ := schedulerInstance.(svrpool.Scheduler)
+	return scheduler, nil
+}
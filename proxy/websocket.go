@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"Gateway/concurrency"
+	"Gateway/ratelimit"
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// WebSocket桥接的配置
+// MaxConnections 表示网关同时保持的WebSocket连接数上限，超过之后新的连接会被拒绝
+// MaxMessageSize 表示单个WebSocket帧的最大字节数，超过之后连接会被关闭
+// MaxLifetime 表示单个连接最长的存活时间，为0表示不限制
+// PingInterval 和 PongWait 用于保活，超过PongWait没有收到客户端的任何消息（包括pong）就认为连接已经断开
+// WriteWait 表示每次向客户端写数据的超时时间
+// CloseGracePeriod 表示客户端关闭之后等待后端结束stream的时间，超时之后直接取消grpc调用
+type WebSocketConfig struct {
+	MaxConnections   int64
+	MaxMessageSize   int64
+	MaxLifetime      time.Duration
+	PingInterval     time.Duration
+	PongWait         time.Duration
+	WriteWait        time.Duration
+	CloseGracePeriod time.Duration
+}
+
+var (
+	WSConfig = WebSocketConfig{
+		MaxConnections:   1024,
+		MaxMessageSize:   1 << 20,
+		PingInterval:     30 * time.Second,
+		PongWait:         60 * time.Second,
+		WriteWait:        10 * time.Second,
+		CloseGracePeriod: 5 * time.Second,
+	}
+	wsConnCount int64 // 当前活跃的WebSocket连接数
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     checkWebSocketOrigin,
+	}
+	bidiStreamDesc = &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+)
+
+// 浏览器发起的WebSocket握手总会带上cookie，并且不受CORS的限制，所以只允许同源或者在GWConfig.AllowedOrigins中显式列出的Origin，"*" 对WebSocket不生效
+// 没有Origin的请求来自非浏览器的客户端，直接允许
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originListed(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// 根据服务名选出一个能够创建grpc stream的Invoker
+func selectStreamInvoker(serviceName string, hint svrpool.Hint) (svrpool.StreamInvoker, error) {
+	scheduler, err := getScheduler(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < retryTimes; i++ {
+		var invoker svrpool.Invoker
+		invoker, err = svrpool.Select(scheduler, hint)
+		if err != nil {
+			continue
+		}
+		streamInvoker, ok := invoker.(svrpool.StreamInvoker)
+		if !ok {
+			return nil, errors.New("invoker of service doesn't support stream")
+		}
+		return streamInvoker, nil
+	}
+	return nil, err
+}
+
+// WebSocket 将一个WebSocket连接桥接到后端的双向流grpc调用上
+// 请求的Query参数中 service 表示服务名，method 表示grpc的完整方法名，例如 /sortService.SortService/Sort
+// 客户端发送的每一帧都会作为一条grpc消息发给后端，后端返回的每一条消息也会作为一个二进制帧写回客户端
+func WebSocket(c *gin.Context) {
+	serviceName, err := tenant.Service(c, c.Query("service"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	method := c.Query("method")
+	if method == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "method is required", "rsp": nil})
+		return
+	}
+	// 和其他的调用一样经过服务的限流和准入，避免一个租户的长连接占满所有的WebSocket连接名额
+	if allowed, retryAfter := ratelimit.AllowService(c, serviceName); !allowed {
+		ratelimit.Reject(c, retryAfter)
+		return
+	}
+	release, err := admit(c, serviceName)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": -1, "msg": fmt.Sprintf("service is overloaded: %v", err), "rsp": nil})
+		return
+	}
+	var invoker svrpool.StreamInvoker
+	defer func() {
+		// WebSocket连接的时长取决于客户端，不能作为耗时样本
+		release(concurrency.NoRtt, invoker != nil && overloaded(err))
+	}()
+	if atomic.AddInt64(&wsConnCount, 1) > WSConfig.MaxConnections {
+		atomic.AddInt64(&wsConnCount, -1)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": -1, "msg": "too many websocket connections", "rsp": nil})
+		return
+	}
+	defer atomic.AddInt64(&wsConnCount, -1)
+
+	invoker, err = selectStreamInvoker(serviceName, hintOf(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": fmt.Sprintf("%v", err), "rsp": nil})
+		return
+	}
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade 失败时已经向客户端返回了错误信息
+		log.Println("upgrade websocket failed, the err is", err)
+		return
+	}
+	defer ws.Close()
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if WSConfig.MaxLifetime > 0 {
+		ctx, cancel = context.WithTimeout(withMetadata(context.Background(), c), WSConfig.MaxLifetime)
+	} else {
+		ctx, cancel = context.WithCancel(withMetadata(context.Background(), c))
+	}
+	defer cancel()
+	stream, err := invoker.ClientConn().NewStream(ctx, bidiStreamDesc, method, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		writeClose(ws, websocket.CloseInternalServerErr, fmt.Sprintf("%v", err))
+		return
+	}
+
+	clientClosed := make(chan struct{})
+	go pumpClientToBackend(ws, stream, cancel, clientClosed)
+	backendDone := make(chan error, 1)
+	go func() {
+		backendDone <- pumpBackendToClient(ws, stream)
+	}()
+
+	ticker := time.NewTicker(WSConfig.PingInterval)
+	defer ticker.Stop()
+	var grace <-chan time.Time
+	for {
+		select {
+		case err = <-backendDone:
+			if err == nil {
+				writeClose(ws, websocket.CloseNormalClosure, "")
+			} else {
+				writeClose(ws, websocket.CloseInternalServerErr, status.Convert(err).Message())
+			}
+			return
+		case <-clientClosed:
+			// 客户端已经关闭，给后端一段时间结束stream，超时之后取消调用
+			clientClosed = nil
+			grace = time.After(WSConfig.CloseGracePeriod)
+		case <-grace:
+			cancel()
+			grace = nil
+		case <-ticker.C:
+			deadline := time.Now().Add(WSConfig.WriteWait)
+			if err := ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				cancel()
+			}
+		}
+	}
+}
+
+// 从客户端读取数据帧并发送给后端，客户端正常关闭时会关闭stream的发送端，异常断开时直接取消grpc调用
+func pumpClientToBackend(ws *websocket.Conn, stream grpc.ClientStream, cancel context.CancelFunc, closed chan<- struct{}) {
+	defer close(closed)
+	ws.SetReadLimit(WSConfig.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(WSConfig.PongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(WSConfig.PongWait))
+	})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				stream.CloseSend()
+			} else {
+				cancel()
+			}
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(WSConfig.PongWait))
+		if err := stream.SendMsg(&frame{payload: data}); err != nil {
+			// 发送失败时真正的错误原因会由RecvMsg返回
+			return
+		}
+	}
+}
+
+// 从后端读取消息并写回给客户端，stream正常结束时返回nil
+func pumpBackendToClient(ws *websocket.Conn, stream grpc.ClientStream) error {
+	var f frame
+	for {
+		err := stream.RecvMsg(&f)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ws.SetWriteDeadline(time.Now().Add(WSConfig.WriteWait))
+		if err := ws.WriteMessage(websocket.BinaryMessage, f.payload); err != nil {
+			return err
+		}
+	}
+}
+
+// 向客户端发送关闭帧，close reason 的长度不能超过123个字节
+func writeClose(ws *websocket.Conn, code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	deadline := time.Now().Add(WSConfig.WriteWait)
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
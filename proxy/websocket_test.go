@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"Gateway/concurrency"
+	"Gateway/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	old := GWConfig
+	defer func() { GWConfig = old }()
+	cases := []struct {
+		name    string
+		origins []string
+		host    string
+		origin  string
+		want    bool
+	}{
+		{"non browser", []string{"*"}, "gw.example.com", "", true},
+		{"same origin", nil, "gw.example.com", "https://gw.example.com", true},
+		{"same origin with port", nil, "gw.example.com:8080", "http://gw.example.com:8080", true},
+		{"listed", []string{"https://app.example.com"}, "gw.example.com", "https://app.example.com", true},
+		{"wildcard is ignored", []string{"*"}, "gw.example.com", "https://evil.example.com", false},
+		{"unlisted", []string{"https://app.example.com"}, "gw.example.com", "https://evil.example.com", false},
+		{"port mismatch", nil, "gw.example.com", "https://gw.example.com:8443", false},
+		{"malformed", nil, "gw.example.com", "://", false},
+	}
+	for _, c := range cases {
+		GWConfig.AllowedOrigins = c.origins
+		req := httptest.NewRequest("GET", "/ws", nil)
+		req.Host = c.host
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if got := checkWebSocketOrigin(req); got != c.want {
+			t.Errorf("%s: allowed = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWebSocketAdmission(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ratelimit.SetServiceRule("WsLimitedSvc", &ratelimit.Rule{Algorithm: ratelimit.TokenBucket, Rate: 1, Period: time.Hour, KeyFunc: ratelimit.AllClients})
+	defer ratelimit.RemoveServiceRule("WsLimitedSvc")
+	limiter := concurrency.NewAIMDLimiter(1, 1, 1, 0.5, time.Second)
+	concurrency.SetLimiter("WsBusySvc", limiter)
+	defer concurrency.RemoveLimiter("WsBusySvc")
+	// 占满WsBusySvc唯一的名额
+	limiter.Acquire()
+	defer limiter.Release(0, false)
+	router := gin.New()
+	router.Use(ratelimit.Middleware())
+	router.GET("/ws", WebSocket)
+
+	cases := []struct {
+		name    string
+		service string
+		want    int
+	}{
+		// 通过了限流和准入，但是服务没有可用的实例，Middleware和WebSocket对同一个请求只计数一次
+		{"first call", "WsLimitedSvc", http.StatusBadRequest},
+		{"rate limited", "WsLimitedSvc", http.StatusTooManyRequests},
+		{"concurrency exhausted", "WsBusySvc", http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ws?service="+c.service+"&method=/pkg.Svc/Call", nil))
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+	if limiter.Inflight() != 1 || atomic.LoadInt64(&wsConnCount) != 0 {
+		t.Errorf("inflight = %d, connections = %d, slots are leaked", limiter.Inflight(), wsConnCount)
+	}
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	TokenBucket   = 1 // 令牌桶算法，允许一定程度的突发流量
+	SlidingWindow = 2 // 滑动窗口算法，用上一个窗口的请求数按时间比例估算滑动窗口内的请求数
+)
+
+// 一条限流规则
+// Algorithm 表示使用的限流算法
+// Rate 和 Period 表示每个Period内最多允许Rate个请求
+// Burst 表示令牌桶的容量，只对令牌桶算法有效，为0时等于Rate
+// KeyFunc 决定了根据什么来区分客户端，例如客户端IP，API key或者某个请求头
+// StreamKeyFunc 是KeyFunc对应的原生grpc版本，为nil时该规则对原生grpc请求不生效
+type Rule struct {
+	Algorithm     int
+	Rate          int64
+	Period        time.Duration
+	Burst         int64
+	KeyFunc       KeyFunc
+	StreamKeyFunc StreamKeyFunc
+}
+
+var ErrInvalidRule = errors.New("rate and period of rate limit rule should be positive")
+
+// 检查规则是否合法，Rate 或者 Period 不大于0时无法计算补充令牌的时间
+func (rule *Rule) Validate() error {
+	if rule.Rate <= 0 || rule.Period <= 0 {
+		return ErrInvalidRule
+	}
+	return nil
+}
+
+// 根据规则判断key对应的客户端这一次请求是否被允许，不被允许时同时返回客户端需要等待的时间
+func Allow(store Store, key string, rule *Rule) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+	now := time.Now()
+	err := store.Update(key, rule.ttl(), func(state *State) {
+		if rule.Algorithm == SlidingWindow {
+			allowed, retryAfter = rule.takeSlidingWindow(state, now)
+		} else {
+			allowed, retryAfter = rule.takeTokenBucket(state, now)
+		}
+	})
+	return allowed, retryAfter, err
+}
+
+// 状态在存储中保留的时间，超过该时间之后状态等价于初始状态，所以可以直接清除
+func (rule *Rule) ttl() time.Duration {
+	if rule.Algorithm == SlidingWindow {
+		return 2 * rule.Period
+	}
+	return time.Duration(float64(rule.burst()) / float64(rule.Rate) * float64(rule.Period))
+}
+
+func (rule *Rule) burst() int64 {
+	if rule.Burst > 0 {
+		return rule.Burst
+	}
+	return rule.Rate
+}
+
+func (rule *Rule) takeTokenBucket(state *State, now time.Time) (bool, time.Duration) {
+	burst := float64(rule.burst())
+	perToken := float64(rule.Period) / float64(rule.Rate) // 补充一个令牌需要的时间
+	if state.Last.IsZero() {
+		state.Tokens = burst
+	} else {
+		state.Tokens = math.Min(burst, state.Tokens+float64(now.Sub(state.Last))/perToken)
+	}
+	state.Last = now
+	if state.Tokens >= 1 {
+		state.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - state.Tokens) * perToken)
+}
+
+func (rule *Rule) takeSlidingWindow(state *State, now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(state.WindowStart)
+	if elapsed >= 2*rule.Period {
+		state.WindowStart = now.Truncate(rule.Period)
+		state.PrevCount, state.CurrCount = 0, 0
+	} else if elapsed >= rule.Period {
+		state.WindowStart = state.WindowStart.Add(rule.Period)
+		state.PrevCount, state.CurrCount = state.CurrCount, 0
+	}
+	// 上一个窗口中仍然落在滑动窗口内的部分按照时间比例计算
+	weight := 1 - float64(now.Sub(state.WindowStart))/float64(rule.Period)
+	estimated := float64(state.PrevCount)*weight + float64(state.CurrCount)
+	if estimated < float64(rule.Rate) {
+		state.CurrCount++
+		return true, 0
+	}
+	if state.PrevCount == 0 {
+		return false, state.WindowStart.Add(rule.Period).Sub(now)
+	}
+	// 等到上一个窗口的请求按比例滑出足够多时才能再次放行
+	need := (estimated - float64(rule.Rate) + 1) / float64(state.PrevCount)
+	return false, time.Duration(need * float64(rule.Period))
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+func TestTokenBucket(t *testing.T) {
+	rule := &Rule{Algorithm: TokenBucket, Rate: 10, Period: time.Second, Burst: 3}
+	start := time.Unix(1000, 0)
+	cases := []struct {
+		name       string
+		offset     time.Duration // 相对于第一次请求的时间
+		want       bool
+		retryAfter time.Duration
+	}{
+		{"full bucket", 0, true, 0},
+		{"burst 2", 0, true, 0},
+		{"burst 3", 0, true, 0},
+		{"empty bucket", 0, false, 100 * time.Millisecond},
+		{"half token", 50 * time.Millisecond, false, 50 * time.Millisecond},
+		{"one token refilled", 100 * time.Millisecond, true, 0},
+		{"refill is capped by burst", 10 * time.Second, true, 0},
+		{"burst 2 after refill", 10 * time.Second, true, 0},
+		{"burst 3 after refill", 10 * time.Second, true, 0},
+		{"empty again", 10 * time.Second, false, 100 * time.Millisecond},
+	}
+	state := &State{}
+	for _, c := range cases {
+		allowed, retryAfter := rule.takeTokenBucket(state, start.Add(c.offset))
+		if allowed != c.want || retryAfter != c.retryAfter {
+			t.Errorf("%s: allowed = %v, retryAfter = %v, want %v, %v", c.name, allowed, retryAfter, c.want, c.retryAfter)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	rule := &Rule{Algorithm: SlidingWindow, Rate: 2, Period: time.Second}
+	start := time.Unix(1000, 0)
+	cases := []struct {
+		name       string
+		offset     time.Duration
+		want       bool
+		retryAfter time.Duration
+	}{
+		{"first", 0, true, 0},
+		{"second", 100 * time.Millisecond, true, 0},
+		{"window is full", 200 * time.Millisecond, false, 800 * time.Millisecond},
+		// 上一个窗口的2个请求还有75%落在滑动窗口内，估算为1.5个
+		{"previous window weighted", 1250 * time.Millisecond, true, 0},
+		{"previous window still counts", 1300 * time.Millisecond, false, 700 * time.Millisecond},
+		{"previous window slid out", 2000 * time.Millisecond, true, 0},
+		{"two windows later", 10 * time.Second, true, 0},
+	}
+	state := &State{}
+	for _, c := range cases {
+		allowed, retryAfter := rule.takeSlidingWindow(state, start.Add(c.offset))
+		if allowed != c.want || retryAfter != c.retryAfter {
+			t.Errorf("%s: allowed = %v, retryAfter = %v, want %v, %v", c.name, allowed, retryAfter, c.want, c.retryAfter)
+		}
+	}
+}
+
+func TestCheckStream(t *testing.T) {
+	SetServiceRule("stream-test/Svc", &Rule{Algorithm: TokenBucket, Rate: 1, Period: time.Hour, StreamKeyFunc: StreamByClientIP})
+	defer RemoveServiceRule("stream-test/Svc")
+	// 没有StreamKeyFunc的规则对原生grpc请求不生效
+	SetRouteRule("/pkg.Http/Call", &Rule{Algorithm: TokenBucket, Rate: 1, Period: time.Hour, KeyFunc: AllClients})
+	defer RemoveRouteRule("/pkg.Http/Call")
+
+	client := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+	}
+	cases := []struct {
+		name        string
+		ctx         context.Context
+		fullMethod  string
+		serviceName string
+		want        bool
+	}{
+		{"first call", client("10.0.0.1"), "/pkg.Svc/Call", "stream-test/Svc", true},
+		{"same client", client("10.0.0.1"), "/pkg.Svc/Call", "stream-test/Svc", false},
+		{"other client", client("10.0.0.2"), "/pkg.Svc/Call", "stream-test/Svc", true},
+		{"no rule", client("10.0.0.1"), "/pkg.Other/Call", "stream-test/Other", true},
+		{"http only rule", client("10.0.0.1"), "/pkg.Http/Call", "stream-test/Http", true},
+		{"http only rule again", client("10.0.0.1"), "/pkg.Http/Call", "stream-test/Http", true},
+	}
+	for _, c := range cases {
+		if allowed, _ := CheckStream(c.ctx, c.fullMethod, c.serviceName); allowed != c.want {
+			t.Errorf("%s: allowed = %v, want %v", c.name, allowed, c.want)
+		}
+	}
+}
+
+func TestSetRuleRejectsInvalidRule(t *testing.T) {
+	cases := []struct {
+		name    string
+		rule    *Rule
+		wantErr bool
+	}{
+		{"valid", &Rule{Rate: 1, Period: time.Second}, false},
+		{"zero rate", &Rule{Rate: 0, Period: time.Second}, true},
+		{"negative rate", &Rule{Rate: -1, Period: time.Second}, true},
+		{"zero period", &Rule{Rate: 1}, true},
+		{"negative period", &Rule{Rate: 1, Period: -time.Second}, true},
+	}
+	for _, c := range cases {
+		err := SetServiceRule("invalid-test/Svc", c.rule)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+		}
+		_, stored := serviceRules.Load("invalid-test/Svc")
+		if stored == c.wantErr {
+			t.Errorf("%s: stored = %v, want %v", c.name, stored, !c.wantErr)
+		}
+		RemoveServiceRule("invalid-test/Svc")
+	}
+}
@@ -0,0 +1,229 @@
+package ratelimit
+
+import (
+	"Gateway/tenant"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 从请求中提取用于区分客户端的key，返回空字符串时该请求不受对应规则的限制
+type KeyFunc func(c *gin.Context) string
+
+// 按照客户端IP限流，客户端IP的确定方式见ClientIP
+func ByClientIP(c *gin.Context) string {
+	return ClientIP(c.Request)
+}
+
+var trustedProxies = &atomic.Value{} // []*net.IPNet
+
+// gin.Context中保存已经由Middleware执行过服务限流规则的服务名，AllowService不会对同一个请求重复计数
+const checkedServiceKey = "ratelimit.checkedService"
+
+// 设置可信的反向代理的网段，例如 10.0.0.0/8，也可以是单个IP，会覆盖之前的设置
+func SetTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return errors.New("invalid trusted proxy " + cidr)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	trustedProxies.Store(nets)
+	return nil
+}
+
+func trusted(ip net.IP) bool {
+	nets, _ := trustedProxies.Load().([]*net.IPNet)
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 返回请求的客户端IP，默认使用TCP连接的对端地址
+// X-Forwarded-For 可以被客户端随意伪造，所以只有对端是可信的代理时才使用，从右往左跳过可信的代理，取第一个不可信的地址
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// 按照API key限流，API key 放在请求头 X-Api-Key 中
+func ByAPIKey(c *gin.Context) string {
+	return c.GetHeader("X-Api-Key")
+}
+
+// 所有客户端共享同一个限额，例如整个租户的限额
+func AllClients(c *gin.Context) string {
+	return "*"
+}
+
+// 按照指定的请求头限流
+func ByHeader(name string) KeyFunc {
+	return func(c *gin.Context) string {
+		return c.GetHeader(name)
+	}
+}
+
+var (
+	DefaultStore Store = NewMemoryStore(time.Minute)
+	routeRules         = &sync.Map{} // route -> *Rule，route 为tenant.Route返回的路由，例如 /sortService，teamA/sortService
+	serviceRules       = &sync.Map{} // serviceName -> *Rule，serviceName 为svrpool中的服务名，例如 SortService，teamA/SortService
+	tenantRules        = &sync.Map{} // tenant -> *Rule，对租户的所有请求生效
+)
+
+// 为路由设置限流规则，会覆盖之前的规则，规则不合法时返回ErrInvalidRule
+func SetRouteRule(route string, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	routeRules.Store(route, rule)
+	return nil
+}
+
+func RemoveRouteRule(route string) {
+	routeRules.Delete(route)
+}
+
+// 为服务设置限流规则，会覆盖之前的规则，规则不合法时返回ErrInvalidRule
+func SetServiceRule(serviceName string, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	serviceRules.Store(serviceName, rule)
+	return nil
+}
+
+func RemoveServiceRule(serviceName string) {
+	serviceRules.Delete(serviceName)
+}
+
+// 为租户设置限流规则，会覆盖之前的规则，默认租户的名字为空字符串，规则不合法时返回ErrInvalidRule
+func SetTenantRule(name string, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	tenantRules.Store(name, rule)
+	return nil
+}
+
+func RemoveTenantRule(name string) {
+	tenantRules.Delete(name)
+}
+
+// Middleware 返回执行限流的中间件，租户，路由和服务的规则都会生效，任意一个规则不通过都会返回429
+// 路由和服务都按照租户区分，不同租户的计数是相互独立的
+// 存储出错时为了不影响正常的请求，会放行该请求
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := tenant.Get(c)
+		if rule, ok := tenantRules.Load(name); ok {
+			if !check(c, "tenant|"+name, rule.(*Rule)) {
+				return
+			}
+		}
+		route := tenant.Route(c)
+		if rule, ok := routeRules.Load(route); ok {
+			if !check(c, "route|"+route, rule.(*Rule)) {
+				return
+			}
+		}
+		if serviceName := c.Query("service"); serviceName != "" {
+			// 服务名不合法时由后面的handler返回错误
+			if qualified, err := tenant.Service(c, serviceName); err == nil {
+				if rule, ok := serviceRules.Load(qualified); ok {
+					if !check(c, "service|"+qualified, rule.(*Rule)) {
+						return
+					}
+				}
+				c.Set(checkedServiceKey, qualified)
+			}
+		}
+		c.Next()
+	}
+}
+
+// 检查请求是否满足规则，不满足时直接返回429并中止请求
+func check(c *gin.Context, prefix string, rule *Rule) bool {
+	clientKey := ""
+	if rule.KeyFunc != nil {
+		clientKey = rule.KeyFunc(c)
+	}
+	allowed, retryAfter := take(prefix, clientKey, rule)
+	if !allowed {
+		Reject(c, retryAfter)
+	}
+	return allowed
+}
+
+// 为key对应的客户端消耗一次限额，clientKey 为空时不受限制
+// 存储出错时为了不影响正常的请求，会放行该请求
+func take(prefix, clientKey string, rule *Rule) (bool, time.Duration) {
+	if clientKey == "" {
+		return true, 0
+	}
+	allowed, retryAfter, err := Allow(DefaultStore, prefix+"|"+clientKey, rule)
+	if err != nil {
+		log.Println("rate limit store failed, the err is", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// AllowService 对请求执行服务的限流规则，serviceName 为带有租户前缀的服务名
+// 用于服务名不在Query参数中的请求，例如gRPC-Web请求的服务名由方法名决定，不被允许时同时返回客户端需要等待的时间
+// 服务名同时在Query参数中时Middleware已经执行过该规则，不会再次计数
+func AllowService(c *gin.Context, serviceName string) (bool, time.Duration) {
+	if c.GetString(checkedServiceKey) == serviceName {
+		return true, 0
+	}
+	rule, ok := serviceRules.Load(serviceName)
+	if !ok || rule.(*Rule).KeyFunc == nil {
+		return true, 0
+	}
+	return take("service|"+serviceName, rule.(*Rule).KeyFunc(c), rule.(*Rule))
+}
+
+// 返回429，并通过Retry-After告诉客户端需要等待的秒数
+func Reject(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"code": -1, "msg": "too many requests", "rsp": nil})
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"no proxy", "1.2.3.4:5678", nil, "1.2.3.4"},
+		{"spoofed by client", "1.2.3.4:5678", []string{"9.9.9.9"}, "1.2.3.4"},
+		{"trusted proxy", "10.0.0.1:80", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"single trusted ip", "192.168.1.1:80", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"untrusted ip next to trusted one", "192.168.1.2:80", []string{"1.2.3.4"}, "192.168.1.2"},
+		// 客户端自己发送的X-Forwarded-For在最左边，只取最右边的不可信地址
+		{"spoofed behind proxy", "10.0.0.1:80", []string{"9.9.9.9, 1.2.3.4"}, "1.2.3.4"},
+		{"chain of proxies", "10.0.0.1:80", []string{"1.2.3.4", "10.0.0.2"}, "1.2.3.4"},
+		{"garbage", "10.0.0.1:80", []string{"9.9.9.9, unknown"}, "10.0.0.1"},
+		{"no port", "1.2.3.4", nil, "1.2.3.4"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		for _, v := range c.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := ClientIP(r); got != c.want {
+			t.Errorf("%s: ClientIP = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSpoofedForwardedForSharesBucket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/limited", func(c *gin.Context) { c.Status(http.StatusOK) })
+	SetRouteRule("/limited", &Rule{Algorithm: TokenBucket, Rate: 1, Period: time.Hour, KeyFunc: ByClientIP})
+	defer RemoveRouteRule("/limited")
+
+	for i, xff := range []string{"", "9.9.9.1", "9.9.9.2"} {
+		r := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		r.RemoteAddr = "1.2.3.4:5678"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+			r.Header.Set("X-Real-Ip", xff)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("request %d with X-Forwarded-For %q: status = %d, want %d", i, xff, w.Code, want)
+		}
+	}
+}
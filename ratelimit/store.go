@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// 限流算法在存储中保存的状态
+// Tokens 和 Last 由令牌桶算法使用，分别表示桶中剩余的令牌数和上一次补充令牌的时间
+// WindowStart，PrevCount 和 CurrCount 由滑动窗口算法使用，分别表示当前窗口的开始时间，上一个窗口和当前窗口的请求数
+type State struct {
+	Tokens      float64   `json:"tokens"`
+	Last        time.Time `json:"last"`
+	WindowStart time.Time `json:"windowStart"`
+	PrevCount   int64     `json:"prevCount"`
+	CurrCount   int64     `json:"currCount"`
+}
+
+// 保存限流状态的存储
+// 默认使用进程内的MemoryStore，多个网关实例需要共享限流状态时，可以基于Redis等实现该接口
+// Update 需要保证对同一个key的读-改-写是原子的，fn 中修改后的状态会被写回存储，超过ttl没有被访问的状态可以被清除
+type Store interface {
+	Update(key string, ttl time.Duration, fn func(state *State)) error
+}
+
+const shardCount = 32 // 分片的数量，用于降低锁竞争
+
+type memoryEntry struct {
+	state  State
+	expire time.Time
+}
+
+type memoryShard struct {
+	lock    *sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// 进程内的限流状态存储，按照key的哈希值分片加锁，后台会定期清除过期的状态
+type MemoryStore struct {
+	shards [shardCount]memoryShard
+}
+
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	store := &MemoryStore{}
+	for i := range store.shards {
+		store.shards[i] = memoryShard{lock: &sync.Mutex{}, entries: map[string]*memoryEntry{}}
+	}
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			store.cleanup(now)
+		}
+	}()
+	return store
+}
+
+func (store *MemoryStore) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &store.shards[h.Sum32()%shardCount]
+}
+
+func (store *MemoryStore) Update(key string, ttl time.Duration, fn func(state *State)) error {
+	shard := store.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, ok := shard.entries[key]
+	if !ok {
+		entry = &memoryEntry{}
+		shard.entries[key] = entry
+	}
+	fn(&entry.state)
+	entry.expire = time.Now().Add(ttl)
+	return nil
+}
+
+func (store *MemoryStore) cleanup(now time.Time) {
+	for i := range store.shards {
+		shard := &store.shards[i]
+		shard.lock.Lock()
+		for key, entry := range shard.entries {
+			if now.After(entry.expire) {
+				delete(shard.entries, key)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
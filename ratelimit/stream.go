@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"Gateway/tenant"
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// 从原生grpc请求中提取用于区分客户端的key，返回空字符串时该请求不受对应规则的限制
+type StreamKeyFunc func(ctx context.Context) string
+
+// 按照客户端IP限流，和ByClientIP共享同一个客户端的计数，原生grpc请求总是使用连接的对端地址
+func StreamByClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// 按照API key限流，API key 放在metadata x-api-key 中
+func StreamByAPIKey(ctx context.Context) string {
+	return StreamByHeader("X-Api-Key")(ctx)
+}
+
+// 所有客户端共享同一个限额，例如整个租户的限额
+func StreamAllClients(ctx context.Context) string {
+	return "*"
+}
+
+// 按照指定的metadata限流
+func StreamByHeader(name string) StreamKeyFunc {
+	name = strings.ToLower(name)
+	return func(ctx context.Context) string {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
+
+// CheckStream 对原生grpc请求执行租户，路由和服务的限流规则，和HTTP请求共享计数
+// serviceName 为带有租户前缀的服务名，不被允许时同时返回客户端需要等待的时间
+func CheckStream(ctx context.Context, fullMethod, serviceName string) (bool, time.Duration) {
+	name := tenant.FromContext(ctx)
+	if rule, ok := tenantRules.Load(name); ok {
+		if allowed, retryAfter := takeStream(ctx, "tenant|"+name, rule.(*Rule)); !allowed {
+			return false, retryAfter
+		}
+	}
+	route := tenant.GrpcRoute(ctx, fullMethod)
+	if rule, ok := routeRules.Load(route); ok {
+		if allowed, retryAfter := takeStream(ctx, "route|"+route, rule.(*Rule)); !allowed {
+			return false, retryAfter
+		}
+	}
+	if rule, ok := serviceRules.Load(serviceName); ok {
+		if allowed, retryAfter := takeStream(ctx, "service|"+serviceName, rule.(*Rule)); !allowed {
+			return false, retryAfter
+		}
+	}
+	return true, 0
+}
+
+func takeStream(ctx context.Context, prefix string, rule *Rule) (bool, time.Duration) {
+	if rule.StreamKeyFunc == nil {
+		return true, 0
+	}
+	return take(prefix, rule.StreamKeyFunc(ctx), rule)
+}
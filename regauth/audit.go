@@ -0,0 +1,76 @@
+package regauth
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 一条审计日志
+// RemoteAddr 是TCP连接的对端地址，UntrustedForwardedFor 是请求携带的X-Forwarded-For，可以被客户端随意伪造，只作为参考
+type auditRecord struct {
+	Time                  time.Time `json:"time"`
+	Action                string    `json:"action"`
+	Service               string    `json:"service"`
+	ServerID              string    `json:"serverID,omitempty"`
+	Identity              string    `json:"identity,omitempty"`
+	RemoteAddr            string    `json:"remoteAddr"`
+	UntrustedForwardedFor string    `json:"untrustedForwardedFor,omitempty"`
+	Success               bool      `json:"success"`
+	Error                 string    `json:"error,omitempty"`
+}
+
+var (
+	auditLogger = log.New(os.Stderr, "[audit] ", 0) // 默认输出到标准错误，可以通过SetAuditFile输出到文件
+	owners      = &sync.Map{}                       // serviceName|serverID -> 注册该server的身份
+)
+
+// 将审计日志追加写入到文件中，每一行是一条JSON格式的记录
+func SetAuditFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLogger = log.New(file, "", 0)
+	return nil
+}
+
+// Audit 记录一次注册，更新或者注销操作，以及认证和鉴权失败的请求
+func Audit(c *gin.Context, action, serviceName, serverID string, err error) {
+	record := auditRecord{Time: time.Now(), Action: action, Service: serviceName, ServerID: serverID,
+		Identity: GetIdentity(c), RemoteAddr: c.Request.RemoteAddr, UntrustedForwardedFor: c.GetHeader("X-Forwarded-For"), Success: err == nil}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	content, _ := json.Marshal(&record)
+	auditLogger.Println(string(content))
+}
+
+// CheckOwner 检查身份是否可以操作某个server，server只能由注册它的身份更新或者注销
+// 没有启用认证（identity为空）或者server还没有被注册时总是允许
+func CheckOwner(serviceName, serverID, identity string) error {
+	if identity == "" {
+		return nil
+	}
+	owner, ok := owners.Load(serviceName + "|" + serverID)
+	if !ok || owner.(string) == identity {
+		return nil
+	}
+	return ErrNotOwner
+}
+
+// 记录server的注册方
+func SetOwner(serviceName, serverID, identity string) {
+	if identity == "" {
+		return
+	}
+	owners.Store(serviceName+"|"+serverID, identity)
+}
+
+func RemoveOwner(serviceName, serverID string) {
+	owners.Delete(serviceName + "|" + serverID)
+}
@@ -0,0 +1,225 @@
+package regauth
+
+import (
+	"Gateway/tenant"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IDHeader        = "X-Register-Id"        // 注册方的身份
+	TimestampHeader = "X-Register-Timestamp" // 签名时的unix时间戳，单位为秒
+	SignatureHeader = "X-Register-Signature" // 签名，HMAC-SHA256(secret, timestamp + "\n" + method + "\n" + host + "\n" + path?query + "\n" + body) 的十六进制
+
+	contextKey = "regauth.identity"
+)
+
+var (
+	ErrUnauthenticated = errors.New("registration request is not authenticated")
+	ErrForbidden       = errors.New("identity is not allowed to register this service")
+	ErrReplayed        = errors.New("registration request is replayed")
+	ErrNotOwner        = errors.New("server is registered by another identity")
+	ErrNotAdmin        = errors.New("identity is not allowed to administrate this tenant")
+)
+
+// 一个可以注册后端的身份
+// ID 对于HMAC签名是请求头 X-Register-Id 的值，对于mTLS是客户端证书的CommonName
+// Secret 是HMAC签名使用的共享密钥，只使用mTLS的身份可以为空
+// Services 表示该身份可以注册的服务
+// Admin 表示该身份可以执行调整流量拆分权重等管理操作，只能管理 Tenant 租户，Tenant 为空表示默认租户
+type Identity struct {
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret,omitempty"`
+	Services []string `json:"services"`
+	Admin    bool     `json:"admin,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+}
+
+type identityFile struct {
+	Identities []*Identity `json:"identities"`
+}
+
+// 对注册请求进行认证和鉴权
+// MaxSkew 表示签名中的时间戳与网关时间允许的最大误差，在该时间窗口内同一个签名只能使用一次
+type Authenticator struct {
+	MaxSkew    time.Duration
+	identities map[string]*Identity
+	lock       *sync.Mutex
+	seen       map[string]bool // 时间窗口内使用过的签名，用于防止重放
+	expiries   []seenSignature // 按照过期时间排序的签名
+}
+
+type seenSignature struct {
+	signature string
+	expire    time.Time
+}
+
+func NewAuthenticator(path string, maxSkew time.Duration) (*Authenticator, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file identityFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	auth := &Authenticator{MaxSkew: maxSkew, identities: map[string]*Identity{},
+		lock: &sync.Mutex{}, seen: map[string]bool{}}
+	for _, identity := range file.Identities {
+		auth.identities[identity.ID] = identity
+	}
+	return auth, nil
+}
+
+// 认证请求，优先使用mTLS的客户端证书，没有证书时校验HMAC签名，返回请求方的身份
+func (auth *Authenticator) authenticate(c *gin.Context, body []byte) (*Identity, error) {
+	if tlsState := c.Request.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+		identity, ok := auth.identities[tlsState.VerifiedChains[0][0].Subject.CommonName]
+		if !ok {
+			return nil, ErrUnauthenticated
+		}
+		return identity, nil
+	}
+	identity, ok := auth.identities[c.GetHeader(IDHeader)]
+	if !ok || identity.Secret == "" {
+		return nil, ErrUnauthenticated
+	}
+	timestamp := c.GetHeader(TimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(sec, 0)); skew > auth.MaxSkew || skew < -auth.MaxSkew {
+		return nil, ErrUnauthenticated
+	}
+	signature, err := hex.DecodeString(c.GetHeader(SignatureHeader))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	// Host决定了请求所属的租户，所以也需要被签名
+	if !hmac.Equal(signature, Sign(identity.Secret, timestamp, c.Request.Method, c.Request.Host, requestTarget(c.Request), body)) {
+		return nil, ErrUnauthenticated
+	}
+	if !auth.markSeen(string(signature), now) {
+		return nil, ErrReplayed
+	}
+	return identity, nil
+}
+
+// 返回客户端请求的原始路径和Query参数，通过路径前缀确定租户时URL.Path中的前缀已经被去掉了，但客户端签名的是带有前缀的路径
+func requestTarget(r *http.Request) string {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		u = r.URL
+	}
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// 记录使用过的签名，签名已经使用过时返回false
+// 签名的过期时间随着now递增，所以只需要从队列的头部清理过期的签名
+func (auth *Authenticator) markSeen(signature string, now time.Time) bool {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+	for len(auth.expiries) > 0 && now.After(auth.expiries[0].expire) {
+		delete(auth.seen, auth.expiries[0].signature)
+		auth.expiries = auth.expiries[1:]
+	}
+	if auth.seen[signature] {
+		return false
+	}
+	auth.seen[signature] = true
+	auth.expiries = append(auth.expiries, seenSignature{signature: signature, expire: now.Add(2 * auth.MaxSkew)})
+	return true
+}
+
+// Sign 计算注册请求的签名，后端注册时可以使用该函数生成 X-Register-Signature
+// host 是请求的Host，target 是请求的路径，有Query参数时带上 ?query
+func Sign(secret, timestamp, method, host, target string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + host + "\n" + target + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// 读取请求体并认证请求，失败时已经返回了错误信息
+func (auth *Authenticator) identify(c *gin.Context, serviceName string) (*Identity, bool) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "can not read request body"})
+		return nil, false
+	}
+	// 后面的handler还需要读取请求体
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	identity, err := auth.authenticate(c, body)
+	if err != nil {
+		Audit(c, "authenticate", serviceName, "", err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": -1, "msg": err.Error()})
+		return nil, false
+	}
+	c.Set(contextKey, identity.ID)
+	return identity, true
+}
+
+// Middleware 返回对注册serviceName的请求进行认证和鉴权的中间件，认证失败返回401，没有权限返回403
+// 注册到其他租户时，身份的 Services 中需要是带有租户前缀的服务名，例如 teamA/SortService
+func (auth *Authenticator) Middleware(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serviceName := tenant.Qualify(tenant.Get(c), name)
+		identity, ok := auth.identify(c, serviceName)
+		if !ok {
+			return
+		}
+		allowed := false
+		for _, name := range identity.Services {
+			if name == serviceName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			Audit(c, "authorize", serviceName, "", ErrForbidden)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": -1, "msg": ErrForbidden.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminMiddleware 返回对管理接口进行认证和鉴权的中间件，只有请求所属租户的Admin身份可以通过，认证失败返回401，没有权限返回403
+func (auth *Authenticator) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 管理操作的审计记录中service为管理接口的路由
+		identity, ok := auth.identify(c, c.FullPath())
+		if !ok {
+			return
+		}
+		if !identity.Admin || identity.Tenant != tenant.Get(c) {
+			Audit(c, "admin", c.FullPath(), "", ErrNotAdmin)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code": -1, "msg": ErrNotAdmin.Error()})
+			return
+		}
+		Audit(c, "admin", c.FullPath(), "", nil)
+		c.Next()
+	}
+}
+
+// 返回中间件认证得到的身份，没有启用认证时返回空字符串
+func GetIdentity(c *gin.Context) string {
+	return c.GetString(contextKey)
+}
@@ -0,0 +1,149 @@
+package regauth
+
+import (
+	"Gateway/tenant"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	SetAuditFile(os.DevNull)
+	dir, err := ioutil.TempDir("", "regauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identities.json")
+	content := `{"identities": [
+		{"id": "ops", "secret": "s1", "admin": true},
+		{"id": "ops-a", "secret": "s2", "admin": true, "tenant": "teamA"},
+		{"id": "node", "secret": "s3", "services": ["SortService"]}]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuthenticator(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", PathPrefix: "/teamA"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	router := gin.New()
+	router.POST("/admin/split/weights", auth.AdminMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	handler := tenant.Handler(router)
+
+	secrets := map[string]string{"ops": "s1", "ops-a": "s2", "node": "s3"}
+	cases := []struct {
+		name       string
+		path       string
+		id         string
+		secret     string // 为空时使用身份的密钥
+		host       string // 请求发送到的Host，为空时和签名中的相同
+		signedPath string // 签名中的路径，为空时和请求的相同
+		want       int
+	}{
+		{"default admin", "/admin/split/weights", "ops", "", "", "", http.StatusOK},
+		{"tenant admin", "/teamA/admin/split/weights", "ops-a", "", "", "", http.StatusOK},
+		{"default admin on tenant", "/teamA/admin/split/weights", "ops", "", "", "", http.StatusForbidden},
+		{"tenant admin on default", "/admin/split/weights", "ops-a", "", "", "", http.StatusForbidden},
+		{"not admin", "/admin/split/weights", "node", "", "", "", http.StatusForbidden},
+		{"wrong secret", "/admin/split/weights", "ops", "bad", "", "", http.StatusUnauthorized},
+		{"unknown identity", "/admin/split/weights", "nobody", "x", "", "", http.StatusUnauthorized},
+		{"signed query", "/admin/split/weights?dry=1", "ops", "", "", "", http.StatusOK},
+		// Host和Query参数都在签名的范围内，不能被替换
+		{"other host", "/admin/split/weights", "ops", "", "other.example.com", "", http.StatusUnauthorized},
+		{"query added", "/admin/split/weights?dry=1", "ops", "", "", "/admin/split/weights", http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		body := `{"route": "/sortService", "n": ` + strconv.Itoa(i) + `}`
+		secret := c.secret
+		if secret == "" {
+			secret = secrets[c.id]
+		}
+		signedPath := c.signedPath
+		if signedPath == "" {
+			signedPath = c.path
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(body))
+		if c.host != "" {
+			req.Host = c.host
+		}
+		req.Header.Set(IDHeader, c.id)
+		req.Header.Set(TimestampHeader, timestamp)
+		// 签名的是网关收到的原始路径
+		req.Header.Set(SignatureHeader, hex.EncodeToString(Sign(secret, timestamp, http.MethodPost, "example.com", signedPath, []byte(body))))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+func TestAuditRemoteAddr(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := auditLogger
+	defer func() { auditLogger = old }()
+	buf := &bytes.Buffer{}
+	auditLogger = log.New(buf, "", 0)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/sortServer", nil)
+	c.Request.RemoteAddr = "1.2.3.4:5678"
+	c.Request.Header.Set("X-Forwarded-For", "9.9.9.9")
+	c.Request.Header.Set("X-Real-Ip", "9.9.9.9")
+	Audit(c, "register", "SortService", "s1", nil)
+
+	var record auditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.RemoteAddr != "1.2.3.4:5678" || record.UntrustedForwardedFor != "9.9.9.9" {
+		t.Errorf("remoteAddr = %q, untrustedForwardedFor = %q, want %q, %q", record.RemoteAddr, record.UntrustedForwardedFor, "1.2.3.4:5678", "9.9.9.9")
+	}
+}
+
+func TestMarkSeen(t *testing.T) {
+	auth := &Authenticator{MaxSkew: time.Minute, lock: &sync.Mutex{}, seen: map[string]bool{}}
+	now := time.Now()
+	cases := []struct {
+		name      string
+		signature string
+		offset    time.Duration
+		want      bool
+		wantSeen  int // 调用之后记录的签名数
+	}{
+		{"first", "a", 0, true, 1},
+		{"replayed", "a", time.Minute, false, 1},
+		{"another", "b", time.Minute, true, 2},
+		{"replayed before expire", "a", 2 * time.Minute, false, 2},
+		// a已经过期，被清理之后可以重新记录
+		{"expired", "a", 2*time.Minute + time.Second, true, 2},
+		{"all others expired", "c", 5 * time.Minute, true, 1},
+	}
+	for _, c := range cases {
+		if got := auth.markSeen(c.signature, now.Add(c.offset)); got != c.want {
+			t.Errorf("%s: markSeen = %v, want %v", c.name, got, c.want)
+		}
+		if len(auth.seen) != c.wantSeen || len(auth.expiries) != c.wantSeen {
+			t.Errorf("%s: %d signatures, %d expiries, want %d", c.name, len(auth.seen), len(auth.expiries), c.wantSeen)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package sortsvr
+
+import (
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 根据资源进行调度的配置
+// SlotsPerCore 表示每个核心同时处理的请求数，Server的总容量为 CoreNum * SlotsPerCore
+// UtilTTL 表示Server在心跳中上报的利用率的有效期，过期之后认为利用率为0，只根据网关统计的ActivePC计算负载
+// MemoryFactor 表示处理一个字节的请求需要Server多少字节的内存，用于根据请求的大小选择内存足够的Server
+type CapacityConfig struct {
+	SlotsPerCore float64
+	UtilTTL      time.Duration
+	MemoryFactor float64
+}
+
+// 根据剩余容量进行调度的调度器，Service 是svrpool中的服务名，选中每个Server的概率与其剩余容量成正比
+// 剩余容量 = CoreNum * SlotsPerCore * (1 - CPU利用率) - ActivePC，再乘以慢启动的比例
+// 请求需要的内存超过Server的剩余内存（Memory * (1 - 内存利用率)，Memory的单位为MB）时不会选择该Server，所有的Server内存都不够时返回svrpool.ErrNoCapacity
+// 权重为0的Server已经被摘除流量，不会被选择
+type CapacityScheduler struct {
+	Service string
+	Config  CapacityConfig
+}
+
+// 一个Server的容量信息
+type Capacity struct {
+	Slots      float64 `json:"slots"`      // 总容量
+	Free       float64 `json:"free"`       // 剩余容量
+	FreeMemory float64 `json:"freeMemory"` // 剩余内存，单位为MB
+	CPUUtil    int32   `json:"cpuUtil"`    // 有效的CPU利用率（百分比）
+	MemUtil    int32   `json:"memUtil"`    // 有效的内存利用率（百分比）
+}
+
+func (scheduler *CapacityScheduler) Select() (svrpool.Invoker, error) {
+	return scheduler.SelectWithHint(svrpool.Hint{})
+}
+
+// 计算Server当前的容量
+func (scheduler *CapacityScheduler) capacity(svr *SortServer, now time.Time) Capacity {
+	info := Capacity{Slots: float64(atomic.LoadInt32(&svr.CoreNum)) * scheduler.Config.SlotsPerCore}
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&svr.UtilUpdate))) <= scheduler.Config.UtilTTL {
+		info.CPUUtil = atomic.LoadInt32(&svr.CPUUtil)
+		info.MemUtil = atomic.LoadInt32(&svr.MemUtil)
+	}
+	info.Free = info.Slots*(1-float64(info.CPUUtil)/100) - float64(atomic.LoadInt64(&svr.ActivePC))
+	if info.Free < 0 {
+		info.Free = 0
+	}
+	info.FreeMemory = float64(atomic.LoadInt32(&svr.Memory)) * (1 - float64(info.MemUtil)/100)
+	return info
+}
+
+// 在满足hint的可用Server中按照剩余容量随机选择，hint.RequestSize 用于估计请求需要的内存
+func (scheduler *CapacityScheduler) SelectWithHint(hint svrpool.Hint) (svrpool.Invoker, error) {
+	svrs, err := svrpool.GetSnapshot(scheduler.Service)
+	if err != nil {
+		return nil, err
+	}
+	candidates := svrs.Candidates(scheduler.Service, hint)
+	if len(candidates) == 0 {
+		return nil, errors.New("no available server")
+	}
+	now := time.Now()
+	needMemory := float64(hint.RequestSize) * scheduler.Config.MemoryFactor / (1 << 20)
+	weights := make([]float64, len(candidates))
+	var weightSum float64
+	var roomiest svrpool.Invoker // 内存足够的Server中剩余内存最多的
+	var maxFreeMemory float64
+	for i, invoker := range candidates {
+		svr, _ := invoker.(*SortServer)
+		weight := atomic.LoadInt32(&svr.Weight)
+		if weight <= 0 {
+			continue
+		}
+		info := scheduler.capacity(svr, now)
+		if info.FreeMemory < needMemory {
+			continue
+		}
+		if roomiest == nil || info.FreeMemory > maxFreeMemory {
+			roomiest, maxFreeMemory = invoker, info.FreeMemory
+		}
+		// 用慢启动的有效权重占配置权重的比例调整剩余容量
+		info.Free *= float64(svrpool.EffectiveWeight(scheduler.Service, invoker, weight)) / float64(weight)
+		weights[i] = info.Free
+		weightSum += info.Free
+	}
+	if roomiest == nil {
+		return nil, svrpool.ErrNoCapacity
+	}
+	if weightSum <= 0 {
+		// 内存足够的Server都已经满载，交给剩余内存最多的Server，由准入控制负责限制并发
+		return roomiest, nil
+	}
+	n := rand.Float64() * weightSum
+	for i, invoker := range candidates {
+		if weights[i] <= 0 {
+			continue
+		}
+		n -= weights[i]
+		if n < 0 {
+			return invoker, nil
+		}
+	}
+	return roomiest, nil
+}
+
+// StatsHandler 返回排序服务各个Server当前的容量，key为服务器的ID
+func (scheduler *CapacityScheduler) StatsHandler(c *gin.Context) {
+	result := map[string]Capacity{}
+	if svrs, err := svrpool.GetSnapshot(scheduler.Service); err == nil {
+		now := time.Now()
+		for serverID, invoker := range svrs.SvrMap {
+			result[serverID] = scheduler.capacity(invoker.(*SortServer), now)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": result})
+}
+
+// CapacityStatsHandler 返回请求所属租户的排序服务各个Server当前的容量，该租户的排序服务没有使用CapacityScheduler时返回404
+func CapacityStatsHandler(c *gin.Context) {
+	val, _ := svrpool.SchedulerPool.Load(tenant.Qualify(tenant.Get(c), ServiceName))
+	scheduler, ok := val.(*CapacityScheduler)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"code": -1, "msg": "sort service doesn't use capacity scheduler", "rsp": nil})
+		return
+	}
+	scheduler.StatsHandler(c)
+}
+
+// 设置排序服务使用的调度器，默认使用按照权重随机选择的SortServerScheduler
+// serviceName 是svrpool中的服务名，不同租户的排序服务可以使用不同的调度器
+func SetScheduler(serviceName string, scheduler svrpool.Scheduler) {
+	svrpool.SchedulerPool.Store(serviceName, scheduler)
+}
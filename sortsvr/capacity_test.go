@@ -0,0 +1,63 @@
+package sortsvr
+
+import (
+	"Gateway/svrpool"
+	"testing"
+)
+
+func TestCapacitySelect(t *testing.T) {
+	type server struct {
+		id       string
+		weight   int32
+		core     int32
+		memory   int32
+		activePC int64
+	}
+	cases := []struct {
+		name        string
+		servers     []server
+		requestSize int // 单位为MB
+		want        []string
+		wantErr     error
+	}{
+		{"free capacity", []server{{"a", 10, 4, 8, 0}, {"b", 10, 4, 8, 8}}, 0, []string{"a"}, nil},
+		{"drained server", []server{{"a", 0, 4, 8, 0}, {"b", 10, 4, 8, 4}}, 0, []string{"b"}, nil},
+		{"memory is short", []server{{"a", 10, 4, 2, 0}, {"b", 10, 4, 16, 4}}, 4, []string{"b"}, nil},
+		// 内存足够的Server都满载时交给剩余内存最多的，由准入控制限制并发
+		{"saturated", []server{{"a", 10, 1, 8, 2}, {"b", 10, 1, 16, 2}, {"c", 10, 8, 2, 0}}, 4, []string{"b"}, nil},
+		{"no server has enough memory", []server{{"a", 10, 4, 2, 0}, {"b", 10, 4, 3, 0}}, 4, nil, svrpool.ErrNoCapacity},
+		{"drained server has enough memory", []server{{"a", 0, 4, 16, 0}, {"b", 10, 4, 2, 0}}, 4, nil, svrpool.ErrNoCapacity},
+	}
+	for _, c := range cases {
+		serviceName := "TestCapacitySelect/" + c.name
+		for _, s := range c.servers {
+			svr := benchServer(s.weight)
+			svr.CoreNum, svr.Memory, svr.ActivePC = s.core, s.memory, s.activePC
+			if _, err := svrpool.AddServer(serviceName, s.id, svr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		scheduler := &CapacityScheduler{Service: serviceName, Config: CapacityConfig{SlotsPerCore: 2, MemoryFactor: 1}}
+		svrs, _ := svrpool.GetSnapshot(serviceName)
+		for i := 0; i < 20; i++ {
+			invoker, err := scheduler.SelectWithHint(svrpool.Hint{RequestSize: c.requestSize << 20})
+			if err != c.wantErr {
+				t.Errorf("%s: err = %v, want %v", c.name, err, c.wantErr)
+				break
+			}
+			if err != nil {
+				continue
+			}
+			got := svrs.ServerID(invoker)
+			allowed := false
+			for _, id := range c.want {
+				allowed = allowed || id == got
+			}
+			if !allowed {
+				t.Errorf("%s: selected %s, want one of %v", c.name, got, c.want)
+				break
+			}
+		}
+		svrpool.ServerPool.Delete(serviceName)
+	}
+}
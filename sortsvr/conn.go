@@ -0,0 +1,68 @@
+package sortsvr
+
+import (
+	"Gateway/regauth"
+	"Gateway/svrpool"
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	DialTimeout = 10 * time.Second // 注册之后连接在该时间内没有进入READY状态，Server会被移出Server pool
+)
+
+// 只有连接处于READY状态的Server才是可用的
+func (svr *SortServer) Available() bool {
+	return connectivity.State(atomic.LoadInt32(&svr.ConnState)) == connectivity.Ready
+}
+
+// 返回grpc连接最近一次进入READY状态的时间，慢启动从该时间开始计算
+func (svr *SortServer) StartTime() time.Time {
+	readyTime := atomic.LoadInt64(&svr.ReadyTime)
+	if readyTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, readyTime)
+}
+
+// 跟踪Server的grpc连接状态，直到连接被关闭
+// 连接在DialTimeout内没有建立成功时，认为Server不可达，将其移出Server pool并关闭连接，Server可以重新注册
+func trackConn(serviceName, serverID string, svr *SortServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	ready := false
+	for {
+		state := svr.Conn.GetState()
+		atomic.StoreInt32(&svr.ConnState, int32(state))
+		if state == connectivity.Shutdown {
+			return
+		}
+		if state == connectivity.Ready {
+			// 断线重连之后后端可能已经重启，缓存是冷的，重新开始慢启动
+			atomic.StoreInt64(&svr.ReadyTime, time.Now().UnixNano())
+		}
+		if state == connectivity.Ready && !ready {
+			ready = true
+			// 连接建立成功之后就不再有超时的限制
+			cancel()
+			ctx = context.Background()
+		}
+		if !svr.Conn.WaitForStateChange(ctx, state) {
+			log.Println("Dial server", serverID, "timeout, remove it from server pool")
+			// 同一个ID可能已经被注销之后重新注册了，只移除自己
+			if invoker, err := svrpool.GetInvoker(serviceName, serverID); err == nil && invoker == svrpool.Invoker(svr) {
+				svrpool.RemoveInvoker(serviceName, serverID)
+				// server已经不存在了，之后可以由其他身份重新注册
+				regauth.RemoveOwner(serviceName, serverID)
+			}
+			svr.Conn.Close()
+			atomic.StoreInt32(&svr.ConnState, int32(connectivity.Shutdown))
+			return
+		}
+		log.Printf("connection of server %s changes from %s to %s\n", serverID, state, svr.Conn.GetState())
+	}
+}
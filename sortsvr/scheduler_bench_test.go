@@ -0,0 +1,90 @@
+package sortsvr
+
+import (
+	"Gateway/svrpool"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// 连接已经READY的Server，调度时不会发起真正的调用
+func benchServer(weight int32) *SortServer {
+	return &SortServer{Weight: weight, ConnState: int32(connectivity.Ready)}
+}
+
+// 向Server pool中注册count个Server，返回清理函数
+func preparePool(b *testing.B, serviceName string, count int) func() {
+	for i := 0; i < count; i++ {
+		if _, err := svrpool.AddServer(serviceName, strconv.Itoa(i), benchServer(10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return func() {
+		svrpool.ServerPool.Delete(serviceName)
+	}
+}
+
+// 没有成员变化时的调度吞吐
+func BenchmarkSelect(b *testing.B) {
+	serviceName := "BenchmarkSelect"
+	defer preparePool(b, serviceName, 64)()
+	scheduler := &SortServerScheduler{Service: serviceName}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := scheduler.Select(); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// 一个goroutine不断地注册和注销Server时的调度吞吐
+func BenchmarkSelectUnderChurn(b *testing.B) {
+	serviceName := "BenchmarkSelectUnderChurn"
+	defer preparePool(b, serviceName, 64)()
+	scheduler := &SortServerScheduler{Service: serviceName}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var churns int64
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			serverID := "churn-" + strconv.Itoa(i%16)
+			svrpool.AddServer(serviceName, serverID, benchServer(10))
+			svrpool.RemoveInvoker(serviceName, serverID)
+			atomic.AddInt64(&churns, 1)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := scheduler.Select(); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+	b.ReportMetric(float64(atomic.LoadInt64(&churns))/float64(b.N), "churns/op")
+}
+
+// 注册和注销本身的开销
+func BenchmarkAddRemove(b *testing.B) {
+	serviceName := "BenchmarkAddRemove"
+	defer preparePool(b, serviceName, 64)()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serverID := "churn-" + strconv.Itoa(i%16)
+		svrpool.AddServer(serviceName, serverID, benchServer(10))
+		svrpool.RemoveInvoker(serviceName, serverID)
+	}
+}
@@ -1,8 +1,11 @@
 package sortsvr
 
 import (
+	"Gateway/regauth"
 	"Gateway/stub/sortService"
 	"Gateway/svrpool"
+	"Gateway/tenant"
+	"Gateway/tlsconf"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,7 +14,6 @@ import (
 	"math/rand"
 	"net/http"
 	"strconv"
-	"sync"
 	"sync/atomic"
 	"time"
 
@@ -32,18 +34,25 @@ const (
 // 其他的参数：ActivePC，AllPCCount，AvgProcessTime主要是Gateway进行统计的，可以通过这些参数计算权重，或者执行相应的负载均衡策略
 // Conn 表示GateWay到提供排序服务RPC server的连接，每次进行调用时都会使用该Conn创建出一个Client去执行调用
 type SortServer struct {
-	IP             string           `json:"ip"`
-	Port           uint16           `json:"port"`
-	Weight         int32            `json:"weight"`   // 用于调度的权重
-	CoreNum        int32            `json:"coreNum"`  // 核心数
-	Memory         int32            `json:"memory"`   // 内存容量
-	Shutdown       bool             `json:"shutdown"` // 是否停止提供服务
-	LastUpdate     time.Time        // 最后一次更新的时间
-	ActivePC       int64            // 活跃的调用数
-	AllPCCount     int64            // 总共做了多少次
-	AvgProcessTime int64            // 调用的平均时间，以微妙或者纳秒为单位
-	Fail           int64            // 调用的失败次数
-	Conn           *grpc.ClientConn // grpc连接，主要用于远程调用
+	IP               string           `json:"ip"`
+	Port             uint16           `json:"port"`
+	Weight           int32            `json:"weight"`   // 用于调度的权重
+	CoreNum          int32            `json:"coreNum"`  // 核心数
+	Memory           int32            `json:"memory"`   // 内存容量
+	Shutdown         bool             `json:"shutdown"` // 是否停止提供服务
+	LastUpdate       time.Time        // 最后一次更新的时间
+	ActivePC         int64            // 活跃的调用数
+	AllPCCount       int64            // 总共做了多少次
+	AvgProcessTime   int64            // 调用的平均时间，以微妙或者纳秒为单位
+	TotalProcessTime int64            // 调用的累计时间（纳秒）
+	Fail             int64            // 调用的失败次数
+	Conn             *grpc.ClientConn // grpc连接，主要用于远程调用
+	ConnState        int32            // grpc连接的状态，即connectivity.State，只有READY的Server才会被调度
+	ReadyTime        int64            // grpc连接最近一次进入READY状态的时间（unix纳秒），用于慢启动
+	Labels           svrpool.Metadata `json:"metadata"` // 注册时携带的元数据，例如 version=v2
+	CPUUtil          int32            // Server在心跳中上报的CPU利用率（百分比）
+	MemUtil          int32            // Server在心跳中上报的内存利用率（百分比）
+	UtilUpdate       int64            // 最后一次上报利用率的时间（unix纳秒）
 }
 
 type Request struct {
@@ -51,17 +60,16 @@ type Request struct {
 }
 
 func (svr *SortServer) Invoke(req []byte) ([]byte, error) {
+	return svr.InvokeContext(context.Background(), req)
+}
+
+func (svr *SortServer) InvokeContext(ctx context.Context, req []byte) ([]byte, error) {
 	log.Printf("select server: %s:%d, weight: %d, active procedure call: %d, cumulative procedure call: %d\n",
 		svr.IP, svr.Port, svr.Weight, svr.ActivePC, svr.AllPCCount)
-	var data Request
-	if err := json.Unmarshal(req, &data); err != nil {
-		return nil, errors.New("unmarshal json body failed")
+	sortReq, err := newSortRequest(req)
+	if err != nil {
+		return nil, err
 	}
-	client := sortService.NewSortServiceClient(svr.Conn)
-	ctx := context.Background()
-
-	var sortReq sortService.SortRequest
-	sortReq.Nums = data.Data
 	// 修改svr的一些参数
 	atomic.AddInt64(&svr.ActivePC, 1)
 	atomic.AddInt64(&svr.AllPCCount, 1)
@@ -71,13 +79,41 @@ func (svr *SortServer) Invoke(req []byte) ([]byte, error) {
 		duration := int64(time.Now().Sub(start))
 		avg := int64(float64(svr.AvgProcessTime)*decay + float64(duration)*(1-decay))
 		atomic.StoreInt64(&svr.AvgProcessTime, avg)
+		atomic.AddInt64(&svr.TotalProcessTime, duration)
 		log.Printf("sort service cost %d milliseconds\n", duration/1000)
 
 	}()
-	rsp, err := client.Sort(ctx, &sortReq)
+	result, err := svr.sort(ctx, sortReq)
 	if err != nil {
 		log.Println("request failed, the err is", err)
 		atomic.AddInt64(&svr.Fail, 1)
+		return nil, err
+	}
+	return result, nil
+}
+
+// 发出影子请求，不修改ActivePC，AllPCCount，Fail等统计信息
+func (svr *SortServer) InvokeShadow(ctx context.Context, req []byte) ([]byte, error) {
+	sortReq, err := newSortRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return svr.sort(ctx, sortReq)
+}
+
+func newSortRequest(req []byte) (*sortService.SortRequest, error) {
+	var data Request
+	if err := json.Unmarshal(req, &data); err != nil {
+		return nil, errors.New("unmarshal json body failed")
+	}
+	return &sortService.SortRequest{Nums: data.Data}, nil
+}
+
+func (svr *SortServer) sort(ctx context.Context, sortReq *sortService.SortRequest) ([]byte, error) {
+	client := sortService.NewSortServiceClient(svr.Conn)
+	rsp, err := client.Sort(ctx, sortReq)
+	if err != nil {
+		return nil, err
 	}
 	result, err := json.Marshal(&rsp.Nums)
 	if err != nil {
@@ -86,29 +122,72 @@ func (svr *SortServer) Invoke(req []byte) ([]byte, error) {
 	return result, nil
 }
 
-func RegisterSortSvr(ip string, port uint16, weight, core, memory int32) error {
+// 返回Server的调用统计信息
+func (svr *SortServer) Stat() svrpool.Stat {
+	return svrpool.Stat{
+		ActivePC:         atomic.LoadInt64(&svr.ActivePC),
+		AllPCCount:       atomic.LoadInt64(&svr.AllPCCount),
+		Fail:             atomic.LoadInt64(&svr.Fail),
+		AvgProcessTime:   atomic.LoadInt64(&svr.AvgProcessTime),
+		TotalProcessTime: atomic.LoadInt64(&svr.TotalProcessTime),
+	}
+}
+
+// 保存到svrpool中的元数据，除了注册时携带的元数据之外，还包括coreNum和memory，从而可以通过 memory>=16 这样的选择器选出大内存的节点
+func (svr *SortServer) metadata() svrpool.Metadata {
+	metadata := make(svrpool.Metadata, len(svr.Labels)+2)
+	for k, v := range svr.Labels {
+		metadata[k] = v
+	}
+	metadata["coreNum"] = strconv.Itoa(int(atomic.LoadInt32(&svr.CoreNum)))
+	metadata["memory"] = strconv.Itoa(int(atomic.LoadInt32(&svr.Memory)))
+	return metadata
+}
+
+// 返回到排序服务的grpc连接，WebSocket桥接等流式调用会直接使用该连接
+func (svr *SortServer) ClientConn() *grpc.ClientConn {
+	return svr.Conn
+}
+
+// serviceName 是svrpool中的服务名，不同租户的排序服务带有租户的前缀，例如 teamA/SortService
+// labels 是实例的元数据，例如 version=v2，可以为nil
+func RegisterSortSvr(serviceName, ip string, port uint16, weight, core, memory int32, labels svrpool.Metadata) error {
 	serverID := ip + ":" + strconv.Itoa(int(port))
-	if invoker, err := svrpool.GetInvoker(ServiceName, serverID); err == nil { // 说明存在对应的Invoker了
+	if invoker, err := svrpool.GetInvoker(serviceName, serverID); err == nil { // 说明存在对应的Invoker了
 		svr, _ := invoker.(*SortServer)
 		svr.Shutdown = false
 		return nil
 	}
-	svr := SortServer{IP: ip, Port: port, Weight: weight, CoreNum: core, Memory: memory, LastUpdate: time.Now()}
-	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithBlock()}
-	var err error
-	if svr.Conn, err = grpc.Dial(serverID, opts...); err != nil {
+	svr := SortServer{IP: ip, Port: port, Weight: weight, CoreNum: core, Memory: memory, LastUpdate: time.Now(), Labels: labels}
+	transport, err := tlsconf.DialOption(serviceName)
+	if err != nil {
+		log.Println("Load tls config of", serviceName, "failed, the err is ", err)
+		return err
+	}
+	// 非阻塞地拨号，连接在后台建立，注册请求不会因为后端不可达而一直阻塞
+	if svr.Conn, err = grpc.Dial(serverID, transport); err != nil {
 		log.Println("Dial server", serverID, "failed, the err is ", err)
 		return err
 	}
-	if _, err := svrpool.AddServer(ServiceName, serverID, &svr); err != nil {
+	svr.ConnState = int32(svr.Conn.GetState())
+	if _, err := svrpool.AddServerWithMetadata(serviceName, serverID, &svr, svr.metadata()); err != nil {
 		log.Println("Add sort server into server pool failed, server ID is ", serverID, "the err is ", err)
+		svr.Conn.Close()
 		return err
 	}
+	go trackConn(serviceName, serverID, &svr)
 	return nil
 }
 
-func UpdateSortSvr(serverID string, updateField map[string]interface{}) error {
-	invoker, err := svrpool.GetInvoker(ServiceName, serverID)
+// 更新请求中的参数错误，例如字段的类型不对，ContactSortServer 对该错误返回400
+type paramError string
+
+func (err paramError) Error() string {
+	return string(err)
+}
+
+func UpdateSortSvr(serviceName, serverID string, updateField map[string]interface{}) error {
+	invoker, err := svrpool.GetInvoker(serviceName, serverID)
 	if err != nil { // 说明存在对应的Invoker了
 		return err
 	}
@@ -120,31 +199,75 @@ func UpdateSortSvr(serverID string, updateField map[string]interface{}) error {
 	if val, exist := updateField["shutdown"]; exist {
 		shutdown, ok := val.(bool)
 		if !ok {
-			return errors.New("wrong params, shutdown is bool type")
+			return paramError("wrong params, shutdown is bool type")
 		}
 		if shutdown {
-			svrpool.RemoveInvoker(ServiceName, serverID)
+			svrpool.RemoveInvoker(serviceName, serverID)
+			regauth.RemoveOwner(serviceName, serverID)
 			svr.Conn.Close()
 			return nil
 		}
 	}
+	// 先检查所有字段的类型再更新，避免非数字的值被当成0写入，或者只更新了一部分字段
+	var labels svrpool.Metadata
+	if val, exist := updateField["metadata"]; exist {
+		if labels, err = parseMetadata(val); err != nil {
+			return paramError(err.Error())
+		}
+	}
+	values := make(map[string]int32, len(updateField))
 	for fieldName, fieldVal := range updateField {
-		val, ok := fieldVal.(int32)
+		switch fieldName {
+		case "weight", "coreNum", "memory", "cpuUtil", "memUtil":
+		case "shutdown", "metadata":
+			continue
+		default:
+			log.Println("sort server doesn't have field : ", fieldName)
+			continue
+		}
+		// 从JSON中解析出来的数字都是float64
+		num, ok := fieldVal.(float64)
 		if !ok {
-			log.Printf("fieldVal: %v can not transform to type uint32", fieldVal)
+			return paramError("wrong params, " + fieldName + " is number type")
+		}
+		// 利用率超出范围时会算出负的剩余资源或者虚高的容量
+		if (fieldName == "cpuUtil" || fieldName == "memUtil") && (num < 0 || num > 100) {
+			return paramError("wrong params, " + fieldName + " should be between 0 and 100")
 		}
+		// 负的权重会让调度器算出负的权重和
+		if fieldName == "weight" && num < 0 {
+			return paramError("wrong params, weight should not be negative")
+		}
+		values[fieldName] = int32(num)
+	}
+	// 元数据，coreNum和memory变化时需要更新svrpool中的元数据
+	metadataChanged := false
+	if labels != nil {
+		svr.Labels = labels
+		metadataChanged = true
+	}
+	for fieldName, val := range values {
 		switch fieldName {
 		case "weight":
 			atomic.StoreInt32(&svr.Weight, val)
 		case "coreNum":
 			atomic.StoreInt32(&svr.CoreNum, val)
+			metadataChanged = true
 		case "memory":
 			atomic.StoreInt32(&svr.Memory, val)
-		default:
-			log.Println("sort server doesn't have field : ", fieldName)
+			metadataChanged = true
+		case "cpuUtil":
+			atomic.StoreInt32(&svr.CPUUtil, val)
+			atomic.StoreInt64(&svr.UtilUpdate, time.Now().UnixNano())
+		case "memUtil":
+			atomic.StoreInt32(&svr.MemUtil, val)
+			atomic.StoreInt64(&svr.UtilUpdate, time.Now().UnixNano())
 		}
 	}
-	return nil
+	if metadataChanged {
+		return svrpool.SetMetadata(serviceName, serverID, svr.metadata())
+	}
+	return svrpool.UpdateServer(serviceName, serverID)
 }
 
 type SortServerRequest struct {
@@ -158,34 +281,55 @@ const (
 	Update   = 2
 )
 
-var (
-	once = &sync.Once{}
-)
-
+// ContactSortServer 处理排序服务后端的注册，更新和注销，后端注册到请求所属租户的排序服务中
 func ContactSortServer(c *gin.Context) {
 	var req SortServerRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": fmt.Sprintf("%v", err)})
 		return
 	}
+	serviceName := tenant.Qualify(tenant.Get(c), ServiceName)
+	identity := regauth.GetIdentity(c)
 	if Register == req.OP {
 		basicInfo, err := parseInfo(req.SvrInfo)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": fmt.Sprintf("format of request packet is wrong, the err is %v", err)})
 			return
 		}
-		err = RegisterSortSvr(basicInfo.IP, basicInfo.Port, basicInfo.Weight, basicInfo.CoreNum, basicInfo.Memory)
+		serverID := basicInfo.IP + ":" + strconv.Itoa(int(basicInfo.Port))
+		// 已经被其他身份注册的server不能被覆盖，避免流量被劫持
+		if err := regauth.CheckOwner(serviceName, serverID, identity); err != nil {
+			regauth.Audit(c, "register", serviceName, serverID, err)
+			c.JSON(http.StatusForbidden, gin.H{"code": -1, "msg": fmt.Sprint(err)})
+			return
+		}
+		err = RegisterSortSvr(serviceName, basicInfo.IP, basicInfo.Port, basicInfo.Weight, basicInfo.CoreNum, basicInfo.Memory, basicInfo.Metadata)
+		regauth.Audit(c, "register", serviceName, serverID, err)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": -2, "msg": fmt.Sprint(err)})
 			return
 		}
-		once.Do(func() {
-			svrpool.SchedulerPool.Store(ServiceName, &SortServerScheduler{})
-		})
+		regauth.SetOwner(serviceName, serverID, identity)
+		// 通过SetScheduler设置了调度器时不覆盖
+		svrpool.SchedulerPool.LoadOrStore(serviceName, &SortServerScheduler{Service: serviceName})
 		c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success"})
 		return
 	}
-	err := UpdateSortSvr(req.ServID, req.SvrInfo)
+	action := "update"
+	if shutdown, _ := req.SvrInfo["shutdown"].(bool); shutdown {
+		action = "deregister"
+	}
+	if err := regauth.CheckOwner(serviceName, req.ServID, identity); err != nil {
+		regauth.Audit(c, action, serviceName, req.ServID, err)
+		c.JSON(http.StatusForbidden, gin.H{"code": -1, "msg": fmt.Sprint(err)})
+		return
+	}
+	err := UpdateSortSvr(serviceName, req.ServID, req.SvrInfo)
+	regauth.Audit(c, action, serviceName, req.ServID, err)
+	if _, ok := err.(paramError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": fmt.Sprint(err)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": -2, "msg": fmt.Sprint(err)})
 		return
@@ -201,6 +345,7 @@ type BasicInfo struct {
 	CoreNum  int32
 	Memory   int32
 	Shutdown bool
+	Metadata svrpool.Metadata
 }
 
 func parseInfo(fieldVals map[string]interface{}) (BasicInfo, error) {
@@ -229,6 +374,9 @@ func parseInfo(fieldVals map[string]interface{}) (BasicInfo, error) {
 		if !ok {
 			return basic, errors.New("field weight is not int")
 		}
+		if wt < 0 {
+			return basic, paramError("field weight should not be negative")
+		}
 		basic.Weight = int32(wt)
 	}
 	if val, ok := fieldVals["coreNum"]; !ok {
@@ -258,34 +406,71 @@ func parseInfo(fieldVals map[string]interface{}) (BasicInfo, error) {
 		}
 		basic.Shutdown = shutdown
 	}
+	// 元数据是可选的
+	if val, ok := fieldVals["metadata"]; ok {
+		metadata, err := parseMetadata(val)
+		if err != nil {
+			return basic, err
+		}
+		basic.Metadata = metadata
+	}
 	return basic, nil
 }
 
+// 解析形如 {"version": "v2", "gpu": false} 的元数据，非字符串的值会被转换成字符串
+func parseMetadata(val interface{}) (svrpool.Metadata, error) {
+	fields, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("field metadata is not object")
+	}
+	metadata := make(svrpool.Metadata, len(fields))
+	for k, v := range fields {
+		metadata[k] = fmt.Sprint(v)
+	}
+	return metadata, nil
+}
+
+// 全局的随机数生成器是并发安全的，只需要在启动时设置一次种子，每次调度都重新设置种子会让同一秒内的调度选出相同的实例
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// 排序服务的调度器，Service 是svrpool中的服务名，每个租户的排序服务有自己的调度器
 type SortServerScheduler struct {
+	Service string
 }
 
 func (scheduler *SortServerScheduler) Select() (svrpool.Invoker, error) {
-	serverInstance, ok := svrpool.ServerPool.Load(ServiceName)
-	if !ok {
-		return nil, errors.New("service doesn't exist")
+	return scheduler.SelectWithHint(svrpool.Hint{})
+}
+
+// 按照权重随机选择，只在满足hint.Selector的可用实例中选择，配置了就近调度时优先选择本地zone的实例
+func (scheduler *SortServerScheduler) SelectWithHint(hint svrpool.Hint) (svrpool.Invoker, error) {
+	svrs, err := svrpool.GetSnapshot(scheduler.Service)
+	if err != nil {
+		return nil, err
 	}
-	svrs, _ := serverInstance.(svrpool.Servers)
-	svrs.RWLock.RLock()
-	defer svrs.RWLock.RUnlock()
+	candidates := svrs.Candidates(scheduler.Service, hint)
+	// 慢启动期间的有效权重随时间变化，所以只计算一次，两次遍历使用相同的权重
+	weights := make([]int32, len(candidates))
 	var weightSum int32
-	for _, svr := range *svrs.SvrSlice {
+	for i, svr := range candidates {
 		sortSvr, _ := svr.(*SortServer)
-		weightSum += sortSvr.Weight
+		weights[i] = svrpool.EffectiveWeight(scheduler.Service, svr, atomic.LoadInt32(&sortSvr.Weight))
+		weightSum += weights[i]
+	}
+	if weightSum <= 0 {
+		return nil, errors.New("no available server")
 	}
-	time.Sleep(10 * time.Millisecond)
-	rand.Seed(time.Now().Unix())
 	randWt := rand.Int31n(weightSum)
-	for _, svr := range *svrs.SvrSlice {
-		sortSvr, _ := svr.(*SortServer)
-		randWt -= sortSvr.Weight
+	for i, svr := range candidates {
+		if weights[i] <= 0 {
+			continue
+		}
+		randWt -= weights[i]
 		if randWt < 0 {
 			// log.Printf("Choose the server : %+v", *sortSvr)
-			return sortSvr, nil
+			return svr, nil
 		}
 	}
 	return nil, errors.New("can not get one instance")
@@ -0,0 +1,109 @@
+package sortsvr
+
+import (
+	"Gateway/regauth"
+	"Gateway/svrpool"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestUpdateSortSvr(t *testing.T) {
+	serviceName := "TestUpdateSortSvr"
+	svr := benchServer(10)
+	svr.CoreNum, svr.Memory = 4, 8
+	if _, err := svrpool.AddServer(serviceName, "s1", svr); err != nil {
+		t.Fatal(err)
+	}
+	defer svrpool.ServerPool.Delete(serviceName)
+
+	cases := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantErr    bool
+		wantWeight int32
+		wantCore   int32
+	}{
+		{"weight", map[string]interface{}{"weight": float64(20)}, false, 20, 4},
+		{"non numeric weight", map[string]interface{}{"weight": "30"}, true, 20, 4},
+		// 有一个字段不合法时其他字段也不会被更新
+		{"partially invalid", map[string]interface{}{"weight": float64(40), "coreNum": true}, true, 20, 4},
+		{"negative weight", map[string]interface{}{"weight": float64(-1), "coreNum": float64(8)}, true, 20, 4},
+		{"bad metadata", map[string]interface{}{"weight": float64(40), "metadata": "v2"}, true, 20, 4},
+		{"unknown field is ignored", map[string]interface{}{"ip": "10.0.0.1", "coreNum": float64(16)}, false, 20, 16},
+		{"shutdown false", map[string]interface{}{"shutdown": false, "weight": float64(50)}, false, 50, 16},
+		{"bad shutdown", map[string]interface{}{"shutdown": "yes"}, true, 50, 16},
+		{"utilization", map[string]interface{}{"cpuUtil": float64(0), "memUtil": float64(100)}, false, 50, 16},
+		{"negative cpu utilization", map[string]interface{}{"cpuUtil": float64(-1), "weight": float64(60)}, true, 50, 16},
+		{"cpu utilization above 100", map[string]interface{}{"cpuUtil": float64(101)}, true, 50, 16},
+		{"negative memory utilization", map[string]interface{}{"memUtil": float64(-50)}, true, 50, 16},
+		{"memory utilization above 100", map[string]interface{}{"memUtil": float64(1000)}, true, 50, 16},
+	}
+	for _, c := range cases {
+		err := UpdateSortSvr(serviceName, "s1", c.fields)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+		}
+		if _, ok := err.(paramError); err != nil && !ok {
+			t.Errorf("%s: err %v should be a param error", c.name, err)
+		}
+		if svr.Weight != c.wantWeight || svr.CoreNum != c.wantCore {
+			t.Errorf("%s: weight = %d, coreNum = %d, want %d, %d", c.name, svr.Weight, svr.CoreNum, c.wantWeight, c.wantCore)
+		}
+		if svr.CPUUtil < 0 || svr.CPUUtil > 100 || svr.MemUtil < 0 || svr.MemUtil > 100 {
+			t.Errorf("%s: cpuUtil = %d, memUtil = %d, utilization out of range is stored", c.name, svr.CPUUtil, svr.MemUtil)
+		}
+	}
+}
+
+func TestShutdownReleasesOwner(t *testing.T) {
+	serviceName := "TestShutdownReleasesOwner"
+	svr := benchServer(10)
+	conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Conn = conn
+	if _, err := svrpool.AddServer(serviceName, "s1", svr); err != nil {
+		t.Fatal(err)
+	}
+	defer svrpool.ServerPool.Delete(serviceName)
+	regauth.SetOwner(serviceName, "s1", "node-1")
+	if err := regauth.CheckOwner(serviceName, "s1", "node-2"); err == nil {
+		t.Fatal("server registered by node-1 is updated by node-2")
+	}
+	if err := UpdateSortSvr(serviceName, "s1", map[string]interface{}{"shutdown": true}); err != nil {
+		t.Fatal(err)
+	}
+	// 注销之后其他身份可以重新注册同一个地址
+	if err := regauth.CheckOwner(serviceName, "s1", "node-2"); err != nil {
+		t.Errorf("owner is kept after shutdown: %v", err)
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+	info := func(weight interface{}) map[string]interface{} {
+		return map[string]interface{}{"ip": "10.0.0.1", "port": float64(8000), "weight": weight,
+			"coreNum": float64(4), "memory": float64(8), "shutdown": false}
+	}
+	cases := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantErr    bool
+		wantWeight int32
+	}{
+		{"valid", info(float64(10)), false, 10},
+		{"zero weight", info(float64(0)), false, 0},
+		{"negative weight", info(float64(-1)), true, 0},
+		{"non numeric weight", info("10"), true, 0},
+	}
+	for _, c := range cases {
+		basic, err := parseInfo(c.fields)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+		}
+		if err == nil && basic.Weight != c.wantWeight {
+			t.Errorf("%s: weight = %d, want %d", c.name, basic.Weight, c.wantWeight)
+		}
+	}
+}
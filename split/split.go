@@ -0,0 +1,296 @@
+package split
+
+import (
+	"Gateway/ratelimit"
+	"Gateway/svrpool"
+	"Gateway/tenant"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流量拆分的一个去向
+// Service 为空时使用请求中的服务名，Selector 用于选出服务中的一个子集（例如 version=v2）
+// Weight 是相对的权重，例如 95 和 5 表示5%的流量进入金丝雀版本
+type Backend struct {
+	Name     string
+	Service  string
+	Selector svrpool.Selector
+	Weight   int
+}
+
+// 一个路由的流量拆分规则
+// StickyKey 不为nil时同一个key（例如客户端IP）总是进入同一个去向，权重变化时只有一部分key会改变去向
+type Rule struct {
+	Backends  []Backend
+	StickyKey ratelimit.KeyFunc
+}
+
+// 一个去向的统计信息，用于在全量之前比较各个版本的错误率和耗时
+type Stats struct {
+	Service    string  `json:"service,omitempty"`
+	Selector   string  `json:"selector,omitempty"`
+	Weight     int     `json:"weight"`
+	Requests   int64   `json:"requests"`
+	Failures   int64   `json:"failures"`
+	ErrorRate  float64 `json:"errorRate"`
+	AvgLatency int64   `json:"avgLatency"` // 平均耗时（纳秒）
+}
+
+type counter struct {
+	requests     int64
+	failures     int64
+	totalLatency int64
+}
+
+const stickyBuckets = 10000 // 带有StickyKey的请求被哈希到的桶的数量
+
+var (
+	rules    = &sync.Map{} // route -> *Rule，route 为tenant.Route返回的路由，例如 /sortService，teamA/sortService，规则发布之后不会被修改
+	counters = &sync.Map{} // route|name -> *counter，调整权重之后统计信息仍然保留
+	rulesMu  = &sync.Mutex{}
+)
+
+// 为路由设置流量拆分规则，会覆盖之前的规则
+// 去向的名字不能为空并且不能重复，统计信息和调整权重都是按照名字区分去向的
+func SetRule(route string, rule *Rule) error {
+	if len(rule.Backends) == 0 {
+		return errors.New("at least one backend is required")
+	}
+	names := make(map[string]bool, len(rule.Backends))
+	for _, backend := range rule.Backends {
+		if backend.Weight < 0 {
+			return errors.New("weight of backend should not be negative")
+		}
+		if backend.Name == "" {
+			return errors.New("name of backend is required")
+		}
+		if names[backend.Name] {
+			return errors.New("duplicate backend " + backend.Name)
+		}
+		names[backend.Name] = true
+	}
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules.Store(route, rule)
+	return nil
+}
+
+func RemoveRule(route string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules.Delete(route)
+}
+
+// 在线调整路由中各个去向的权重，没有出现在weights中的去向保持原来的权重
+func SetWeights(route string, weights map[string]int) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	val, ok := rules.Load(route)
+	if !ok {
+		return errors.New("route doesn't have split rule")
+	}
+	old := val.(*Rule)
+	rule := &Rule{Backends: append([]Backend(nil), old.Backends...), StickyKey: old.StickyKey}
+	found := 0
+	for i := range rule.Backends {
+		if weight, ok := weights[rule.Backends[i].Name]; ok {
+			if weight < 0 {
+				return errors.New("weight of backend should not be negative")
+			}
+			rule.Backends[i].Weight = weight
+			found++
+		}
+	}
+	if found != len(weights) {
+		return errors.New("unknown backend in weights")
+	}
+	rules.Store(route, rule)
+	return nil
+}
+
+// 一次拆分的结果，调用结束之后需要执行Done记录结果
+type Choice struct {
+	Backend
+	counter *counter
+}
+
+// Choose 根据请求的路由选择一个去向，路由没有配置拆分规则或者所有权重都为0时返回nil
+func Choose(c *gin.Context) *Choice {
+	route := tenant.Route(c)
+	val, ok := rules.Load(route)
+	if !ok {
+		return nil
+	}
+	rule := val.(*Rule)
+	total := 0
+	for _, backend := range rule.Backends {
+		total += backend.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+	key := ""
+	if rule.StickyKey != nil {
+		key = rule.StickyKey(c)
+	}
+	if key == "" {
+		n := rand.Intn(total)
+		for _, backend := range rule.Backends {
+			n -= backend.Weight
+			if n < 0 {
+				return &Choice{Backend: backend, counter: getCounter(route, backend.Name)}
+			}
+		}
+		return nil
+	}
+	// key的桶号和权重的总和无关，累加的权重按比例映射到桶上，权重变化时只有落在比例变化部分的key会改变去向
+	hash := fnv.New32a()
+	hash.Write([]byte(route + "|" + key))
+	bucket := int64(hash.Sum32() % stickyBuckets)
+	cumulative := int64(0)
+	for _, backend := range rule.Backends {
+		cumulative += int64(backend.Weight)
+		if bucket*int64(total) < cumulative*stickyBuckets {
+			return &Choice{Backend: backend, counter: getCounter(route, backend.Name)}
+		}
+	}
+	return nil
+}
+
+func getCounter(route, name string) *counter {
+	key := route + "|" + name
+	if val, ok := counters.Load(key); ok {
+		return val.(*counter)
+	}
+	val, _ := counters.LoadOrStore(key, &counter{})
+	return val.(*counter)
+}
+
+// 记录调用的结果
+func (choice *Choice) Done(err error, rtt time.Duration) {
+	atomic.AddInt64(&choice.counter.requests, 1)
+	atomic.AddInt64(&choice.counter.totalLatency, int64(rtt))
+	if err != nil {
+		atomic.AddInt64(&choice.counter.failures, 1)
+	}
+}
+
+// 返回路由中各个去向的统计信息，key为去向的名字
+func RouteStats(route string) map[string]Stats {
+	result := map[string]Stats{}
+	val, ok := rules.Load(route)
+	if !ok {
+		return result
+	}
+	for _, backend := range val.(*Rule).Backends {
+		cnt := getCounter(route, backend.Name)
+		stats := Stats{Service: backend.Service, Selector: backend.Selector.String(), Weight: backend.Weight,
+			Requests: atomic.LoadInt64(&cnt.requests), Failures: atomic.LoadInt64(&cnt.failures)}
+		if stats.Requests > 0 {
+			stats.ErrorRate = float64(stats.Failures) / float64(stats.Requests)
+			stats.AvgLatency = atomic.LoadInt64(&cnt.totalLatency) / stats.Requests
+		}
+		result[backend.Name] = stats
+	}
+	return result
+}
+
+// StatsHandler 返回请求所属租户的各个路由中各个去向的统计信息
+func StatsHandler(c *gin.Context) {
+	stats := map[string]map[string]Stats{}
+	name := tenant.Get(c)
+	rules.Range(func(key, value interface{}) bool {
+		if tenant.Owns(name, key.(string)) {
+			stats[key.(string)] = RouteStats(key.(string))
+		}
+		return true
+	})
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": stats})
+}
+
+type weightsRequest struct {
+	Route   string         `json:"route"`
+	Weights map[string]int `json:"weights"`
+}
+
+// WeightsHandler 在线调整权重，请求体为 {"route": "/sortService", "weights": {"stable": 90, "canary": 10}}
+// route 是相对于请求所属租户的路由，必须以 / 开头，所以只能调整本租户的路由，需要放在管理员认证的中间件之后
+func WeightsHandler(c *gin.Context) {
+	var req weightsRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	if !strings.HasPrefix(req.Route, "/") {
+		c.JSON(http.StatusForbidden, gin.H{"code": -1, "msg": "route doesn't belong to the tenant", "rsp": nil})
+		return
+	}
+	route := tenant.Get(c) + req.Route
+	if err := SetWeights(route, req.Weights); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": RouteStats(route)})
+}
+
+type backendFile struct {
+	Name     string `json:"name"`
+	Service  string `json:"service"`
+	Selector string `json:"selector"`
+	Weight   int    `json:"weight"`
+}
+
+type ruleFile struct {
+	Sticky   string        `json:"sticky"`
+	Backends []backendFile `json:"backends"`
+}
+
+// 从JSON文件中加载各个路由的拆分规则，格式为
+// {"/sortService": {"sticky": "ip", "backends": [{"name": "stable", "selector": "version=v1", "weight": 95}, {"name": "canary", "selector": "version=v2", "weight": 5}]}}
+// sticky 可以是 ip，apikey，header:<name>，为空表示不需要粘性，ip 为ratelimit.ClientIP确定的客户端IP，只信任可信代理转发的X-Forwarded-For
+func LoadRules(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var files map[string]ruleFile
+	if err := json.Unmarshal(content, &files); err != nil {
+		return err
+	}
+	for route, file := range files {
+		rule := &Rule{}
+		switch {
+		case file.Sticky == "":
+		case file.Sticky == "ip":
+			rule.StickyKey = ratelimit.ByClientIP
+		case file.Sticky == "apikey":
+			rule.StickyKey = ratelimit.ByAPIKey
+		case strings.HasPrefix(file.Sticky, "header:"):
+			rule.StickyKey = ratelimit.ByHeader(strings.TrimPrefix(file.Sticky, "header:"))
+		default:
+			return errors.New("unknown sticky key " + file.Sticky)
+		}
+		for _, backend := range file.Backends {
+			selector, err := svrpool.ParseSelector(backend.Selector)
+			if err != nil {
+				return err
+			}
+			rule.Backends = append(rule.Backends, Backend{Name: backend.Name, Service: backend.Service,
+				Selector: selector, Weight: backend.Weight})
+		}
+		if err := SetRule(route, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
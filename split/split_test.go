@@ -0,0 +1,199 @@
+package split
+
+import (
+	"Gateway/ratelimit"
+	"Gateway/tenant"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 在路由上发送n个请求，返回各个去向被选中的次数
+func distribute(t *testing.T, route string, n int, header func(i int) string) map[string]int {
+	gin.SetMode(gin.TestMode)
+	counts := map[string]int{}
+	router := gin.New()
+	router.POST(route, func(c *gin.Context) {
+		if choice := Choose(c); choice != nil {
+			counts[choice.Name]++
+		} else {
+			counts[""]++
+		}
+	})
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodPost, route, nil)
+		if header != nil {
+			req.Header.Set("X-User", header(i))
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	return counts
+}
+
+func TestChooseWeights(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []int
+		want    []float64 // 每个去向期望的比例
+	}{
+		{"canary 10%", []int{90, 10}, []float64{0.9, 0.1}},
+		{"even", []int{1, 1, 2}, []float64{0.25, 0.25, 0.5}},
+		{"drained", []int{100, 0}, []float64{1, 0}},
+	}
+	names := []string{"a", "b", "c"}
+	for i, c := range cases {
+		route := "/split-" + strconv.Itoa(i)
+		rule := &Rule{}
+		for j, weight := range c.weights {
+			rule.Backends = append(rule.Backends, Backend{Name: names[j], Weight: weight})
+		}
+		if err := SetRule(route, rule); err != nil {
+			t.Fatal(err)
+		}
+		const n = 20000
+		counts := distribute(t, route, n, nil)
+		for j, want := range c.want {
+			got := float64(counts[names[j]]) / n
+			if math.Abs(got-want) > 0.02 {
+				t.Errorf("%s: backend %s got %.3f of traffic, want %.3f", c.name, names[j], got, want)
+			}
+		}
+		RemoveRule(route)
+	}
+}
+
+func TestChooseAllZero(t *testing.T) {
+	if err := SetRule("/split-zero", &Rule{Backends: []Backend{{Name: "a"}, {Name: "b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRule("/split-zero")
+	if counts := distribute(t, "/split-zero", 10, nil); counts[""] != 10 {
+		t.Errorf("all zero weights should not split, got %v", counts)
+	}
+}
+
+func TestChooseSticky(t *testing.T) {
+	route := "/split-sticky"
+	if err := SetRule(route, &Rule{Backends: []Backend{{Name: "a", Weight: 50}, {Name: "b", Weight: 50}},
+		StickyKey: ratelimit.ByHeader("X-User")}); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRule(route)
+	// 同一个用户的所有请求都应该进入同一个去向
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		counts := distribute(t, route, 50, func(int) string { return user })
+		if len(counts) != 1 {
+			t.Errorf("user %s is split across backends: %v", user, counts)
+		}
+	}
+}
+
+func TestStickyKeysMoveOnlyWithWeights(t *testing.T) {
+	route := "/split-sticky-move"
+	defer RemoveRule(route)
+	user := func(i int) string { return "user-" + strconv.Itoa(i) }
+	// 记录每个用户在当前权重下进入的去向
+	assign := func(weights ...int) map[string]string {
+		if err := SetRule(route, &Rule{Backends: []Backend{{Name: "stable", Weight: weights[0]}, {Name: "canary", Weight: weights[1]}},
+			StickyKey: ratelimit.ByHeader("X-User")}); err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			for name := range distribute(t, route, 1, func(int) string { return user(i) }) {
+				result[user(i)] = name
+			}
+		}
+		return result
+	}
+	cases := []struct {
+		name     string
+		from, to []int
+		maxMoved float64 // 最多改变去向的用户比例
+	}{
+		{"grow canary", []int{95, 5}, []int{90, 10}, 0.07},
+		// 权重的总和变化时也只有比例变化的部分会移动
+		{"grow canary and total", []int{95, 5}, []int{90, 20}, 0.16},
+		{"scale both", []int{95, 5}, []int{190, 10}, 0},
+	}
+	for _, c := range cases {
+		before, after := assign(c.from...), assign(c.to...)
+		moved := 0
+		for u, name := range before {
+			if after[u] != name {
+				moved++
+				// 金丝雀的比例只增不减，所以只会有用户从stable移动到canary
+				if name != "stable" {
+					t.Errorf("%s: user %s moved from %s to %s", c.name, u, name, after[u])
+				}
+			}
+		}
+		if share := float64(moved) / float64(len(before)); share > c.maxMoved {
+			t.Errorf("%s: %.3f of users changed backend, want at most %.3f", c.name, share, c.maxMoved)
+		}
+	}
+}
+
+func TestSetRuleValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		rule *Rule
+	}{
+		{"no backend", &Rule{}},
+		{"negative weight", &Rule{Backends: []Backend{{Name: "a", Weight: -1}}}},
+		{"empty name", &Rule{Backends: []Backend{{Name: "a", Weight: 1}, {Weight: 1}}}},
+		{"duplicate name", &Rule{Backends: []Backend{{Name: "a", Weight: 1}, {Name: "a", Weight: 2}}}},
+	}
+	for _, c := range cases {
+		if err := SetRule("/split-invalid", c.rule); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestWeightsHandlerTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := tenant.SetTenants([]*tenant.Tenant{{Name: "teamA", PathPrefix: "/teamA"}, {Name: "teamB", PathPrefix: "/teamB"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.SetTenants(nil)
+	for _, route := range []string{"teamA/sortService", "teamB/sortService"} {
+		if err := SetRule(route, &Rule{Backends: []Backend{{Name: "stable", Weight: 100}, {Name: "canary"}}}); err != nil {
+			t.Fatal(err)
+		}
+		defer RemoveRule(route)
+	}
+	router := gin.New()
+	router.POST("/admin/split/weights", WeightsHandler)
+	handler := tenant.Handler(router)
+
+	cases := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"own route", "/teamA/admin/split/weights", `{"route": "/sortService", "weights": {"canary": 10}}`, http.StatusOK},
+		{"other tenant", "/teamA/admin/split/weights", `{"route": "teamB/sortService", "weights": {"canary": 20}}`, http.StatusForbidden},
+		{"default tenant to teamB", "/admin/split/weights", `{"route": "teamB/sortService", "weights": {"canary": 30}}`, http.StatusForbidden},
+		{"unknown backend", "/teamB/admin/split/weights", `{"route": "/sortService", "weights": {"beta": 30}}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(c.body)))
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+	if got := RouteStats("teamA/sortService")["canary"].Weight; got != 10 {
+		t.Errorf("weight of teamA canary = %d, want 10", got)
+	}
+	if got := RouteStats("teamB/sortService")["canary"].Weight; got != 0 {
+		t.Errorf("weight of teamB canary = %d, want 0", got)
+	}
+}
@@ -0,0 +1,133 @@
+package svrpool
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	MetaZone = "zone" // 表示实例所在zone（机架，机房）的元数据的key
+)
+
+// 服务的就近调度配置
+// Zone 是网关所在的zone，优先调度到相同zone的实例
+// Priorities 是其他zone的溢出顺序，没有列出的zone（包括没有zone的实例）优先级最低
+// MinHealthyPercent 表示zone的可用实例数占该zone实例总数的百分比达到该值时，该zone承担全部的流量
+// 低于该值时该zone只承担 可用比例 / MinHealthyPercent 的流量，剩下的流量按照优先级溢出到其他zone，例如该值为70，本地zone有60%的实例可用时，约86%的流量留在本地
+type Locality struct {
+	Zone              string
+	Priorities        []string
+	MinHealthyPercent float64
+}
+
+var (
+	localities = &sync.Map{} // serviceName -> Locality
+)
+
+// 为服务设置就近调度
+func SetLocality(serviceName string, locality Locality) {
+	localities.Store(serviceName, locality)
+}
+
+func RemoveLocality(serviceName string) {
+	localities.Delete(serviceName)
+}
+
+// 返回满足hint并且可用的实例，调度器在这些实例中进行负载均衡
+// 服务配置了就近调度时，先按照各个zone的可用比例随机选出一个zone，再返回该zone的可用实例
+func (snapshot *Snapshot) Candidates(serviceName string, hint Hint) []Invoker {
+	val, ok := localities.Load(serviceName)
+	if !ok {
+		candidates := make([]Invoker, 0, len(snapshot.SvrSlice))
+		for _, svr := range snapshot.SvrSlice {
+			if snapshot.Matches(svr, hint.Selector) && Available(serviceName, svr) {
+				candidates = append(candidates, svr)
+			}
+		}
+		return candidates
+	}
+	locality := val.(Locality)
+	// 按照zone的优先级分组，0是本地zone，最后一组是没有列出的zone
+	levels := len(locality.Priorities) + 2
+	priority := make(map[string]int, levels)
+	for i := len(locality.Priorities) - 1; i >= 0; i-- {
+		priority[locality.Priorities[i]] = i + 1
+	}
+	priority[locality.Zone] = 0
+	totals := make([]int, levels)
+	healthy := make([][]Invoker, levels)
+	for _, svr := range snapshot.SvrSlice {
+		if !snapshot.Matches(svr, hint.Selector) {
+			continue
+		}
+		level, ok := priority[snapshot.Metadata[svr][MetaZone]]
+		if !ok {
+			level = levels - 1
+		}
+		totals[level]++
+		if Available(serviceName, svr) {
+			healthy[level] = append(healthy[level], svr)
+		}
+	}
+	counts := make([]int, levels)
+	for level := range healthy {
+		counts[level] = len(healthy[level])
+	}
+	level := pickLevel(priorityLoads(totals, counts, locality.MinHealthyPercent), rand.Float64())
+	if level < 0 {
+		return nil
+	}
+	return healthy[level]
+}
+
+// 计算各个优先级应该承担的流量比例
+// 每个优先级的健康度为 可用比例 / minHealthyPercent，最大为1，优先级高的先按照健康度分配，剩下的流量依次分配给后面的优先级
+// 所有优先级的健康度之和不足1时按照健康度的比例分配全部的流量
+func priorityLoads(totals, healthy []int, minHealthyPercent float64) []float64 {
+	health := make([]float64, len(totals))
+	sum := 0.0
+	for level, total := range totals {
+		if total == 0 || healthy[level] == 0 {
+			continue
+		}
+		health[level] = 1
+		if minHealthyPercent > 0 {
+			health[level] = math.Min(1, float64(healthy[level])/float64(total)*100/minHealthyPercent)
+		}
+		sum += health[level]
+	}
+	loads := make([]float64, len(totals))
+	if sum == 0 {
+		return loads
+	}
+	if sum < 1 {
+		for level := range health {
+			loads[level] = health[level] / sum
+		}
+		return loads
+	}
+	remaining := 1.0
+	for level := range health {
+		loads[level] = math.Min(health[level], remaining)
+		remaining -= loads[level]
+	}
+	return loads
+}
+
+// 根据[0, 1)之间的随机数r按照流量比例选出一个优先级，所有的比例都为0时返回-1
+func pickLevel(loads []float64, r float64) int {
+	last := -1
+	for level, load := range loads {
+		if load <= 0 {
+			continue
+		}
+		if r < load {
+			return level
+		}
+		r -= load
+		last = level
+	}
+	// 浮点数的误差可能导致r没有落在任何一个优先级中
+	return last
+}
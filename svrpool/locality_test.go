@@ -0,0 +1,111 @@
+package svrpool
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPriorityLoads(t *testing.T) {
+	cases := []struct {
+		name       string
+		totals     []int
+		healthy    []int
+		minPercent float64
+		want       []float64
+	}{
+		{"local fully healthy", []int{10, 10}, []int{10, 10}, 70, []float64{1, 0}},
+		{"local above threshold", []int{10, 10}, []int{7, 10}, 70, []float64{1, 0}},
+		// 60% / 70% ≈ 0.857 的流量留在本地，而不是按照实例数把62.5%的流量溢出
+		{"local below threshold", []int{10, 10}, []int{6, 10}, 70, []float64{6.0 / 7, 1.0 / 7}},
+		{"spill over two levels", []int{10, 10, 10}, []int{2, 2, 10}, 100, []float64{0.2, 0.2, 0.6}},
+		{"no local instances", []int{0, 4, 4}, []int{0, 4, 4}, 70, []float64{0, 1, 0}},
+		{"local all down", []int{10, 4}, []int{0, 4}, 70, []float64{0, 1}},
+		// 所有优先级加起来都不够时按照健康度的比例分配
+		{"everything degraded", []int{10, 10}, []int{2, 4}, 100, []float64{1.0 / 3, 2.0 / 3}},
+		{"nothing healthy", []int{10, 10}, []int{0, 0}, 70, []float64{0, 0}},
+		{"no threshold", []int{10, 10}, []int{1, 10}, 0, []float64{1, 0}},
+	}
+	for _, c := range cases {
+		got := priorityLoads(c.totals, c.healthy, c.minPercent)
+		for level := range c.want {
+			if math.Abs(got[level]-c.want[level]) > 1e-9 {
+				t.Errorf("%s: loads = %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPickLevel(t *testing.T) {
+	cases := []struct {
+		name  string
+		loads []float64
+		r     float64
+		want  int
+	}{
+		{"first level", []float64{0.8, 0.2}, 0, 0},
+		{"end of first level", []float64{0.8, 0.2}, 0.79, 0},
+		{"second level", []float64{0.8, 0.2}, 0.8, 1},
+		{"skip empty level", []float64{0, 1}, 0, 1},
+		{"rounding error", []float64{0.5, 0.49999999}, 0.9999999999, 1},
+		{"no load", []float64{0, 0}, 0.5, -1},
+	}
+	for _, c := range cases {
+		if got := pickLevel(c.loads, c.r); got != c.want {
+			t.Errorf("%s: level = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+type zoneInvoker struct {
+	id   int
+	down bool
+}
+
+func (invoker *zoneInvoker) Invoke(req []byte) ([]byte, error) {
+	return req, nil
+}
+
+func (invoker *zoneInvoker) Available() bool {
+	return !invoker.down
+}
+
+func TestCandidatesByZone(t *testing.T) {
+	serviceName := "TestCandidatesByZone"
+	SetLocality(serviceName, Locality{Zone: "a", Priorities: []string{"b"}, MinHealthyPercent: 70})
+	defer RemoveLocality(serviceName)
+	snapshot := &Snapshot{Metadata: map[Invoker]Metadata{}}
+	add := func(zone string, count, down int) {
+		for i := 0; i < count; i++ {
+			invoker := &zoneInvoker{id: len(snapshot.SvrSlice), down: i < down}
+			snapshot.SvrSlice = append(snapshot.SvrSlice, invoker)
+			snapshot.Metadata[invoker] = Metadata{MetaZone: zone}
+		}
+	}
+	// 本地10个实例中6个可用，其他zone的10个实例都可用
+	add("a", 10, 4)
+	add("b", 10, 0)
+
+	const rounds = 10000
+	local := 0
+	for i := 0; i < rounds; i++ {
+		candidates := snapshot.Candidates(serviceName, Hint{})
+		if len(candidates) == 0 {
+			t.Fatal("no candidates")
+		}
+		// 每次只返回同一个zone的可用实例
+		zone := snapshot.Metadata[candidates[0]][MetaZone]
+		for _, svr := range candidates {
+			if snapshot.Metadata[svr][MetaZone] != zone || !svr.(*zoneInvoker).Available() {
+				t.Fatalf("candidates mix zones or contain unavailable instances: %v", candidates)
+			}
+		}
+		if zone == "a" {
+			local++
+		}
+	}
+	// 期望约86%的流量留在本地
+	if share := float64(local) / rounds; share < 0.83 || share > 0.89 {
+		t.Errorf("local share = %.3f, want about %.3f", share, 6.0/7)
+	}
+}
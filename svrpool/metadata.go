@@ -0,0 +1,245 @@
+package svrpool
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MetaVersion = "version" // 表示实例版本的元数据的key
+)
+
+// 注册的实例携带的元数据，例如 version=v2，zone=rack-1，gpu=false，注册之后不能被修改，只能整体替换
+type Metadata map[string]string
+
+// 选择器中条件的比较方式，大小比较时元数据和条件中的值都需要是数字
+const (
+	OpEqual        = "="
+	OpNotEqual     = "!="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+)
+
+// 选择器中的一个条件，例如 key=value，Op为空时表示OpEqual
+// 元数据中没有key时，只有OpNotEqual的条件满足
+type Requirement struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// 选择器，所有条件都满足时实例才被选中，空的选择器选中所有实例
+type Selector []Requirement
+
+// 按照先长后短的顺序匹配，避免把 >= 解析成 >
+var selectorOps = []string{OpNotEqual, OpGreaterEqual, OpLessEqual, OpEqual, OpGreater, OpLess}
+
+// 解析形如 version=v2,gpu!=true,memory>=16 的选择器
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+func parseRequirement(s string) (Requirement, error) {
+	index, op := -1, ""
+	for _, candidate := range selectorOps {
+		// 选择最靠前的操作符，相同位置时选择更长的
+		if i := strings.Index(s, candidate); i >= 0 && (index < 0 || i < index) {
+			index, op = i, candidate
+		}
+	}
+	if index <= 0 {
+		return Requirement{}, errors.New("selector should be in the form of key=value, key!=value or key>=value")
+	}
+	req := Requirement{Key: strings.TrimSpace(s[:index]), Op: op, Value: strings.TrimSpace(s[index+len(op):])}
+	if req.Key == "" {
+		return Requirement{}, errors.New("key of selector is empty")
+	}
+	if op != OpEqual && op != OpNotEqual {
+		if _, err := strconv.ParseFloat(req.Value, 64); err != nil {
+			return Requirement{}, errors.New("value of " + req.Key + " should be a number")
+		}
+	}
+	return req, nil
+}
+
+func (req Requirement) Matches(metadata Metadata) bool {
+	value, ok := metadata[req.Key]
+	switch req.Op {
+	case "", OpEqual:
+		return ok && value == req.Value
+	case OpNotEqual:
+		return !ok || value != req.Value
+	}
+	if !ok {
+		return false
+	}
+	actual, err1 := strconv.ParseFloat(value, 64)
+	expected, err2 := strconv.ParseFloat(req.Value, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	switch req.Op {
+	case OpGreater:
+		return actual > expected
+	case OpGreaterEqual:
+		return actual >= expected
+	case OpLess:
+		return actual < expected
+	case OpLessEqual:
+		return actual <= expected
+	}
+	return false
+}
+
+func (selector Selector) Matches(metadata Metadata) bool {
+	for _, req := range selector {
+		if !req.Matches(metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+func (selector Selector) String() string {
+	parts := make([]string, 0, len(selector))
+	for _, req := range selector {
+		op := req.Op
+		if op == "" {
+			op = OpEqual
+		}
+		parts = append(parts, req.Key+op+req.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// 返回实例的元数据，没有元数据时返回nil，返回值不能被修改
+func (snapshot *Snapshot) MetadataOf(invoker Invoker) Metadata {
+	return snapshot.Metadata[invoker]
+}
+
+// 返回实例的ID，实例不在Snapshot中时返回空字符串
+func (snapshot *Snapshot) ServerID(invoker Invoker) string {
+	for serverID, svr := range snapshot.SvrMap {
+		if svr == invoker {
+			return serverID
+		}
+	}
+	return ""
+}
+
+// 判断实例是否满足选择器
+func (snapshot *Snapshot) Matches(invoker Invoker, selector Selector) bool {
+	return len(selector) == 0 || selector.Matches(snapshot.Metadata[invoker])
+}
+
+// 替换实例的元数据，订阅者会收到EventUpdate事件
+func SetMetadata(serviceName, serverID string, metadata Metadata) error {
+	val, ok := ServerPool.Load(serviceName)
+	if !ok {
+		return errors.New("service doesn't exist")
+	}
+	svrs := val.(*Servers)
+	svrs.lock.Lock()
+	defer svrs.lock.Unlock()
+	old := svrs.Snapshot()
+	invoker, exist := old.SvrMap[serverID]
+	if !exist || svrs.removed {
+		return errors.New("server doesn't exist")
+	}
+	snapshot := &Snapshot{SvrMap: old.SvrMap, SvrSlice: old.SvrSlice, Metadata: make(map[Invoker]Metadata, len(old.Metadata)+1)}
+	for svr, md := range old.Metadata {
+		snapshot.Metadata[svr] = md
+	}
+	snapshot.Metadata[invoker] = copyMetadata(metadata)
+	svrs.publish(snapshot, Event{Type: EventUpdate, ServiceName: serviceName, ServerID: serverID, Invoker: invoker})
+	return nil
+}
+
+// 根据服务名和服务器的ID返回实例的元数据
+func GetMetadata(serviceName, serverID string) (Metadata, error) {
+	snapshot, err := GetSnapshot(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	invoker, ok := snapshot.SvrMap[serverID]
+	if !ok {
+		return nil, errors.New("server doesn't exist")
+	}
+	return copyMetadata(snapshot.Metadata[invoker]), nil
+}
+
+// 返回服务中满足选择器的所有实例的元数据，key为服务器的ID
+func ListInstances(serviceName string, selector Selector) (map[string]Metadata, error) {
+	snapshot, err := GetSnapshot(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	instances := map[string]Metadata{}
+	for serverID, invoker := range snapshot.SvrMap {
+		if snapshot.Matches(invoker, selector) {
+			instances[serverID] = copyMetadata(snapshot.Metadata[invoker])
+		}
+	}
+	return instances, nil
+}
+
+func copyMetadata(metadata Metadata) Metadata {
+	if metadata == nil {
+		return nil
+	}
+	result := make(Metadata, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+// 一个实例的信息
+type instance struct {
+	ServerID  string   `json:"serverID"`
+	Available bool     `json:"available"`
+	Metadata  Metadata `json:"metadata"`
+}
+
+// InstancesHandler 返回请求所属租户的服务中满足选择器的实例，GET ?service=xxx&selector=version=v2
+func InstancesHandler(c *gin.Context) {
+	serviceName, valid := qualify(c)
+	selector, err := ParseSelector(c.Query("selector"))
+	if !valid || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "service is required and selector should be valid", "rsp": nil})
+		return
+	}
+	snapshot, err := GetSnapshot(serviceName)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	instances := []instance{}
+	for serverID, invoker := range snapshot.SvrMap {
+		if snapshot.Matches(invoker, selector) {
+			instances = append(instances, instance{ServerID: serverID, Available: Available(serviceName, invoker),
+				Metadata: snapshot.Metadata[invoker]})
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ServerID < instances[j].ServerID })
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": gin.H{"instances": instances, "revision": snapshot.Revision}})
+}
@@ -0,0 +1,41 @@
+package svrpool
+
+import (
+	"Gateway/tenant"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 返回租户中所有的服务名（不带租户的前缀），其他租户的服务不会被返回
+func ListServices(namespace string) []string {
+	var services []string
+	ServerPool.Range(func(key, value interface{}) bool {
+		if ns, serviceName := tenant.Split(key.(string)); ns == namespace {
+			services = append(services, serviceName)
+		}
+		return true
+	})
+	sort.Strings(services)
+	return services
+}
+
+// 将请求中的服务名转换成ServerPool中的名字，只能访问请求所属租户的服务
+func qualify(c *gin.Context) (string, bool) {
+	serviceName := c.Query("service")
+	if serviceName == "" {
+		return "", false
+	}
+	qualified, err := tenant.Service(c, serviceName)
+	return qualified, err == nil
+}
+
+// ServicesHandler 返回请求所属租户中所有的服务
+func ServicesHandler(c *gin.Context) {
+	services := ListServices(tenant.Get(c))
+	if services == nil {
+		services = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": services})
+}
@@ -1,24 +1,109 @@
 package svrpool
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
 )
 
 type Invoker interface {
 	Invoke(req []byte) ([]byte, error)
 }
 
+// 可以携带context的Invoker，context中的outgoing metadata（例如认证之后得到的用户信息）会随调用一起发送给后端
+type ContextInvoker interface {
+	Invoker
+	InvokeContext(ctx context.Context, req []byte) ([]byte, error)
+}
+
+// 可以发出不计入调用统计的请求的Invoker，流量镜像的影子请求不应该影响异常检测和调度器依赖的统计信息
+type ShadowInvoker interface {
+	Invoker
+	InvokeShadow(ctx context.Context, req []byte) ([]byte, error)
+}
+
+// 可以报告自身是否可用的Invoker，例如grpc连接还没有建立好的Invoker是不可用的
+// 调度器只应该选择可用的Invoker
+type Checker interface {
+	Available() bool
+}
+
+// Invoker的调用统计信息
+// ActivePC 表示正在进行的调用数，AllPCCount 和 Fail 分别表示累计的调用次数和失败次数，AvgProcessTime 表示调用的平均耗时（纳秒）
+// TotalProcessTime 表示已经完成的调用的累计耗时（纳秒），两次统计的差值除以调用次数的差值就是这段时间内的平均耗时
+type Stat struct {
+	ActivePC         int64 `json:"activePC"`
+	AllPCCount       int64 `json:"allPCCount"`
+	Fail             int64 `json:"fail"`
+	AvgProcessTime   int64 `json:"avgProcessTime"`
+	TotalProcessTime int64 `json:"totalProcessTime"`
+}
+
+// 可以提供调用统计信息的Invoker，异常检测等功能依赖这些统计信息
+type StatInvoker interface {
+	Invoker
+	Stat() Stat
+}
+
+// 判断Invoker是否可用的过滤器，例如健康检查会把检查失败的Invoker过滤掉
+type Filter func(serviceName string, invoker Invoker) bool
+
+var (
+	filters     []Filter
+	filtersLock = &sync.RWMutex{}
+)
+
+// 添加一个过滤器，所有的过滤器都通过时Invoker才是可用的
+func AddFilter(filter Filter) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	filters = append(filters, filter)
+}
+
+// 判断Invoker是否可用，Invoker实现了Checker接口时需要其报告可用，并且需要通过所有的过滤器
+func Available(serviceName string, invoker Invoker) bool {
+	if checker, ok := invoker.(Checker); ok && !checker.Available() {
+		return false
+	}
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	for _, filter := range filters {
+		if !filter(serviceName, invoker) {
+			return false
+		}
+	}
+	return true
+}
+
+// 能够提供到后端grpc连接的Invoker，WebSocket桥接等流式的调用需要直接在该连接上创建Stream
+type StreamInvoker interface {
+	Invoker
+	ClientConn() *grpc.ClientConn
+}
+
+// 一个服务在某一时刻的所有Invoker，发布之后就不会再被修改，所以读取时不需要加锁
+// Map 和 Slice 中保存的其实是同一份Server，并且保存的都只是指针，指向相同的Server对象
+// Metadata 保存各个实例的元数据，Revision 是产生该Snapshot的变化的版本号，可以从该版本号开始Watch后续的变化
+type Snapshot struct {
+	SvrMap   map[string]Invoker
+	SvrSlice []Invoker
+	Metadata map[Invoker]Metadata
+	Revision int64
+}
+
+// 一个服务的Invoker集合
+// 添加和移除Invoker时在lock的保护下复制出一份新的Snapshot，修改之后通过snapshot原子地发布，调度器读取时不需要加锁
 type Servers struct {
-	RWLock   *sync.RWMutex      // 添加和移除server时使用
-	SvrMap   map[string]Invoker // Map 和 Slice 中保存的其实是同一份Server，并且保存的都只是指针，指向相同的Server对象
-	SvrSlice *[]Invoker
-	SvrCount int
+	lock     *sync.Mutex   // 添加和移除server时使用
+	snapshot *atomic.Value // *Snapshot
+	removed  bool          // 服务的最后一个Invoker被移除之后，该Servers会被移出ServerPool，不能再向其中添加Invoker
 }
 
 var (
-	ServerPool  = &sync.Map{}   // serviceName -> Servers 的映射
-	svrPoolLock = &sync.Mutex{} // 在向ServerPool中添加
+	ServerPool = &sync.Map{} // serviceName -> *Servers 的映射
 )
 
 const (
@@ -27,77 +112,151 @@ const (
 	RemoveInvokerErrorServerNotExists  = -2 // 移除Invoker时的状态码，表示Invoker不存在
 )
 
+func newServers() *Servers {
+	svrs := &Servers{lock: &sync.Mutex{}, snapshot: &atomic.Value{}}
+	svrs.snapshot.Store(&Snapshot{SvrMap: map[string]Invoker{}})
+	return svrs
+}
+
+// 返回当前的Snapshot，返回值不能被修改
+func (svrs *Servers) Snapshot() *Snapshot {
+	return svrs.snapshot.Load().(*Snapshot)
+}
+
 // 向ServerPool中添加一个Invoker
 func AddServer(serviceName, serverID string, invoker Invoker) (int, error) {
-	svrs, ok := ServerPool.Load(serviceName)
-	if ok {
-		serversInstance, _ := svrs.(Servers)
-		serversInstance.RWLock.Lock()
-		if _, exist := serversInstance.SvrMap[serverID]; exist {
-			serversInstance.RWLock.Unlock()
+	return AddServerWithMetadata(serviceName, serverID, invoker, nil)
+}
+
+// 向ServerPool中添加一个携带元数据的Invoker，元数据可以用于通过Selector选择实例的子集
+func AddServerWithMetadata(serviceName, serverID string, invoker Invoker, metadata Metadata) (int, error) {
+	for {
+		val, loaded := ServerPool.Load(serviceName)
+		if !loaded {
+			val, _ = ServerPool.LoadOrStore(serviceName, newServers())
+		}
+		svrs := val.(*Servers)
+		svrs.lock.Lock()
+		if svrs.removed {
+			// 在竞争锁时服务的最后一个Invoker被移除了，重新获取新的Servers，否则添加的Invoker会丢失
+			svrs.lock.Unlock()
+			continue
+		}
+		old := svrs.Snapshot()
+		if _, exist := old.SvrMap[serverID]; exist {
+			svrs.lock.Unlock()
 			return AddInvokerErrorRepeatAdd, errors.New("repeated add")
 		}
-		serversInstance.SvrMap[serverID] = invoker
-		*(serversInstance.SvrSlice) = append(*(serversInstance.SvrSlice), invoker)
-		serversInstance.RWLock.Unlock()
+		snapshot := &Snapshot{SvrMap: make(map[string]Invoker, len(old.SvrMap)+1), SvrSlice: make([]Invoker, 0, len(old.SvrSlice)+1),
+			Metadata: make(map[Invoker]Metadata, len(old.Metadata)+1)}
+		for id, svr := range old.SvrMap {
+			snapshot.SvrMap[id] = svr
+		}
+		for svr, md := range old.Metadata {
+			snapshot.Metadata[svr] = md
+		}
+		snapshot.SvrMap[serverID] = invoker
+		if metadata != nil {
+			snapshot.Metadata[invoker] = copyMetadata(metadata)
+		}
+		snapshot.SvrSlice = append(append(snapshot.SvrSlice, old.SvrSlice...), invoker)
+		svrs.publish(snapshot, Event{Type: EventAdd, ServiceName: serviceName, ServerID: serverID, Invoker: invoker})
+		svrs.lock.Unlock()
 		return 0, nil
 	}
-	svrPoolLock.Lock()
-	defer svrPoolLock.Unlock()
-	// 再次检查是因为担心在竞争锁时已经被其他的goroutine捷足先登，这样可能会导致被覆盖
-	if svrs, ok = ServerPool.Load(serviceName); ok {
-		return AddServer(serviceName, serverID, invoker)
-	}
-	svrs = Servers{RWLock: &sync.RWMutex{}, SvrMap: map[string]Invoker{serverID: invoker}, SvrSlice: &[]Invoker{invoker}}
-	ServerPool.Store(serviceName, svrs)
-	return 0, nil
 }
 
 // 移除一个已经关闭或者是已经长时间没有心跳的Invoker
 func RemoveInvoker(serviceName, serverID string) (int, error) {
-	svrs, ok := ServerPool.Load(serviceName)
+	val, ok := ServerPool.Load(serviceName)
 	if !ok {
 		return RemoveInvokerErrorServiceNotExists, errors.New("service doesn't exist")
 	}
-	serversInstance, _ := svrs.(Servers)
-	serversInstance.RWLock.Lock()
-	defer serversInstance.RWLock.Unlock()
+	svrs := val.(*Servers)
+	svrs.lock.Lock()
+	defer svrs.lock.Unlock()
+	old := svrs.Snapshot()
 	// 删除invoker 的逻辑
-	invoker, exist := serversInstance.SvrMap[serverID]
-	if !exist {
+	invoker, exist := old.SvrMap[serverID]
+	if !exist || svrs.removed {
 		return RemoveInvokerErrorServerNotExists, errors.New("server doesn't exist")
 	}
-	delete(serversInstance.SvrMap, serverID)
-	index := 0
-	for i, instance := range *serversInstance.SvrSlice {
-		if instance == invoker {
-			index = i
-			break
+	snapshot := &Snapshot{SvrMap: make(map[string]Invoker, len(old.SvrMap)), SvrSlice: make([]Invoker, 0, len(old.SvrSlice)),
+		Metadata: make(map[Invoker]Metadata, len(old.Metadata))}
+	for id, svr := range old.SvrMap {
+		if id != serverID {
+			snapshot.SvrMap[id] = svr
+		}
+	}
+	for svr, md := range old.Metadata {
+		if svr != invoker {
+			snapshot.Metadata[svr] = md
 		}
 	}
-	*serversInstance.SvrSlice = append((*serversInstance.SvrSlice)[0:index], (*serversInstance.SvrSlice)[index+1:]...)
-	if len(serversInstance.SvrMap) > 0 {
+	for _, svr := range old.SvrSlice {
+		if svr != invoker {
+			snapshot.SvrSlice = append(snapshot.SvrSlice, svr)
+		}
+	}
+	svrs.publish(snapshot, Event{Type: EventRemove, ServiceName: serviceName, ServerID: serverID, Invoker: invoker})
+	if len(snapshot.SvrMap) > 0 {
 		return 0, nil
 	}
-	svrPoolLock.Lock()
-	defer svrPoolLock.Unlock()
-	//if len(serversInstance.SvrMap) > 0 { // 这里再次检查是为了防止在加锁的过程中，又有新的Server注册，但后来发现Review时考虑到之前对serversInstance加了锁，所以这种情况不会发生
-	//	return 0, nil
-	//}
+	// 持有锁时标记并删除，之后的AddServer会创建新的Servers
+	svrs.removed = true
 	ServerPool.Delete(serviceName)
 	return 0, nil
 }
 
-// 根据服务名和服务器的ID返回一个Invoker
-func GetInvoker(serviceName, serverID string) (Invoker, error) {
-	serverInstance, ok := ServerPool.Load(serviceName)
+// 通知Invoker的信息（例如权重）发生了变化，订阅者会收到EventUpdate事件
+func UpdateServer(serviceName, serverID string) error {
+	val, ok := ServerPool.Load(serviceName)
+	if !ok {
+		return errors.New("service doesn't exist")
+	}
+	svrs := val.(*Servers)
+	svrs.lock.Lock()
+	defer svrs.lock.Unlock()
+	old := svrs.Snapshot()
+	invoker, exist := old.SvrMap[serverID]
+	if !exist || svrs.removed {
+		return errors.New("server doesn't exist")
+	}
+	// 成员没有变化，新的Snapshot可以和旧的共享Map和Slice
+	svrs.publish(&Snapshot{SvrMap: old.SvrMap, SvrSlice: old.SvrSlice, Metadata: old.Metadata},
+		Event{Type: EventUpdate, ServiceName: serviceName, ServerID: serverID, Invoker: invoker})
+	return nil
+}
+
+// 返回服务当前的Snapshot，调度器可以在不加锁的情况下遍历其中的Invoker，返回值不能被修改
+func GetSnapshot(serviceName string) (*Snapshot, error) {
+	val, ok := ServerPool.Load(serviceName)
 	if !ok {
 		return nil, errors.New("service doesn't exist")
 	}
-	svrs, _ := serverInstance.(Servers)
-	svrs.RWLock.RLock()
-	defer svrs.RWLock.RUnlock()
-	svr, ok := svrs.SvrMap[serverID]
+	return val.(*Servers).Snapshot(), nil
+}
+
+// 返回服务当前所有的Invoker，key为服务器的ID，返回的map是一份拷贝，可以随意修改
+func ListInvokers(serviceName string) (map[string]Invoker, error) {
+	snapshot, err := GetSnapshot(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	invokers := make(map[string]Invoker, len(snapshot.SvrMap))
+	for serverID, invoker := range snapshot.SvrMap {
+		invokers[serverID] = invoker
+	}
+	return invokers, nil
+}
+
+// 根据服务名和服务器的ID返回一个Invoker
+func GetInvoker(serviceName, serverID string) (Invoker, error) {
+	snapshot, err := GetSnapshot(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	svr, ok := snapshot.SvrMap[serverID]
 	if !ok {
 		return nil, errors.New("server doesn't exist")
 	}
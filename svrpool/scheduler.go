@@ -1,11 +1,41 @@
 package svrpool
 
-import "sync"
+import (
+	"errors"
+	"sync"
+)
 
 type Scheduler interface {
 	Select() (Invoker, error)
 }
 
+// 调度时附带的请求相关的信息
+// Selector 表示只能在满足选择器的实例中进行调度，例如路由规则要求 version=v2
+// RequestSize 表示请求体的字节数，流式的调用为0，调度器可以据此选择资源足够的实例
+type Hint struct {
+	Selector    Selector
+	RequestSize int
+}
+
+// 可以根据Hint进行调度的调度器
+type HintScheduler interface {
+	Scheduler
+	SelectWithHint(hint Hint) (Invoker, error)
+}
+
 var (
 	SchedulerPool = &sync.Map{}
+	// 有可用的实例，但是没有实例的资源足够处理该请求，例如请求需要的内存超过了所有实例的剩余内存
+	ErrNoCapacity = errors.New("no server has enough capacity for the request")
 )
+
+// 使用调度器选出一个Invoker，调度器没有实现HintScheduler时只能处理空的Hint
+func Select(scheduler Scheduler, hint Hint) (Invoker, error) {
+	if hintScheduler, ok := scheduler.(HintScheduler); ok {
+		return hintScheduler.SelectWithHint(hint)
+	}
+	if len(hint.Selector) > 0 {
+		return nil, errors.New("scheduler doesn't support selector")
+	}
+	return scheduler.Select()
+}
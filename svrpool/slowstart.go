@@ -0,0 +1,73 @@
+package svrpool
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// 慢启动的配置，刚开始提供服务的Invoker在Window内的有效权重从较小的值逐渐增加到配置的权重
+// 有效权重 = 权重 * max(MinWeightPercent / 100, (已经过的时间 / Window) ^ (1 / Aggression))
+// Aggression 为1时权重线性增长，大于1时开始阶段增长得更快，小于1时开始阶段增长得更慢，不大于0时按1处理
+type SlowStart struct {
+	Window           time.Duration
+	Aggression       float64
+	MinWeightPercent float64
+}
+
+// 需要慢启动的Invoker，StartTime 返回Invoker开始提供服务的时间（例如grpc连接进入READY的时间），零值表示还没有开始
+type WarmingInvoker interface {
+	Invoker
+	StartTime() time.Time
+}
+
+var (
+	slowStarts = &sync.Map{} // serviceName -> SlowStart
+)
+
+// 为服务设置慢启动，之后通过EffectiveWeight计算的权重会在Window内逐渐增加
+func SetSlowStart(serviceName string, config SlowStart) {
+	slowStarts.Store(serviceName, config)
+}
+
+func RemoveSlowStart(serviceName string) {
+	slowStarts.Delete(serviceName)
+}
+
+// 返回Invoker在调度时应该使用的权重，没有配置慢启动，Invoker没有实现WarmingInvoker接口，或者已经过了慢启动窗口时返回weight本身
+// 权重大于0的Invoker的有效权重至少为1，保证它总有机会被选中
+func EffectiveWeight(serviceName string, invoker Invoker, weight int32) int32 {
+	val, ok := slowStarts.Load(serviceName)
+	if !ok || weight <= 0 {
+		return weight
+	}
+	warming, ok := invoker.(WarmingInvoker)
+	if !ok {
+		return weight
+	}
+	config := val.(SlowStart)
+	start := warming.StartTime()
+	if start.IsZero() || config.Window <= 0 {
+		return weight
+	}
+	elapsed := time.Since(start)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if elapsed >= config.Window {
+		return weight
+	}
+	aggression := config.Aggression
+	if aggression <= 0 {
+		aggression = 1
+	}
+	factor := math.Pow(float64(elapsed)/float64(config.Window), 1/aggression)
+	if min := config.MinWeightPercent / 100; factor < min {
+		factor = min
+	}
+	effective := int32(float64(weight) * factor)
+	if effective < 1 {
+		effective = 1
+	}
+	return effective
+}
@@ -0,0 +1,230 @@
+package svrpool
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 成员变化的类型
+type EventType int
+
+const (
+	EventAdd    EventType = 1 // 添加了Invoker
+	EventRemove EventType = 2 // 移除了Invoker
+	EventUpdate EventType = 3 // Invoker的信息（例如权重）发生了变化
+)
+
+const (
+	historySize = 1024 // 每个服务最多保留的事件数，落后太多的订阅者会收到ErrCompacted
+)
+
+var (
+	ErrCompacted       = errors.New("required revision has been compacted")
+	ErrServiceNotFound = errors.New("service doesn't exist")
+
+	revision = int64(0)    // 全局的版本号，ServerPool每发生一次变化就加1
+	hubs     = &sync.Map{} // serviceName -> *watchHub，只在发布事件时创建，服务被移出ServerPool之后仍然保留，以便订阅者继续接收事件
+)
+
+// 一次成员变化，Revision 是变化之后的版本号，在所有服务之间单调递增
+// Invoker 对于EventRemove是被移除的Invoker
+type Event struct {
+	Type        EventType `json:"type"`
+	ServiceName string    `json:"serviceName"`
+	ServerID    string    `json:"serverID"`
+	Invoker     Invoker   `json:"-"`
+	Revision    int64     `json:"revision"`
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "add"
+	case EventRemove:
+		return "remove"
+	case EventUpdate:
+		return "update"
+	}
+	return "unknown"
+}
+
+// 一个服务最近的事件
+type watchHub struct {
+	lock      *sync.Mutex
+	events    []Event
+	compacted int64         // 已经被丢弃的最新事件的版本号
+	changed   chan struct{} // 有新的事件时被关闭并替换，用来唤醒等待中的订阅者
+}
+
+// 返回服务的watchHub，服务从来没有发布过事件时返回nil
+// 订阅不会创建watchHub，否则任意的服务名都会留下一个永远不会被清除的watchHub
+func getHub(serviceName string) *watchHub {
+	if val, ok := hubs.Load(serviceName); ok {
+		return val.(*watchHub)
+	}
+	return nil
+}
+
+// 返回服务的watchHub，不存在时创建，只在发布事件时调用
+func createHub(serviceName string) *watchHub {
+	if hub := getHub(serviceName); hub != nil {
+		return hub
+	}
+	val, _ := hubs.LoadOrStore(serviceName, &watchHub{lock: &sync.Mutex{}, changed: make(chan struct{})})
+	return val.(*watchHub)
+}
+
+// 返回ServerPool当前的版本号，从该版本号开始Watch可以收到之后所有的变化
+func Revision() int64 {
+	return atomic.LoadInt64(&revision)
+}
+
+// 发布新的Snapshot并记录事件，调用方需要持有svrs.lock，从而保证同一个服务的事件按照版本号的顺序记录
+func (svrs *Servers) publish(snapshot *Snapshot, event Event) {
+	event.Revision = atomic.AddInt64(&revision, 1)
+	snapshot.Revision = event.Revision
+	svrs.snapshot.Store(snapshot)
+
+	hub := createHub(event.ServiceName)
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.events = append(hub.events, event)
+	if len(hub.events) > 2*historySize {
+		dropped := len(hub.events) - historySize
+		hub.compacted = hub.events[dropped-1].Revision
+		hub.events = append([]Event(nil), hub.events[dropped:]...)
+	}
+	close(hub.changed)
+	hub.changed = make(chan struct{})
+}
+
+// 返回版本号大于after的事件，after已经被丢弃时返回ErrCompacted
+func (hub *watchHub) since(after int64) ([]Event, <-chan struct{}, error) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if after < hub.compacted {
+		return nil, nil, ErrCompacted
+	}
+	i := len(hub.events)
+	for i > 0 && hub.events[i-1].Revision > after {
+		i--
+	}
+	return append([]Event(nil), hub.events[i:]...), hub.changed, nil
+}
+
+// 订阅一个服务的成员变化
+// 事件从C中按照版本号的顺序读取，订阅者处理得慢不会阻塞ServerPool，但是落后超过historySize个事件之后，
+// C会被关闭，Err返回ErrCompacted，此时需要重新通过GetSnapshot获取全量的Invoker，再从Snapshot的Revision开始订阅
+type Watcher struct {
+	C    <-chan Event
+	c    chan Event
+	stop chan struct{}
+	once *sync.Once
+	err  error
+}
+
+// Watch 从版本号fromRevision之后开始订阅服务的成员变化，fromRevision可以是之前收到的最后一个事件的版本号，
+// 或者Snapshot的Revision，或者Revision()的返回值（只订阅之后的变化）
+// 服务从来没有添加过Invoker时返回ErrServiceNotFound，已经被移出ServerPool的服务仍然可以订阅
+func Watch(serviceName string, fromRevision int64) (*Watcher, error) {
+	hub := getHub(serviceName)
+	if hub == nil {
+		return nil, ErrServiceNotFound
+	}
+	if _, _, err := hub.since(fromRevision); err != nil {
+		return nil, err
+	}
+	c := make(chan Event, 64)
+	watcher := &Watcher{C: c, c: c, stop: make(chan struct{}), once: &sync.Once{}}
+	go watcher.run(hub, fromRevision)
+	return watcher, nil
+}
+
+func (watcher *Watcher) run(hub *watchHub, next int64) {
+	defer close(watcher.c)
+	for {
+		events, changed, err := hub.since(next)
+		if err != nil {
+			watcher.err = err
+			return
+		}
+		for _, event := range events {
+			select {
+			case watcher.c <- event:
+				next = event.Revision
+			case <-watcher.stop:
+				return
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-watcher.stop:
+			return
+		}
+	}
+}
+
+// 取消订阅，之后C会被关闭
+func (watcher *Watcher) Close() {
+	watcher.once.Do(func() {
+		close(watcher.stop)
+	})
+}
+
+// C被关闭之后返回关闭的原因，由Close关闭时返回nil
+func (watcher *Watcher) Err() error {
+	return watcher.err
+}
+
+// WatchHandler 以长轮询的方式提供成员变化，用于dashboard等外部的订阅者
+// GET ?service=xxx&revision=n 返回请求所属租户的服务中版本号大于n的事件，没有事件时最多等待30秒，不指定revision时只等待之后的变化
+// 返回的revision用于下一次请求，版本号已经被丢弃时返回410，需要不带revision重新开始，服务不存在时返回404
+func WatchHandler(c *gin.Context) {
+	serviceName, valid := qualify(c)
+	after := Revision()
+	var err error
+	if val, ok := c.GetQuery("revision"); ok {
+		after, err = strconv.ParseInt(val, 10, 64)
+	}
+	if !valid || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": -1, "msg": "service and revision are required", "rsp": nil})
+		return
+	}
+	hub := getHub(serviceName)
+	if _, err := GetSnapshot(serviceName); err != nil || hub == nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": -1, "msg": ErrServiceNotFound.Error(), "rsp": nil})
+		return
+	}
+	events, changed, err := hub.since(after)
+	if err == nil && len(events) == 0 {
+		select {
+		case <-changed:
+			events, _, err = hub.since(after)
+		case <-time.After(30 * time.Second):
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusGone, gin.H{"code": -1, "msg": err.Error(), "rsp": nil})
+		return
+	}
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].Revision
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "Success", "rsp": gin.H{"events": events, "revision": next}})
+}
@@ -0,0 +1,57 @@
+package svrpool
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testInvoker struct{}
+
+func (invoker *testInvoker) Invoke(req []byte) ([]byte, error) {
+	return req, nil
+}
+
+func TestWatchHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	serviceName := "TestWatchHandler"
+	from := Revision()
+	if _, err := AddServer(serviceName, "s1", &testInvoker{}); err != nil {
+		t.Fatal(err)
+	}
+	defer ServerPool.Delete(serviceName)
+	router := gin.New()
+	router.GET("/stats/pool/watch", WatchHandler)
+
+	cases := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"existing service", "?service=" + serviceName + "&revision=" + strconv.FormatInt(from, 10), http.StatusOK},
+		{"unknown service", "?service=NoSuchService&revision=0", http.StatusNotFound},
+		{"other tenant", "?service=teamA/" + serviceName + "&revision=0", http.StatusBadRequest},
+		{"missing service", "?revision=0", http.StatusBadRequest},
+		{"bad revision", "?service=" + serviceName + "&revision=x", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/pool/watch"+c.query, nil))
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+	// 订阅不存在的服务不会留下watchHub
+	if _, ok := hubs.Load("NoSuchService"); ok {
+		t.Error("watching an unknown service created a hub")
+	}
+	if _, err := Watch("NoSuchService", 0); err != ErrServiceNotFound {
+		t.Errorf("Watch unknown service: err = %v, want %v", err, ErrServiceNotFound)
+	}
+	if _, ok := hubs.Load("NoSuchService"); ok {
+		t.Error("Watch created a hub for an unknown service")
+	}
+}
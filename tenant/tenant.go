@@ -0,0 +1,229 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	Separator = "/" // 租户与服务名之间的分隔符，租户 teamA 的服务 SortService 在svrpool中的名字为 teamA/SortService
+
+	contextKey = "tenant.name"
+)
+
+var (
+	ErrInvalidName = errors.New("service name should not contain " + Separator)
+	ErrMismatch    = errors.New("credential doesn't belong to the tenant of this request")
+)
+
+// 一个租户，不同租户的服务，调度器，路由规则和限额都是相互隔离的
+// Hosts 是属于该租户的域名，PathPrefix 是属于该租户的路径前缀，例如 /teamA，转发之前会去掉该前缀
+// RateLimit 和 Burst 表示整个租户每秒允许的请求数和突发请求数，为0表示不限制
+// 不属于任何租户的请求属于默认租户，默认租户的名字为空字符串，其服务名不带前缀
+type Tenant struct {
+	Name       string   `json:"name"`
+	Hosts      []string `json:"hosts,omitempty"`
+	PathPrefix string   `json:"pathPrefix,omitempty"`
+	RateLimit  int64    `json:"rateLimit,omitempty"`
+	Burst      int64    `json:"burst,omitempty"`
+}
+
+type tenantFile struct {
+	Tenants []*Tenant `json:"tenants"`
+}
+
+type registry struct {
+	tenants  []*Tenant
+	byHost   map[string]*Tenant
+	prefixes []*Tenant // 按照前缀长度从长到短排序，优先匹配更长的前缀
+}
+
+type ctxKey struct{}
+
+var (
+	current = &atomic.Value{} // *registry
+)
+
+func init() {
+	current.Store(&registry{byHost: map[string]*Tenant{}})
+}
+
+// 设置所有的租户，会覆盖之前的设置
+func SetTenants(tenants []*Tenant) error {
+	reg := &registry{byHost: map[string]*Tenant{}}
+	names := map[string]bool{}
+	for _, t := range tenants {
+		if t.Name == "" || strings.Contains(t.Name, Separator) {
+			return errors.New("invalid tenant name " + t.Name)
+		}
+		if names[t.Name] {
+			return errors.New("duplicate tenant " + t.Name)
+		}
+		names[t.Name] = true
+		if t.RateLimit < 0 || t.Burst < 0 {
+			return errors.New("rate limit and burst of tenant " + t.Name + " should not be negative")
+		}
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if _, ok := reg.byHost[host]; ok {
+				return errors.New("host " + host + " belongs to more than one tenant")
+			}
+			reg.byHost[host] = t
+		}
+		if t.PathPrefix != "" {
+			if !strings.HasPrefix(t.PathPrefix, "/") || strings.HasSuffix(t.PathPrefix, "/") {
+				return errors.New("path prefix of tenant " + t.Name + " should start with / and not end with /")
+			}
+			reg.prefixes = append(reg.prefixes, t)
+		}
+		reg.tenants = append(reg.tenants, t)
+	}
+	sort.Slice(reg.prefixes, func(i, j int) bool { return len(reg.prefixes[i].PathPrefix) > len(reg.prefixes[j].PathPrefix) })
+	current.Store(reg)
+	return nil
+}
+
+// 从JSON文件中加载租户，格式为
+// {"tenants": [{"name": "teamA", "hosts": ["a.example.com"], "pathPrefix": "/teamA", "rateLimit": 1000, "burst": 2000}]}
+func LoadTenants(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file tenantFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return err
+	}
+	return SetTenants(file.Tenants)
+}
+
+// 返回所有的租户，不包括默认租户
+func List() []*Tenant {
+	return current.Load().(*registry).tenants
+}
+
+// 根据域名返回租户，域名可以带有端口，不属于任何租户时返回默认租户
+func FromHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := current.Load().(*registry).byHost[strings.ToLower(host)]; ok {
+		return t.Name
+	}
+	return ""
+}
+
+// Handler 在路由之前根据域名和路径前缀确定请求所属的租户，域名优先
+// 通过路径前缀确定租户时会去掉该前缀，所以各个租户可以使用相同的路由，例如 /teamA/sortService 会被当作 /sortService 处理
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := FromHost(r.Host)
+		if name == "" {
+			for _, t := range current.Load().(*registry).prefixes {
+				if r.URL.Path == t.PathPrefix || strings.HasPrefix(r.URL.Path, t.PathPrefix+"/") {
+					name = t.Name
+					r.URL.Path = strings.TrimPrefix(r.URL.Path, t.PathPrefix)
+					if r.URL.Path == "" {
+						r.URL.Path = "/"
+					}
+					r.URL.RawPath = ""
+					break
+				}
+			}
+		}
+		if name != "" {
+			r = r.WithContext(NewContext(r.Context(), name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 返回携带租户的context，用于原生grpc请求
+func NewContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, name)
+}
+
+// 返回原生grpc请求所属的租户，优先使用NewContext设置的租户，其次根据 :authority 确定
+func FromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(ctxKey{}).(string); ok {
+		return name
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(":authority"); len(values) > 0 {
+			return FromHost(values[0])
+		}
+	}
+	return ""
+}
+
+// 返回HTTP请求所属的租户
+func Get(c *gin.Context) string {
+	if name, ok := c.Get(contextKey); ok {
+		return name.(string)
+	}
+	return FromContext(c.Request.Context())
+}
+
+// Bind 将请求绑定到凭证（例如API key）所属的租户上，凭证不属于任何租户时不做处理
+// 请求已经通过域名或者路径前缀确定了其他租户时返回ErrMismatch，避免使用一个租户的凭证访问另一个租户
+func Bind(c *gin.Context, name string) error {
+	if name == "" {
+		return nil
+	}
+	if resolved := Get(c); resolved != "" && resolved != name {
+		return ErrMismatch
+	}
+	c.Set(contextKey, name)
+	return nil
+}
+
+// 返回租户中的服务在svrpool等注册表中的名字
+func Qualify(tenant, serviceName string) string {
+	if tenant == "" {
+		return serviceName
+	}
+	return tenant + Separator + serviceName
+}
+
+// 将注册表中的名字拆分成租户和服务名
+func Split(qualified string) (string, string) {
+	if i := strings.Index(qualified, Separator); i >= 0 {
+		return qualified[:i], qualified[i+1:]
+	}
+	return "", qualified
+}
+
+// 判断注册表中的服务名或者路由规则中的路由是否属于租户，用于只向租户返回自己的统计信息
+func Owns(name, qualified string) bool {
+	ns, _ := Split(qualified)
+	return ns == name
+}
+
+// Service 将客户端指定的服务名转换成注册表中的名字
+// 客户端指定的服务名不能带有分隔符，所以只能访问请求所属租户的服务
+func Service(c *gin.Context, serviceName string) (string, error) {
+	if strings.Contains(serviceName, Separator) {
+		return "", ErrInvalidName
+	}
+	return Qualify(Get(c), serviceName), nil
+}
+
+// Route 返回请求的路由在路由规则中的名字，默认租户为gin中注册的路由，例如 /sortService，其他租户带有租户的前缀，例如 teamA/sortService
+func Route(c *gin.Context) string {
+	return Get(c) + c.FullPath()
+}
+
+// 返回原生grpc请求在路由规则中的名字，例如 teamA/sortService.SortService/Sort
+func GrpcRoute(ctx context.Context, fullMethod string) string {
+	return FromContext(ctx) + fullMethod
+}
@@ -0,0 +1,94 @@
+package tenant
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	if err := SetTenants([]*Tenant{
+		{Name: "teamA", Hosts: []string{"a.example.com"}, PathPrefix: "/teamA"},
+		{Name: "teamB", PathPrefix: "/teamB"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTenants(nil)
+
+	cases := []struct {
+		name       string
+		host       string
+		target     string
+		wantTenant string
+		wantPath   string
+	}{
+		{"default tenant", "gw.example.com", "/sortService", "", "/sortService"},
+		{"prefix is stripped", "gw.example.com", "/teamA/sortService", "teamA", "/sortService"},
+		{"prefix only", "gw.example.com", "/teamB", "teamB", "/"},
+		{"prefix with slash", "gw.example.com", "/teamB/", "teamB", "/"},
+		{"query is kept", "gw.example.com", "/teamB/sortService?service=SortService", "teamB", "/sortService"},
+		{"prefix must be a path segment", "gw.example.com", "/teamAB/sortService", "", "/teamAB/sortService"},
+		{"host", "a.example.com", "/sortService", "teamA", "/sortService"},
+		{"host with port", "a.example.com:8080", "/sortService", "teamA", "/sortService"},
+		// 通过域名确定租户之后不再处理路径前缀
+		{"host wins over prefix", "a.example.com", "/teamB/sortService", "teamA", "/teamB/sortService"},
+		{"escaped path", "gw.example.com", "/teamA/a%2Fb", "teamA", "/a/b"},
+	}
+	for _, c := range cases {
+		var gotTenant, gotPath, gotURI string
+		handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotTenant, gotPath, gotURI = FromContext(r.Context()), r.URL.Path, r.RequestURI
+		}))
+		req := httptest.NewRequest(http.MethodGet, c.target, nil)
+		req.Host = c.host
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if gotTenant != c.wantTenant || gotPath != c.wantPath {
+			t.Errorf("%s: tenant = %q, path = %q, want %q, %q", c.name, gotTenant, gotPath, c.wantTenant, c.wantPath)
+		}
+		// 原始的路径保留在RequestURI中，用于校验签名
+		if gotURI != c.target {
+			t.Errorf("%s: request uri = %q, want %q", c.name, gotURI, c.target)
+		}
+	}
+}
+
+func TestQualifyAndSplit(t *testing.T) {
+	cases := []struct {
+		tenant    string
+		service   string
+		qualified string
+	}{
+		{"", "SortService", "SortService"},
+		{"teamA", "SortService", "teamA/SortService"},
+	}
+	for _, c := range cases {
+		if got := Qualify(c.tenant, c.service); got != c.qualified {
+			t.Errorf("Qualify(%q, %q) = %q, want %q", c.tenant, c.service, got, c.qualified)
+		}
+		if tenant, service := Split(c.qualified); tenant != c.tenant || service != c.service {
+			t.Errorf("Split(%q) = %q, %q, want %q, %q", c.qualified, tenant, service, c.tenant, c.service)
+		}
+	}
+}
+
+func TestOwns(t *testing.T) {
+	cases := []struct {
+		tenant    string
+		qualified string
+		want      bool
+	}{
+		{"", "SortService", true},
+		{"", "/sortService", true},
+		{"", "teamA/SortService", false},
+		{"teamA", "teamA/SortService", true},
+		{"teamA", "teamA/sortService.SortService/Sort", true},
+		{"teamA", "SortService", false},
+		{"teamA", "/sortService", false},
+		{"teamA", "teamB/SortService", false},
+	}
+	for _, c := range cases {
+		if got := Owns(c.tenant, c.qualified); got != c.want {
+			t.Errorf("Owns(%q, %q) = %v, want %v", c.tenant, c.qualified, got, c.want)
+		}
+	}
+}
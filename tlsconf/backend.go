@@ -0,0 +1,88 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// 网关访问某个服务的后端时使用的TLS配置
+// CAFile 用于校验后端的证书，为空时使用系统的根证书
+// CertFile 和 KeyFile 是网关的客户端证书，都不为空时启用mTLS
+// ServerName 用于校验后端证书中的名字，为空时使用拨号的地址
+type BackendTLS struct {
+	CAFile     string `json:"caFile"`
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+	ServerName string `json:"serverName"`
+}
+
+var (
+	backendTLS = &sync.Map{} // serviceName -> *BackendTLS
+)
+
+// 为服务设置访问后端时的TLS配置
+func SetBackendTLS(serviceName string, config *BackendTLS) {
+	backendTLS.Store(serviceName, config)
+}
+
+// 从JSON文件中加载各个服务的TLS配置，格式为 {"SortService": {"caFile": "...", ...}}
+func LoadBackendTLS(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	configs := map[string]*BackendTLS{}
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return err
+	}
+	for serviceName, config := range configs {
+		SetBackendTLS(serviceName, config)
+	}
+	return nil
+}
+
+// DialOption 返回拨号连接服务的后端时使用的传输层选项，没有配置TLS的服务使用明文连接
+// 客户端证书在每次TLS握手时重新读取，所以证书轮换之后，已有的ClientConn重新连接时也会使用新的证书
+func DialOption(serviceName string) (grpc.DialOption, error) {
+	val, ok := backendTLS.Load(serviceName)
+	if !ok {
+		return grpc.WithInsecure(), nil
+	}
+	tlsConfig, err := val.(*BackendTLS).clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// 返回连接后端时使用的tls配置
+func (config *BackendTLS) clientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.ServerName, MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pool, err := loadCAPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" && config.KeyFile != "" {
+		// 拨号时先加载一次，证书配置错误时尽早返回错误
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return nil, err
+		}
+		certFile, keyFile := config.CertFile, config.KeyFile
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,51 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+)
+
+func TestClientCertificateRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := writeCert(t, dir, "client", "v1.client.example.com")
+	config, err := (&BackendTLS{CertFile: file.CertFile, KeyFile: file.KeyFile}).clientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		rotate  func()
+		want    string
+		wantErr bool
+	}{
+		{"initial", func() {}, "v1.client.example.com", false},
+		// 同一个tls.Config在之后的握手中使用轮换之后的证书
+		{"rotated", func() { writeCert(t, dir, "client", "v2.client.example.com") }, "v2.client.example.com", false},
+		{"removed", func() { os.Remove(file.KeyFile) }, "", true},
+	}
+	for _, c := range cases {
+		c.rotate()
+		cert, err := config.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.DNSNames[0] != c.want {
+			t.Errorf("%s: client certificate = %q, want %q", c.name, leaf.DNSNames[0], c.want)
+		}
+	}
+
+	if _, err := (&BackendTLS{CertFile: file.CertFile, KeyFile: file.KeyFile}).clientConfig(); err == nil {
+		t.Error("missing key should be reported when dialing")
+	}
+}
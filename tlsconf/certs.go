@@ -0,0 +1,192 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 一对证书和私钥文件
+type CertFile struct {
+	CertFile string
+	KeyFile  string
+}
+
+type loadedCert struct {
+	file       CertFile
+	cert       *tls.Certificate
+	modTime    time.Time // 证书文件的修改时间
+	keyModTime time.Time // 私钥文件的修改时间
+}
+
+// 网关对外提供HTTPS时使用的证书集合
+// 握手时根据客户端的SNI选择证书，证书中的DNSNames（支持 *.example.com 形式的通配符）都会参与匹配，
+// 匹配不到时使用第一个证书。证书或者私钥文件被替换之后会被自动重新加载
+type CertStore struct {
+	lock   *sync.RWMutex
+	certs  []*loadedCert
+	byName map[string]*tls.Certificate
+}
+
+func NewCertStore(files []CertFile) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("at least one certificate is required")
+	}
+	store := &CertStore{lock: &sync.RWMutex{}}
+	for _, file := range files {
+		loaded, err := loadCert(file)
+		if err != nil {
+			return nil, err
+		}
+		store.certs = append(store.certs, loaded)
+	}
+	store.index()
+	return store, nil
+}
+
+func loadCert(file CertFile) (*loadedCert, error) {
+	modTime, keyModTime, err := modTimes(file)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &loadedCert{file: file, cert: &cert, modTime: modTime, keyModTime: keyModTime}, nil
+}
+
+// 返回证书文件和私钥文件的修改时间
+func modTimes(file CertFile) (time.Time, time.Time, error) {
+	info, err := os.Stat(file.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(file.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return info.ModTime(), keyInfo.ModTime(), nil
+}
+
+// 在持有写锁（或者初始化）时重建 名字 -> 证书 的索引
+func (store *CertStore) index() {
+	byName := map[string]*tls.Certificate{}
+	for _, loaded := range store.certs {
+		names := loaded.cert.Leaf.DNSNames
+		if len(names) == 0 && loaded.cert.Leaf.Subject.CommonName != "" {
+			names = []string{loaded.cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			if _, exist := byName[strings.ToLower(name)]; !exist {
+				byName[strings.ToLower(name)] = loaded.cert
+			}
+		}
+	}
+	store.byName = byName
+}
+
+// GetCertificate 用于tls.Config，根据SNI选择证书
+func (store *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := store.byName[name]; ok {
+		return cert, nil
+	}
+	// 去掉最左边的一级，尝试匹配通配符证书
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := store.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return store.certs[0].cert, nil
+}
+
+// Watch 每隔interval检查一次证书和私钥文件，任意一个文件被修改之后重新加载，加载失败时继续使用之前的证书
+func (store *CertStore) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			store.reload()
+		}
+	}()
+}
+
+func (store *CertStore) reload() {
+	store.lock.RLock()
+	var changed []int
+	for i, loaded := range store.certs {
+		modTime, keyModTime, err := modTimes(loaded.file)
+		if err == nil && (!modTime.Equal(loaded.modTime) || !keyModTime.Equal(loaded.keyModTime)) {
+			changed = append(changed, i)
+		}
+	}
+	store.lock.RUnlock()
+	for _, i := range changed {
+		file := store.certs[i].file
+		loaded, err := loadCert(file)
+		if err != nil {
+			// 证书和私钥可能还没有全部替换完成，下一次检查时再重试
+			log.Println("reload certificate", file.CertFile, "failed, the err is", err)
+			continue
+		}
+		store.lock.Lock()
+		store.certs[i] = loaded
+		store.index()
+		store.lock.Unlock()
+		log.Println("certificate", file.CertFile, "reloaded")
+	}
+}
+
+// ServerConfig 返回网关对外监听时使用的tls配置
+// clientCAFile 不为空时会校验客户端证书（客户端可以不提供证书），用于后端注册时的mTLS认证
+func ServerConfig(store *CertStore, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCAFile != "" {
+		pool, err := loadCAPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}
+
+// 解析形如 cert1.pem:key1.pem,cert2.pem:key2.pem 的证书列表
+func ParseCertFiles(s string) ([]CertFile, error) {
+	var files []CertFile
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("certificate should be in the form of cert:key")
+		}
+		files = append(files, CertFile{CertFile: parts[0], KeyFile: parts[1]})
+	}
+	return files, nil
+}
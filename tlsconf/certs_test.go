@@ -0,0 +1,183 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 在dir中生成名为name的自签名证书，CommonName也是name
+func writeCert(t *testing.T, dir, name string, dnsNames ...string) CertFile {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := CertFile{CertFile: filepath.Join(dir, name+".pem"), KeyFile: filepath.Join(dir, name+".key")}
+	if err := ioutil.WriteFile(file.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tlsconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := NewCertStore([]CertFile{
+		writeCert(t, dir, "default", "gateway.example.com"),
+		writeCert(t, dir, "wildcard", "*.example.com"),
+		writeCert(t, dir, "api", "api.example.com", "api.example.org"),
+		// 没有DNSNames时使用CommonName
+		writeCert(t, dir, "legacy.example.net"),
+		// 和前面的证书名字重复时使用先配置的证书
+		writeCert(t, dir, "duplicate", "api.example.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		serverName string
+		want       string
+	}{
+		{"gateway.example.com", "default"},
+		{"api.example.com", "api"},
+		{"API.Example.COM", "api"},
+		{"api.example.org", "api"},
+		{"other.example.com", "wildcard"},
+		// 通配符只匹配一级
+		{"a.b.example.com", "default"},
+		{"example.com", "default"},
+		{"legacy.example.net", "legacy.example.net"},
+		{"unknown.test", "default"},
+		{"", "default"},
+	}
+	for _, c := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != c.want {
+			t.Errorf("GetCertificate(%q) = %q, want %q", c.serverName, got, c.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store, err := NewCertStore([]CertFile{
+		writeCert(t, dir, "default", "default.example.com"),
+		writeCert(t, dir, "site", "old.example.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 准备好用于替换的证书和私钥
+	other := tempDir(t)
+	defer os.RemoveAll(other)
+	pending := writeCert(t, other, "site", "new.example.com")
+
+	cases := []struct {
+		name    string
+		replace func()
+		wantOld string // old.example.com 选择的证书中的名字
+		wantNew string // new.example.com 选择的证书中的名字
+	}{
+		{"not modified", func() {}, "old.example.com", "default.example.com"},
+		// 只替换了证书，还没有替换私钥，继续使用之前的证书
+		{"key not replaced", func() {
+			replaceFile(t, filepath.Join(dir, "site.pem"), pending.CertFile, 1)
+		}, "old.example.com", "default.example.com"},
+		// 之后只有私钥文件发生变化，也会重新加载，并且按照新的名字建立索引
+		{"key replaced", func() {
+			replaceFile(t, filepath.Join(dir, "site.key"), pending.KeyFile, 2)
+		}, "default.example.com", "new.example.com"},
+		{"both replaced", func() {
+			writeCert(t, dir, "site", "newer.example.com")
+			modTime := time.Now().Add(3 * time.Minute)
+			os.Chtimes(filepath.Join(dir, "site.pem"), modTime, modTime)
+		}, "default.example.com", "default.example.com"},
+	}
+	for _, c := range cases {
+		c.replace()
+		store.reload()
+		for serverName, want := range map[string]string{"old.example.com": c.wantOld, "new.example.com": c.wantNew} {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cert.Leaf.DNSNames[0]; got != want {
+				t.Errorf("%s: GetCertificate(%q) = %q, want %q", c.name, serverName, got, want)
+			}
+		}
+	}
+}
+
+// 用src的内容替换dst，并且把dst的修改时间推后minutes分钟，保证修改时间发生变化
+func replaceFile(t *testing.T, dst, src string, minutes int) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(minutes) * time.Minute)
+	os.Chtimes(dst, modTime, modTime)
+}
+
+func TestParseCertFiles(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    []CertFile
+		wantErr bool
+	}{
+		{"a.pem:a.key", []CertFile{{CertFile: "a.pem", KeyFile: "a.key"}}, false},
+		{"a.pem:a.key, b.pem:b.key", []CertFile{{CertFile: "a.pem", KeyFile: "a.key"}, {CertFile: "b.pem", KeyFile: "b.key"}}, false},
+		{"a.pem", nil, true},
+		{"a.pem:a.key:extra", nil, true},
+	}
+	for _, c := range cases {
+		got, err := ParseCertFiles(c.s)
+		if (err != nil) != c.wantErr || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseCertFiles(%q) = %v, %v, want %v, wantErr %v", c.s, got, err, c.want, c.wantErr)
+		}
+	}
+}